@@ -0,0 +1,393 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argoWorkflows
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultTimeout      = 30 * time.Minute
+
+	// pod names are built the way Argo Workflows builds them, the
+	// <workflow>-<template> prefix is truncated to leave room for the hash
+	maxK8sResourceNameLength = 253
+	k8sNamingHashLength      = 10
+	maxPodNamePrefixLength   = maxK8sResourceNameLength - k8sNamingHashLength - 1
+)
+
+// ClientConfig configures an Argo Workflows Client
+type ClientConfig struct {
+	// BaseURL is the Argo Server address, defaults to the local port-forward
+	BaseURL string
+	// Namespace workflows are submitted to, defaults to argo
+	Namespace string
+	// Token is sent as a bearer token when the Argo Server uses client auth
+	Token string
+	// CABundle is a PEM encoded CA bundle used to verify the Argo Server
+	CABundle []byte
+	// InsecureSkipVerify disables server certificate verification, the Argo
+	// Server uses a self-signed certificate by default
+	InsecureSkipVerify bool
+	// HTTPClient overrides the http client, CABundle and InsecureSkipVerify are
+	// ignored when it is set
+	HTTPClient pkg.HTTPDoer
+}
+
+// Client talks to the Argo Workflows server API
+type Client struct {
+	baseURL    string
+	namespace  string
+	token      string
+	httpClient pkg.HTTPDoer
+}
+
+// SubmitOptions configures a workflow submitted from a WorkflowTemplate
+type SubmitOptions struct {
+	// Parameters override the template arguments
+	Parameters map[string]string
+	Labels     map[string]string
+	// GenerateName defaults to the template name followed by a dash
+	GenerateName   string
+	ServiceAccount string
+	// ClusterTemplate submits from a ClusterWorkflowTemplate
+	ClusterTemplate bool
+}
+
+// WaitOptions configures WaitForWorkflow
+type WaitOptions struct {
+	// Timeout defaults to 30 minutes
+	Timeout time.Duration
+	// PollInterval defaults to 5 seconds
+	PollInterval time.Duration
+	// NodeHandler is called each time a node changes phase, it defaults to
+	// logging the change
+	NodeHandler func(workflow string, node NodeStatus)
+}
+
+// NewClient returns an Argo Workflows client
+func NewClient(config ClientConfig) (*Client, error) {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("https://localhost:%d", pkg.ArgoPodLocalPort)
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid argo workflows base url %q: %s", baseURL, err)
+	}
+
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = pkg.ArgoNamespace
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+		if len(config.CABundle) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(config.CABundle) {
+				return nil, fmt.Errorf("unable to parse argo workflows ca bundle")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		// log streams stay open for as long as the pod runs, so requests are
+		// bound by their context rather than a client timeout
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	return &Client{
+		baseURL:    baseURL,
+		namespace:  namespace,
+		token:      config.Token,
+		httpClient: httpClient,
+	}, nil
+}
+
+// SubmitFromTemplate submits a Workflow from a WorkflowTemplate and returns the
+// created Workflow
+func (c *Client) SubmitFromTemplate(ctx context.Context, template string, opts SubmitOptions) (*Workflow, error) {
+	generateName := opts.GenerateName
+	if generateName == "" {
+		generateName = template + "-"
+	}
+
+	parameters := make([]string, 0, len(opts.Parameters))
+	for key, value := range opts.Parameters {
+		parameters = append(parameters, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(parameters)
+
+	labels := make([]string, 0, len(opts.Labels))
+	for key, value := range opts.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(labels)
+
+	kind := "WorkflowTemplate"
+	if opts.ClusterTemplate {
+		kind = "ClusterWorkflowTemplate"
+	}
+
+	request := submitRequest{
+		Namespace:    c.namespace,
+		ResourceKind: kind,
+		ResourceName: template,
+		SubmitOptions: submitOptions{
+			GenerateName:   generateName,
+			Labels:         strings.Join(labels, ","),
+			Parameters:     parameters,
+			ServiceAccount: opts.ServiceAccount,
+		},
+	}
+
+	workflow := &Workflow{}
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/v1/workflows/%s/submit", url.PathEscape(c.namespace)), request, workflow)
+	if err != nil {
+		return nil, fmt.Errorf("error submitting workflow from template %s: %s", template, err)
+	}
+	log.Info().Msgf("submitted workflow %s from template %s", workflow.Metadata.Name, template)
+
+	return workflow, nil
+}
+
+// GetWorkflow returns a Workflow
+func (c *Client) GetWorkflow(ctx context.Context, name string) (*Workflow, error) {
+	workflow := &Workflow{}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/workflows/%s/%s", url.PathEscape(c.namespace), url.PathEscape(name)), nil, workflow)
+	if err != nil {
+		return nil, fmt.Errorf("error getting workflow %s: %s", name, err)
+	}
+
+	return workflow, nil
+}
+
+// WaitForWorkflow follows a Workflow until it completes, reporting node phase
+// changes as they happen
+//
+// An error is returned if the Workflow does not succeed, along with the final
+// Workflow so failed nodes can be inspected
+func (c *Client) WaitForWorkflow(ctx context.Context, name string, opts WaitOptions) (*Workflow, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.NodeHandler == nil {
+		opts.NodeHandler = func(workflow string, node NodeStatus) {
+			log.Info().Msgf("workflow %s: %s %s", workflow, node.DisplayName, node.Phase)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	phases := make(map[string]string)
+	for {
+		workflow, err := c.GetWorkflow(ctx, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timed out waiting for workflow %s: %s", name, err)
+			}
+			log.Warn().Msgf("%s, retrying", err)
+		} else {
+			for _, node := range SortedNodes(workflow) {
+				if phases[node.ID] != node.Phase {
+					phases[node.ID] = node.Phase
+					opts.NodeHandler(name, node)
+				}
+			}
+
+			if Completed(workflow.Status.Phase) {
+				if workflow.Status.Phase != PhaseSucceeded {
+					return workflow, fmt.Errorf("workflow %s finished with phase %s: %s", name, workflow.Status.Phase, workflow.Status.Message)
+				}
+				log.Info().Msgf("workflow %s succeeded", name)
+				return workflow, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return workflow, fmt.Errorf("timed out waiting for workflow %s to complete", name)
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// StepLogs returns the logs of the main container of a pod node
+func (c *Client) StepLogs(ctx context.Context, workflow *Workflow, node NodeStatus) (string, error) {
+	var buffer bytes.Buffer
+	err := c.StreamStepLogs(ctx, workflow, node, &buffer)
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// StreamStepLogs writes the logs of the main container of a pod node to w until
+// the pod exits or the context is cancelled
+func (c *Client) StreamStepLogs(ctx context.Context, workflow *Workflow, node NodeStatus, w io.Writer) error {
+	if node.Type != "Pod" {
+		return fmt.Errorf("node %s is a %s node, only pod nodes have logs", node.DisplayName, node.Type)
+	}
+
+	query := url.Values{}
+	query.Set("podName", PodName(workflow.Metadata.Name, node))
+	query.Set("logOptions.container", "main")
+	query.Set("logOptions.follow", "true")
+	endpoint := fmt.Sprintf("%s/api/v1/workflows/%s/%s/log?%s", c.baseURL, url.PathEscape(c.namespace), url.PathEscape(workflow.Metadata.Name), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	c.setAuthorization(req)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting logs for %s: %s", node.DisplayName, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return newAPIError(res.StatusCode, body)
+	}
+
+	// the response is a stream of newline delimited json entries
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.Error != nil {
+			return fmt.Errorf("error streaming logs for %s: %s", node.DisplayName, entry.Error.Message)
+		}
+		if _, err := io.WriteString(w, entry.Result.Content+"\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading logs for %s: %s", node.DisplayName, err)
+	}
+
+	return nil
+}
+
+// SortedNodes returns the nodes of a Workflow ordered by start time
+func SortedNodes(workflow *Workflow) []NodeStatus {
+	nodes := make([]NodeStatus, 0, len(workflow.Status.Nodes))
+	for _, node := range workflow.Status.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].StartedAt.Equal(nodes[j].StartedAt) {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return nodes[i].StartedAt.Before(nodes[j].StartedAt)
+	})
+
+	return nodes
+}
+
+// PodName returns the name of the pod that ran a node, using the pod naming of
+// Argo Workflows 3.4 (<workflow>-<template>-<node hash>), nodes of inline
+// templates only use the workflow name as prefix
+func PodName(workflowName string, node NodeStatus) string {
+	if node.TemplateName == "" || workflowName == node.ID {
+		return node.ID
+	}
+
+	hash := strings.TrimPrefix(node.ID, workflowName+"-")
+	prefix := workflowName
+	if !strings.Contains(node.Name, ".inline") {
+		prefix = fmt.Sprintf("%s-%s", workflowName, node.TemplateName)
+	}
+	// the prefix is truncated to a fixed length whatever the length of the hash
+	if len(prefix) > maxPodNamePrefixLength {
+		prefix = prefix[:maxPodNamePrefixLength]
+	}
+
+	return fmt.Sprintf("%s-%s", prefix, hash)
+}
+
+// do sends a request to the Argo Server and decodes the response into out
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", pkg.JSONContentType)
+	c.setAuthorization(req)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newAPIError(res.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) setAuthorization(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	}
+}
+
+// newAPIError returns an error for an unexpected Argo Server response
+func newAPIError(statusCode int, body []byte) error {
+	var apiErr apiError
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Message != "" {
+		return fmt.Errorf("argo workflows api returned http status code %d: %s", statusCode, apiErr.Message)
+	}
+
+	return fmt.Errorf("argo workflows api returned http status code %d: %s", statusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argoWorkflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPodName(t *testing.T) {
+	longWorkflow := "kubefirst-provision-" + strings.Repeat("w", 200) + "-abcde"
+	longTemplate := "clone-gitops-template-" + strings.Repeat("t", 20)
+
+	tests := []struct {
+		name     string
+		workflow string
+		node     NodeStatus
+		want     string
+	}{
+		{
+			name:     "short names",
+			workflow: "hello-x7k2p",
+			node:     NodeStatus{ID: "hello-x7k2p-1234567890", TemplateName: "whalesay"},
+			want:     "hello-x7k2p-whalesay-1234567890",
+		},
+		{
+			name:     "workflow node",
+			workflow: "hello-x7k2p",
+			node:     NodeStatus{ID: "hello-x7k2p", TemplateName: "main"},
+			want:     "hello-x7k2p",
+		},
+		{
+			name:     "node without template",
+			workflow: "hello-x7k2p",
+			node:     NodeStatus{ID: "hello-x7k2p-1234567890"},
+			want:     "hello-x7k2p-1234567890",
+		},
+		{
+			name:     "prefix longer than 52 characters is kept",
+			workflow: "kubefirst-provision-" + strings.Repeat("w", 30),
+			node:     NodeStatus{ID: "kubefirst-provision-" + strings.Repeat("w", 30) + "-1234567890", TemplateName: longTemplate},
+			want:     "kubefirst-provision-" + strings.Repeat("w", 30) + "-" + longTemplate + "-1234567890",
+		},
+		{
+			name:     "prefix truncated to 242 characters",
+			workflow: longWorkflow,
+			node:     NodeStatus{ID: longWorkflow + "-1234567890", TemplateName: longTemplate},
+			want:     (longWorkflow + "-" + longTemplate)[:242] + "-1234567890",
+		},
+		{
+			name:     "prefix truncation does not depend on the hash length",
+			workflow: longWorkflow,
+			node:     NodeStatus{ID: longWorkflow + "-12345", TemplateName: longTemplate},
+			want:     (longWorkflow + "-" + longTemplate)[:242] + "-12345",
+		},
+		{
+			name:     "prefix of exactly 242 characters",
+			workflow: strings.Repeat("w", 230),
+			node:     NodeStatus{ID: strings.Repeat("w", 230) + "-1234567890", TemplateName: strings.Repeat("t", 11)},
+			want:     strings.Repeat("w", 230) + "-" + strings.Repeat("t", 11) + "-1234567890",
+		},
+		{
+			name:     "inline template",
+			workflow: "hello-x7k2p",
+			node:     NodeStatus{ID: "hello-x7k2p-1234567890", Name: "hello-x7k2p[0].step.inline", TemplateName: "step"},
+			want:     "hello-x7k2p-1234567890",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PodName(tt.workflow, tt.node)
+			if got != tt.want {
+				t.Errorf("wanted %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSubmitWaitAndLogs(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	var submitted submitRequest
+	var logPodName string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		node := NodeStatus{ID: "provision-abc-1234567890", Name: "provision-abc", DisplayName: "provision-abc", Type: "Pod", TemplateName: "run"}
+		workflow := Workflow{}
+		workflow.Metadata.Name = "provision-abc"
+		workflow.Metadata.Namespace = "argo"
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/workflows/argo/submit":
+			if err := json.NewDecoder(r.Body).Decode(&submitted); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			workflow.Status.Phase = PhasePending
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/workflows/argo/provision-abc":
+			polls++
+			node.Phase = PhaseRunning
+			workflow.Status.Phase = PhaseRunning
+			if polls > 1 {
+				node.Phase = PhaseSucceeded
+				workflow.Status.Phase = PhaseSucceeded
+			}
+			workflow.Status.Nodes = map[string]NodeStatus{node.ID: node}
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/workflows/argo/provision-abc/log":
+			logPodName = r.URL.Query().Get("podName")
+			fmt.Fprintln(w, `{"result":{"content":"cloning","podName":"provision-abc-run-1234567890"}}`)
+			fmt.Fprintln(w, `{"result":{"content":"done","podName":"provision-abc-run-1234567890"}}`)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"code":5,"message":"not found"}`)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(workflow)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(ClientConfig{BaseURL: server.URL, Namespace: "argo", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	workflow, err := client.SubmitFromTemplate(ctx, "provision", SubmitOptions{
+		Parameters: map[string]string{"b": "2", "a": "1"},
+		Labels:     map[string]string{"kubefirst.io/cluster": "kubefirst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workflow.Metadata.Name != "provision-abc" {
+		t.Errorf("wanted workflow provision-abc, got %s", workflow.Metadata.Name)
+	}
+	if submitted.ResourceKind != "WorkflowTemplate" || submitted.ResourceName != "provision" || submitted.SubmitOptions.GenerateName != "provision-" {
+		t.Errorf("unexpected submit request %+v", submitted)
+	}
+	if strings.Join(submitted.SubmitOptions.Parameters, ",") != "a=1,b=2" {
+		t.Errorf("wanted sorted parameters, got %v", submitted.SubmitOptions.Parameters)
+	}
+
+	phases := make([]string, 0)
+	workflow, err = client.WaitForWorkflow(ctx, "provision-abc", WaitOptions{
+		PollInterval: time.Millisecond,
+		Timeout:      5 * time.Second,
+		NodeHandler: func(workflow string, node NodeStatus) {
+			phases = append(phases, node.Phase)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(phases, ",") != "Running,Succeeded" {
+		t.Errorf("wanted node phases Running,Succeeded, got %v", phases)
+	}
+
+	logs, err := client.StepLogs(ctx, workflow, workflow.Status.Nodes["provision-abc-1234567890"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs != "cloning\ndone\n" {
+		t.Errorf("unexpected logs %q", logs)
+	}
+	if logPodName != "provision-abc-run-1234567890" {
+		t.Errorf("wanted logs for pod provision-abc-run-1234567890, got %s", logPodName)
+	}
+
+	_, err = client.GetWorkflow(ctx, "missing")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("wanted a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argoWorkflows
+
+import "time"
+
+// workflow and node phases
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseSkipped   = "Skipped"
+	PhaseFailed    = "Failed"
+	PhaseError     = "Error"
+	PhaseOmitted   = "Omitted"
+)
+
+// Workflow is the subset of an Argo Workflow used by the runtime
+type Workflow struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Status WorkflowStatus `json:"status"`
+}
+
+// WorkflowStatus is the status of an Argo Workflow
+type WorkflowStatus struct {
+	Phase      string                `json:"phase"`
+	Message    string                `json:"message,omitempty"`
+	StartedAt  time.Time             `json:"startedAt,omitempty"`
+	FinishedAt time.Time             `json:"finishedAt,omitempty"`
+	Progress   string                `json:"progress,omitempty"`
+	Nodes      map[string]NodeStatus `json:"nodes,omitempty"`
+}
+
+// NodeStatus is the status of a single step, DAG task or pod of a Workflow
+type NodeStatus struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	DisplayName  string    `json:"displayName"`
+	Type         string    `json:"type"`
+	TemplateName string    `json:"templateName,omitempty"`
+	Phase        string    `json:"phase"`
+	Message      string    `json:"message,omitempty"`
+	StartedAt    time.Time `json:"startedAt,omitempty"`
+	FinishedAt   time.Time `json:"finishedAt,omitempty"`
+}
+
+// Completed returns true when the workflow or node has finished running
+func Completed(phase string) bool {
+	switch phase {
+	case PhaseSucceeded, PhaseFailed, PhaseError, PhaseSkipped, PhaseOmitted:
+		return true
+	}
+	return false
+}
+
+// submitRequest is the body of a request to submit a Workflow from a template
+type submitRequest struct {
+	Namespace     string        `json:"namespace"`
+	ResourceKind  string        `json:"resourceKind"`
+	ResourceName  string        `json:"resourceName"`
+	SubmitOptions submitOptions `json:"submitOptions"`
+}
+
+type submitOptions struct {
+	GenerateName   string   `json:"generateName,omitempty"`
+	Labels         string   `json:"labels,omitempty"`
+	Parameters     []string `json:"parameters,omitempty"`
+	ServiceAccount string   `json:"serviceAccount,omitempty"`
+}
+
+// logEntry is a single line of the workflow log stream
+type logEntry struct {
+	Result struct {
+		Content string `json:"content"`
+		PodName string `json:"podName"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// apiError is the error body returned by the Argo Server
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
@@ -44,7 +44,7 @@ func ArgoCDApplicationCleanup(clientset kubernetes.Interface, removeApps []strin
 		log.Info().Msgf("attempting to delete argocd application %s", app)
 		err := waitForApplicationDeletion(clientset, app)
 		if err != nil {
-			log.Error().Msgf("error deleting argocd application %s: %s", err)
+			log.Error().Msgf("error deleting argocd application %s: %s", app, err)
 		}
 	}
 
@@ -116,6 +116,10 @@ func RefreshRegistryApplication(host string, token string) error {
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("argocd refresh request returned http status code %d", response.StatusCode)
+	}
+
 	return nil
 }
 
@@ -141,6 +145,10 @@ func RefreshApplication(host string, token string, appName string) error {
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("argocd refresh request returned http status code %d", response.StatusCode)
+	}
+
 	return nil
 }
 
@@ -20,24 +20,77 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
-// ApplyArgoCDKustomize
+// BootstrapOptions configures BootstrapArgoCD
+type BootstrapOptions struct {
+	// InstallPath is a kustomization directory or remote kustomize target
+	// containing the ArgoCD installation
+	InstallPath string
+	// Namespace defaults to argocd
+	Namespace string
+	// JobFallback runs ApplyArgoCDKustomize if the in-process apply fails, e.g.
+	// when the remote kustomization cannot be fetched from where the runtime runs
+	JobFallback bool
+}
+
+// BootstrapArgoCD installs ArgoCD by building the kustomization with
+// KustomizeBuild and applying the result with server-side apply, without
+// running a Job in the cluster
+func BootstrapArgoCD(ctx context.Context, kcl *k8s.KubernetesClient, opts BootstrapOptions) error {
+	if opts.Namespace == "" {
+		opts.Namespace = "argocd"
+	}
+
+	_, err := k8s.EnsureNamespaces(ctx, kcl.Clientset, k8s.NamespaceSpecs(opts.Namespace))
+	if err != nil {
+		return fmt.Errorf("error creating namespace: %s", err)
+	}
+
+	err = applyArgoCDManifests(ctx, kcl, opts)
+	if err == nil {
+		log.Info().Msg("applied argocd installation manifests")
+		return nil
+	}
+	if !opts.JobFallback {
+		return err
+	}
+
+	log.Warn().Msgf("could not apply argocd manifests in process, falling back to bootstrap job: %s", err)
+	return ApplyArgoCDKustomize(kcl.Clientset, opts.InstallPath)
+}
+
+// applyArgoCDManifests builds the ArgoCD kustomization and applies it
+func applyArgoCDManifests(ctx context.Context, kcl *k8s.KubernetesClient, opts BootstrapOptions) error {
+	manifests, err := kcl.KustomizeBuild(opts.InstallPath)
+	if err != nil {
+		return fmt.Errorf("error building argocd kustomization %s: %s", opts.InstallPath, err)
+	}
+
+	yamlData, err := kcl.SplitYAMLFile(manifests)
+	if err != nil {
+		return fmt.Errorf("error parsing argocd manifests: %s", err)
+	}
+
+	err = kcl.ApplyManifests(ctx, yamlData, opts.Namespace)
+	if err != nil {
+		return fmt.Errorf("error applying argocd manifests: %s", err)
+	}
+
+	return nil
+}
+
+// ApplyArgoCDKustomize runs a Job that applies the ArgoCD kustomization with
+// kubectl, BootstrapArgoCD should be preferred where the runtime can reach the
+// cluster API directly
 func ApplyArgoCDKustomize(clientset *kubernetes.Clientset, argoCDInstallPath string) error {
 	enabled := true
 	name := "argocd-bootstrap"
 	namespace := "argocd"
 
 	// Create Namespace
-	nsObj := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
-	_, err := clientset.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	_, err := k8s.EnsureNamespaces(context.Background(), clientset, k8s.NamespaceSpecs(namespace))
 	if err != nil {
-		_, err = clientset.CoreV1().Namespaces().Create(context.Background(), nsObj, metav1.CreateOptions{})
-		if err != nil {
-			log.Error().Msgf("error creating namespace: %s", err)
-			return fmt.Errorf("error creating namespace: %s", err)
-		}
-		log.Info().Msgf("namespace created: %s", namespace)
-	} else {
-		log.Warn().Msgf("namespace %s already exists - skipping", namespace)
+		log.Error().Msgf("error creating namespace: %s", err)
+		return fmt.Errorf("error creating namespace: %s", err)
 	}
 
 	// Create ServiceAccount
@@ -0,0 +1,398 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/kubefirst/runtime/pkg/argocdModel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// clientTimeout is the timeout of the http.Client built by NewClient
+	clientTimeout = 30 * time.Second
+	// tokenExpiryLeeway renews session tokens shortly before they expire
+	tokenExpiryLeeway = time.Minute
+)
+
+// ClientConfig configures an ArgoCD API Client
+type ClientConfig struct {
+	// BaseURL is the ArgoCD server address without the /api/v1 suffix, e.g.
+	// https://argocd.kubefirst.dev - defaults to GetArgoEndpoint()
+	BaseURL string
+	// Username and Password are used to create session tokens
+	Username string
+	Password string
+	// Token is an optional pre-existing session or account token, it is only
+	// replaced when Username and Password are also set
+	Token string
+	// CABundle is a PEM encoded CA bundle used to verify the ArgoCD server
+	CABundle []byte
+	// InsecureSkipVerify disables server certificate verification, this should
+	// only be used with a local port-forward
+	InsecureSkipVerify bool
+	// HTTPClient overrides the http client, CABundle and InsecureSkipVerify are
+	// ignored when it is set
+	HTTPClient pkg.HTTPDoer
+}
+
+// Client talks to the ArgoCD REST API, logging in lazily and refreshing its
+// session token when it expires
+type Client struct {
+	baseURL    string
+	username   string
+	password   string
+	httpClient pkg.HTTPDoer
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// APIError is returned when the ArgoCD API responds with an unexpected status code
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("argocd api returned http status code %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if err is an APIError for a missing resource
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// NewClient returns an ArgoCD API client
+func NewClient(config ClientConfig) (*Client, error) {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = GetArgoEndpoint()
+	}
+	baseURL = strings.TrimSuffix(strings.TrimSuffix(baseURL, "/"), "/api/v1")
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid argocd base url %q: %s", baseURL, err)
+	}
+
+	if config.Token == "" && (config.Username == "" || config.Password == "") {
+		return nil, fmt.Errorf("an argocd token or username and password are required")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+		if len(config.CABundle) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(config.CABundle) {
+				return nil, fmt.Errorf("unable to parse argocd ca bundle")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient = &http.Client{Transport: transport, Timeout: clientTimeout}
+	}
+
+	client := &Client{
+		baseURL:    baseURL,
+		username:   config.Username,
+		password:   config.Password,
+		httpClient: httpClient,
+	}
+	if config.Token != "" {
+		client.token = config.Token
+		client.tokenExpiry = tokenExpiry(config.Token)
+	}
+
+	return client, nil
+}
+
+// BaseURL returns the ArgoCD server address the client talks to
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Token returns a valid session token, logging in if required
+func (c *Client) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.tokenExpiry.IsZero() || time.Now().Add(tokenExpiryLeeway).Before(c.tokenExpiry)) {
+		return c.token, nil
+	}
+	if c.username == "" || c.password == "" {
+		if c.token != "" {
+			return "", fmt.Errorf("argocd token has expired and no credentials are available to renew it")
+		}
+		return "", fmt.Errorf("argocd credentials are required")
+	}
+
+	return c.login(ctx)
+}
+
+// login creates a new session token, the caller must hold c.mu
+func (c *Client) login(ctx context.Context) (string, error) {
+	payload, err := json.Marshal(argocdModel.SessionSessionCreateRequest{
+		Username: c.username,
+		Password: c.password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/session", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", pkg.JSONContentType)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting argocd session: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", newAPIError(res.StatusCode, body)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	err = json.Unmarshal(body, &session)
+	if err != nil {
+		return "", err
+	}
+	if session.Token == "" {
+		return "", fmt.Errorf("unable to retrieve argocd token, make sure provided credentials are valid")
+	}
+
+	c.token = session.Token
+	c.tokenExpiry = tokenExpiry(session.Token)
+	log.Debug().Msgf("created argocd session for %s", c.username)
+
+	return c.token, nil
+}
+
+// invalidateToken forgets a token the server has rejected so the next request
+// logs in again
+func (c *Client) invalidateToken(token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.username == "" || c.password == "" {
+		return false
+	}
+	if c.token == token {
+		c.token = ""
+		c.tokenExpiry = time.Time{}
+	}
+
+	return true
+}
+
+// do sends a request to the ArgoCD API and decodes a successful response into
+// out when it is not nil
+//
+// A request rejected with 401 is retried once with a new session token
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		payload, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	endpoint := c.baseURL + "/api/v1" + path
+	if len(query) > 0 {
+		endpoint = endpoint + "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.Token(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		if in != nil {
+			req.Header.Set("Content-Type", pkg.JSONContentType)
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("error sending %s request to argocd %s: %s", method, path, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 && c.invalidateToken(token) {
+			log.Debug().Msg("argocd session token was rejected, logging in again")
+			continue
+		}
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return newAPIError(res.StatusCode, body)
+		}
+		if out == nil || len(body) == 0 {
+			return nil
+		}
+
+		return json.Unmarshal(body, out)
+	}
+}
+
+// GetApplication returns an ArgoCD Application
+func (c *Client) GetApplication(ctx context.Context, name string) (argocdModel.V1alpha1Application, error) {
+	var application argocdModel.V1alpha1Application
+	err := c.do(ctx, http.MethodGet, "/applications/"+url.PathEscape(name), nil, nil, &application)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+
+	return application, nil
+}
+
+// ListApplications returns every ArgoCD Application, optionally filtered by a
+// label selector such as app.kubernetes.io/part-of=registry
+func (c *Client) ListApplications(ctx context.Context, selector string) ([]argocdModel.V1alpha1Application, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("selector", selector)
+	}
+
+	var list argocdModel.V1alpha1ApplicationList
+	err := c.do(ctx, http.MethodGet, "/applications", query, nil, &list)
+	if err != nil {
+		return []argocdModel.V1alpha1Application{}, err
+	}
+
+	return list.Items, nil
+}
+
+// Sync starts a sync operation for an ArgoCD Application and returns the
+// Application with the operation that was started
+func (c *Client) Sync(ctx context.Context, name string, request argocdModel.ApplicationApplicationSyncRequest) (argocdModel.V1alpha1Application, error) {
+	request.Name = name
+
+	var application argocdModel.V1alpha1Application
+	err := c.do(ctx, http.MethodPost, "/applications/"+url.PathEscape(name)+"/sync", nil, request, &application)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+	log.Info().Msgf("started sync of argocd application %s", name)
+
+	return application, nil
+}
+
+// Refresh forces ArgoCD to compare an Application against its source, a hard
+// refresh also invalidates the manifest cache
+func (c *Client) Refresh(ctx context.Context, name string, hard bool) (argocdModel.V1alpha1Application, error) {
+	refresh := "normal"
+	if hard {
+		refresh = "hard"
+	}
+
+	var application argocdModel.V1alpha1Application
+	err := c.do(ctx, http.MethodGet, "/applications/"+url.PathEscape(name), url.Values{"refresh": {refresh}}, nil, &application)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+
+	return application, nil
+}
+
+// Delete deletes an ArgoCD Application, when cascade is true the resources it
+// manages are deleted as well
+func (c *Client) Delete(ctx context.Context, name string, cascade bool) error {
+	err := c.do(ctx, http.MethodDelete, "/applications/"+url.PathEscape(name), url.Values{"cascade": {fmt.Sprintf("%t", cascade)}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("deleted argocd application %s", name)
+
+	return nil
+}
+
+// Rollback syncs an ArgoCD Application to the deployment with id in its history
+func (c *Client) Rollback(ctx context.Context, name string, id int64, prune bool) (argocdModel.V1alpha1Application, error) {
+	request := argocdModel.ApplicationApplicationRollbackRequest{
+		Name:  name,
+		ID:    id,
+		Prune: prune,
+	}
+
+	var application argocdModel.V1alpha1Application
+	err := c.do(ctx, http.MethodPost, "/applications/"+url.PathEscape(name)+"/rollback", nil, request, &application)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+	log.Info().Msgf("rolled back argocd application %s to history id %d", name, id)
+
+	return application, nil
+}
+
+// newAPIError builds an APIError from an ArgoCD error response body
+func newAPIError(statusCode int, body []byte) *APIError {
+	var runtimeError argocdModel.RuntimeError
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &runtimeError); err == nil && runtimeError.Message != "" {
+		message = runtimeError.Message
+	}
+
+	return &APIError{StatusCode: statusCode, Message: message}
+}
+
+// tokenExpiry returns the expiry of a JWT session token, or the zero time if it
+// cannot be determined - the signature is not verified, the server does that
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
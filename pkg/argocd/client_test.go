@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg/argocdModel"
+)
+
+func testToken(t *testing.T, exp time.Time) string {
+	claims, err := json.Marshal(map[string]int64{"exp": exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("e30.%s.sig", base64.RawURLEncoding.EncodeToString(claims))
+}
+
+func TestClientTokenRefresh(t *testing.T) {
+	expired := testToken(t, time.Now().Add(-time.Hour))
+	valid := testToken(t, time.Now().Add(time.Hour))
+	rejected := testToken(t, time.Now().Add(2*time.Hour))
+
+	logins := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/session":
+			logins++
+			json.NewEncoder(w).Encode(map[string]string{"token": valid})
+		case "/api/v1/applications/registry":
+			if r.Header.Get("Authorization") != "Bearer "+valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(argocdModel.RuntimeError{Message: "invalid session"})
+				return
+			}
+			fmt.Fprint(w, `{"metadata":{"name":"registry"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(argocdModel.RuntimeError{Message: "not found"})
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		token      string
+		wantLogins int
+	}{
+		{name: "lazy login", token: "", wantLogins: 1},
+		{name: "expired token", token: expired, wantLogins: 1},
+		{name: "rejected token", token: rejected, wantLogins: 1},
+		{name: "valid token", token: valid, wantLogins: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logins = 0
+			client, err := NewClient(ClientConfig{
+				BaseURL:    server.URL + "/api/v1",
+				Username:   "admin",
+				Password:   "password",
+				Token:      tt.token,
+				HTTPClient: server.Client(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			application, err := client.GetApplication(context.Background(), "registry")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if application.Metadata.Name != "registry" {
+				t.Errorf("unexpected application %+v", application)
+			}
+			if logins != tt.wantLogins {
+				t.Errorf("wanted %d logins, got %d", tt.wantLogins, logins)
+			}
+
+			_, err = client.GetApplication(context.Background(), "missing")
+			if !IsNotFound(err) {
+				t.Errorf("wanted not found error, got %v", err)
+			}
+		})
+	}
+}
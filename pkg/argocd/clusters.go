@@ -0,0 +1,252 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// SecretTypeCluster is a cluster ArgoCD can deploy to
+	SecretTypeCluster = "cluster"
+
+	clusterManagerName          = "argocd-manager"
+	clusterManagerRoleName      = "argocd-manager-role"
+	clusterManagerRoleBinding   = "argocd-manager-role-binding"
+	clusterManagerTokenName     = "argocd-manager-token"
+	clusterManagerNamespace     = "kube-system"
+	clusterTokenTimeout         = 30 * time.Second
+	clusterSecretNamePrefix     = "cluster-"
+	clusterSecretManagedByLabel = "kubefirst.io/managed-by"
+)
+
+// ClusterRegistration describes a workload cluster to register with a
+// management ArgoCD
+type ClusterRegistration struct {
+	// Name of the cluster in ArgoCD, also used for the cluster Secret name
+	Name string
+	// Labels are added to the cluster Secret so ApplicationSet cluster
+	// generators can select the cluster
+	Labels map[string]string
+	// Namespaces limits ArgoCD to specific namespaces of the cluster, every
+	// namespace when empty
+	Namespaces []string
+	// Server is the API server URL the management ArgoCD connects to, defaults
+	// to the host of the target kubeconfig. It has to be set when that host is
+	// only reachable locally, e.g. 0.0.0.0 or 127.0.0.1 for k3d clusters
+	Server string
+}
+
+// RegisteredCluster is a cluster Secret in the management ArgoCD
+type RegisteredCluster struct {
+	Name   string
+	Server string
+	Labels map[string]string
+}
+
+// argoCDClusterConfig is the config key of an ArgoCD cluster Secret
+type argoCDClusterConfig struct {
+	BearerToken     string `json:"bearerToken"`
+	TLSClientConfig struct {
+		Insecure bool   `json:"insecure"`
+		CAData   []byte `json:"caData,omitempty"`
+	} `json:"tlsClientConfig"`
+}
+
+// RegisterCluster registers a workload cluster with a management ArgoCD
+//
+// A ServiceAccount bound to a ClusterRole for ArgoCD is created in kube-system
+// on the target cluster along with a long lived token, then the ArgoCD cluster
+// Secret pointing at the target API server is written to the argocd namespace
+// of the management cluster. It is safe to call repeatedly
+func RegisterCluster(ctx context.Context, target *k8s.KubernetesClient, management kubernetes.Interface, cluster ClusterRegistration) error {
+	return registerCluster(ctx, target.Clientset, target.RestConfig, management, cluster)
+}
+
+// registerCluster registers the cluster reached through targetClientset, which
+// is configured by targetConfig
+func registerCluster(ctx context.Context, targetClientset kubernetes.Interface, targetConfig *rest.Config, management kubernetes.Interface, cluster ClusterRegistration) error {
+	if cluster.Name == "" {
+		return fmt.Errorf("cluster name is required")
+	}
+
+	token, err := ensureClusterManager(ctx, targetClientset)
+	if err != nil {
+		return fmt.Errorf("error creating argocd service account on cluster %s: %s", cluster.Name, err)
+	}
+
+	caData := targetConfig.CAData
+	if len(caData) == 0 && targetConfig.CAFile != "" {
+		caData, err = os.ReadFile(targetConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("error reading ca file for cluster %s: %s", cluster.Name, err)
+		}
+	}
+
+	server := cluster.Server
+	if server == "" {
+		server = targetConfig.Host
+	}
+
+	config := argoCDClusterConfig{BearerToken: token}
+	config.TLSClientConfig.CAData = caData
+	config.TLSClientConfig.Insecure = targetConfig.Insecure
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		SecretTypeLabel:             SecretTypeCluster,
+		clusterSecretManagedByLabel: "kubefirst",
+	}
+	for key, value := range cluster.Labels {
+		labels[key] = value
+	}
+
+	data := map[string][]byte{
+		"name":   []byte(cluster.Name),
+		"server": []byte(server),
+		"config": configJSON,
+	}
+	if len(cluster.Namespaces) > 0 {
+		data["namespaces"] = []byte(strings.Join(cluster.Namespaces, ","))
+	}
+
+	_, err = k8s.EnsureSecret(ctx, management, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        clusterSecretNamePrefix + cluster.Name,
+			Namespace:   "argocd",
+			Labels:      labels,
+			Annotations: map[string]string{"managed-by": "argocd.argoproj.io"},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing argocd cluster secret for %s: %s", cluster.Name, err)
+	}
+	log.Info().Msgf("registered cluster %s (%s) with argocd", cluster.Name, server)
+
+	return nil
+}
+
+// UnregisterCluster removes a workload cluster from the management ArgoCD
+//
+// target may be nil when the workload cluster has already been destroyed,
+// otherwise the ArgoCD ServiceAccount, token and RBAC are removed from it
+func UnregisterCluster(ctx context.Context, target kubernetes.Interface, management kubernetes.Interface, name string) error {
+	err := k8s.DeleteSecret(ctx, management, "argocd", clusterSecretNamePrefix+name)
+	if err != nil {
+		return fmt.Errorf("error removing argocd cluster secret for %s: %s", name, err)
+	}
+	log.Info().Msgf("unregistered cluster %s from argocd", name)
+
+	if target == nil {
+		return nil
+	}
+
+	err = target.CoreV1().Secrets(clusterManagerNamespace).Delete(ctx, clusterManagerTokenName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting argocd token on cluster %s: %s", name, err)
+	}
+	err = target.RbacV1().ClusterRoleBindings().Delete(ctx, clusterManagerRoleBinding, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting argocd cluster role binding on cluster %s: %s", name, err)
+	}
+	err = target.RbacV1().ClusterRoles().Delete(ctx, clusterManagerRoleName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting argocd cluster role on cluster %s: %s", name, err)
+	}
+	err = target.CoreV1().ServiceAccounts(clusterManagerNamespace).Delete(ctx, clusterManagerName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting argocd service account on cluster %s: %s", name, err)
+	}
+	log.Info().Msgf("removed argocd service account from cluster %s", name)
+
+	return nil
+}
+
+// ListRegisteredClusters returns the clusters registered with the management
+// ArgoCD by RegisterCluster
+func ListRegisteredClusters(ctx context.Context, management kubernetes.Interface) ([]RegisteredCluster, error) {
+	secrets, err := management.CoreV1().Secrets("argocd").List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=kubefirst", SecretTypeLabel, SecretTypeCluster, clusterSecretManagedByLabel),
+	})
+	if err != nil {
+		return []RegisteredCluster{}, fmt.Errorf("error listing argocd cluster secrets: %s", err)
+	}
+
+	clusters := make([]RegisteredCluster, 0, len(secrets.Items))
+	for _, secret := range secrets.Items {
+		clusters = append(clusters, RegisteredCluster{
+			Name:   string(secret.Data["name"]),
+			Server: string(secret.Data["server"]),
+			Labels: secret.Labels,
+		})
+	}
+
+	return clusters, nil
+}
+
+// ensureClusterManager creates the ArgoCD ServiceAccount, RBAC and token Secret
+// on a workload cluster and returns the token
+func ensureClusterManager(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	_, err := clientset.CoreV1().ServiceAccounts(clusterManagerNamespace).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterManagerName, Namespace: clusterManagerNamespace},
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating service account: %s", err)
+	}
+
+	_, err = clientset.RbacV1().ClusterRoles().Create(ctx, &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterManagerRoleName},
+		Rules: []rbacv1.PolicyRule{
+			{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			{Verbs: []string{"*"}, NonResourceURLs: []string{"*"}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating cluster role: %s", err)
+	}
+
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterManagerRoleBinding},
+		Subjects: []rbacv1.Subject{
+			{Kind: "ServiceAccount", Name: clusterManagerName, Namespace: clusterManagerNamespace},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     clusterManagerRoleName,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating cluster role binding: %s", err)
+	}
+
+	token, err := k8s.EnsureServiceAccountToken(ctx, clientset, clusterManagerNamespace, clusterManagerName, clusterManagerTokenName, clusterTokenTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestTargetClientset returns a fake workload cluster whose token controller
+// populates service account token Secrets as they are created
+func newTestTargetClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*v1.Secret)
+		if secret.Type == v1.SecretTypeServiceAccountToken {
+			secret.Data = map[string][]byte{v1.ServiceAccountTokenKey: []byte("token-" + secret.Annotations[v1.ServiceAccountNameKey])}
+		}
+		return false, nil, nil
+	})
+
+	return clientset
+}
+
+// newTestManagementClientset returns a fake management cluster that stores
+// applied Secrets, server-side apply is not supported by the fake object tracker
+func newTestManagementClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		secret := &v1.Secret{}
+		err := json.Unmarshal(patch.GetPatch(), secret)
+		if err != nil {
+			return true, nil, err
+		}
+		secret.Namespace = patch.GetNamespace()
+		err = clientset.Tracker().Add(secret)
+		if errors.IsAlreadyExists(err) {
+			err = clientset.Tracker().Update(v1.SchemeGroupVersion.WithResource("secrets"), secret, secret.Namespace)
+		}
+		return true, secret, err
+	})
+
+	return clientset
+}
+
+func TestRegisterListAndUnregisterCluster(t *testing.T) {
+	ctx := context.Background()
+	target := newTestTargetClientset()
+	management := newTestManagementClientset()
+	targetConfig := &rest.Config{Host: "https://0.0.0.0:6443", TLSClientConfig: rest.TLSClientConfig{CAData: []byte("ca")}}
+
+	if err := registerCluster(ctx, target, targetConfig, management, ClusterRegistration{}); err == nil {
+		t.Error("wanted an error for a cluster without a name")
+	}
+
+	err := registerCluster(ctx, target, targetConfig, management, ClusterRegistration{
+		Name:       "workload",
+		Labels:     map[string]string{"env": "dev"},
+		Namespaces: []string{"apps", "monitoring"},
+		Server:     "https://k3d-workload-serverlb:6443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// registering again keeps a single cluster and defaults the server
+	err = registerCluster(ctx, target, targetConfig, management, ClusterRegistration{Name: "workload", Labels: map[string]string{"env": "dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := management.CoreV1().Secrets("argocd").Get(ctx, "cluster-workload", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels[SecretTypeLabel] != SecretTypeCluster || secret.Labels["env"] != "dev" {
+		t.Errorf("wanted the cluster secret type and labels, got %v", secret.Labels)
+	}
+	if string(secret.Data["server"]) != "https://0.0.0.0:6443" {
+		t.Errorf("wanted the server to default to the kubeconfig host, got %s", secret.Data["server"])
+	}
+	var config argoCDClusterConfig
+	err = json.Unmarshal(secret.Data["config"], &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BearerToken != "token-"+clusterManagerName || string(config.TLSClientConfig.CAData) != "ca" {
+		t.Errorf("wanted the service account token and ca, got %+v", config)
+	}
+	for _, check := range []func() error{
+		func() error {
+			_, err := target.CoreV1().ServiceAccounts(clusterManagerNamespace).Get(ctx, clusterManagerName, metav1.GetOptions{})
+			return err
+		},
+		func() error {
+			_, err := target.RbacV1().ClusterRoleBindings().Get(ctx, clusterManagerRoleBinding, metav1.GetOptions{})
+			return err
+		},
+	} {
+		if err := check(); err != nil {
+			t.Errorf("wanted the argocd manager on the target cluster: %s", err)
+		}
+	}
+
+	// secrets not created by RegisterCluster are not listed
+	_, err = management.CoreV1().Secrets("argocd").Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-manual", Namespace: "argocd", Labels: map[string]string{SecretTypeLabel: SecretTypeCluster}},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := ListRegisteredClusters(ctx, management)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != "workload" || clusters[0].Server != "https://0.0.0.0:6443" {
+		t.Errorf("wanted only the workload cluster, got %+v", clusters)
+	}
+
+	err = UnregisterCluster(ctx, target, management, "workload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := management.CoreV1().Secrets("argocd").Get(ctx, "cluster-workload", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("wanted the cluster secret to be removed, got %v", err)
+	}
+	if _, err := target.CoreV1().ServiceAccounts(clusterManagerNamespace).Get(ctx, clusterManagerName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("wanted the service account to be removed, got %v", err)
+	}
+	if _, err := target.RbacV1().ClusterRoles().Get(ctx, clusterManagerRoleName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("wanted the cluster role to be removed, got %v", err)
+	}
+
+	// a destroyed workload cluster is only removed from argocd
+	err = UnregisterCluster(ctx, nil, management, "workload")
+	if err != nil {
+		t.Errorf("wanted unregistering twice without a target to succeed, got %s", err)
+	}
+}
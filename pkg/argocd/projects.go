@@ -0,0 +1,329 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	v1alpha1ArgocdApplication "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const inClusterServer = "https://kubernetes.default.svc"
+
+// AppProjectOptions configures an ArgoCD AppProject built by NewAppProject
+type AppProjectOptions struct {
+	Name        string
+	Description string
+	// SourceRepos are the repository URLs Applications in the project may deploy from
+	SourceRepos []string
+	// Destinations are the clusters and namespaces Applications may deploy to
+	Destinations []v1alpha1ArgocdApplication.ApplicationDestination
+	// ClusterResourceWhitelist lists the cluster scoped resources Applications
+	// may manage, none when empty
+	ClusterResourceWhitelist   []metav1.GroupKind
+	NamespaceResourceBlacklist []metav1.GroupKind
+	Roles                      []v1alpha1ArgocdApplication.ProjectRole
+}
+
+// GitDirectoryApplicationSetOptions configures an ApplicationSet that creates an
+// Application for each directory of a git repository
+type GitDirectoryApplicationSetOptions struct {
+	Name     string
+	Project  string
+	RepoURL  string
+	Revision string
+	// Directories are path globs, e.g. apps/*
+	Directories []string
+	// Exclude are path globs to skip
+	Exclude []string
+	// Namespace to deploy each Application to, defaults to the directory name
+	Namespace string
+	AutoSync  bool
+}
+
+// ClusterApplicationSetOptions configures an ApplicationSet that creates an
+// Application for each cluster registered with ArgoCD matching a label selector
+type ClusterApplicationSetOptions struct {
+	Name     string
+	Project  string
+	RepoURL  string
+	Revision string
+	Path     string
+	// ClusterSelector matches the labels of ArgoCD cluster Secrets, every
+	// cluster when empty
+	ClusterSelector map[string]string
+	Namespace       string
+	AutoSync        bool
+}
+
+// NewAppProject returns an ArgoCD AppProject
+func NewAppProject(opts AppProjectOptions) *v1alpha1ArgocdApplication.AppProject {
+	return &v1alpha1ArgocdApplication.AppProject{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AppProject",
+			APIVersion: ArgoCDAPIVersion,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.Name,
+			Namespace: "argocd",
+		},
+		Spec: v1alpha1ArgocdApplication.AppProjectSpec{
+			Description:                opts.Description,
+			SourceRepos:                opts.SourceRepos,
+			Destinations:               opts.Destinations,
+			ClusterResourceWhitelist:   opts.ClusterResourceWhitelist,
+			NamespaceResourceBlacklist: opts.NamespaceResourceBlacklist,
+			Roles:                      opts.Roles,
+		},
+	}
+}
+
+// NewTeamAppProject returns an AppProject scoped to a single repository and
+// namespace in the management cluster, with an admin role for the team's group
+// and no access to cluster scoped resources
+func NewTeamAppProject(team string, repoURL string, namespace string) *v1alpha1ArgocdApplication.AppProject {
+	return NewAppProject(AppProjectOptions{
+		Name:        team,
+		Description: fmt.Sprintf("%s team project", team),
+		SourceRepos: []string{repoURL},
+		Destinations: []v1alpha1ArgocdApplication.ApplicationDestination{
+			{Server: inClusterServer, Namespace: namespace},
+		},
+		NamespaceResourceBlacklist: []metav1.GroupKind{
+			{Group: "", Kind: "ResourceQuota"},
+			{Group: "", Kind: "LimitRange"},
+			{Group: "networking.k8s.io", Kind: "NetworkPolicy"},
+		},
+		Roles: []v1alpha1ArgocdApplication.ProjectRole{
+			{
+				Name:        "admin",
+				Description: fmt.Sprintf("%s team administrators", team),
+				Policies: []string{
+					fmt.Sprintf("p, proj:%s:admin, applications, *, %s/*, allow", team, team),
+				},
+				Groups: []string{team},
+			},
+		},
+	})
+}
+
+// NewGitDirectoryApplicationSet returns an ApplicationSet using the git
+// directory generator
+func NewGitDirectoryApplicationSet(opts GitDirectoryApplicationSetOptions) *v1alpha1ArgocdApplication.ApplicationSet {
+	directories := make([]v1alpha1ArgocdApplication.GitDirectoryGeneratorItem, 0, len(opts.Directories)+len(opts.Exclude))
+	for _, path := range opts.Directories {
+		directories = append(directories, v1alpha1ArgocdApplication.GitDirectoryGeneratorItem{Path: path})
+	}
+	for _, path := range opts.Exclude {
+		directories = append(directories, v1alpha1ArgocdApplication.GitDirectoryGeneratorItem{Path: path, Exclude: true})
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = "{{path.basename}}"
+	}
+
+	return newApplicationSet(opts.Name, v1alpha1ArgocdApplication.ApplicationSetGenerator{
+		Git: &v1alpha1ArgocdApplication.GitGenerator{
+			RepoURL:     opts.RepoURL,
+			Revision:    revisionOrHead(opts.Revision),
+			Directories: directories,
+		},
+	}, applicationSetTemplate(
+		"{{path.basename}}",
+		opts.Project,
+		opts.RepoURL,
+		opts.Revision,
+		"{{path}}",
+		inClusterServer,
+		namespace,
+		opts.AutoSync,
+	))
+}
+
+// NewClusterApplicationSet returns an ApplicationSet using the cluster generator,
+// the generated Applications are named <cluster>-<name>
+func NewClusterApplicationSet(opts ClusterApplicationSetOptions) *v1alpha1ArgocdApplication.ApplicationSet {
+	return newApplicationSet(opts.Name, v1alpha1ArgocdApplication.ApplicationSetGenerator{
+		Clusters: &v1alpha1ArgocdApplication.ClusterGenerator{
+			Selector: metav1.LabelSelector{MatchLabels: opts.ClusterSelector},
+		},
+	}, applicationSetTemplate(
+		fmt.Sprintf("{{name}}-%s", opts.Name),
+		opts.Project,
+		opts.RepoURL,
+		opts.Revision,
+		opts.Path,
+		"{{server}}",
+		opts.Namespace,
+		opts.AutoSync,
+	))
+}
+
+// ApplyAppProject creates or updates an AppProject with server-side apply
+func ApplyAppProject(ctx context.Context, dynamicClient dynamic.Interface, project *v1alpha1ArgocdApplication.AppProject) error {
+	return applyArgoCDResource(ctx, dynamicClient, AppProjectResource, project.Namespace, project.Name, project)
+}
+
+// GetAppProject returns an AppProject, the returned error can be checked with
+// errors.IsNotFound
+func GetAppProject(ctx context.Context, dynamicClient dynamic.Interface, name string) (*v1alpha1ArgocdApplication.AppProject, error) {
+	project := &v1alpha1ArgocdApplication.AppProject{}
+	err := getArgoCDResource(ctx, dynamicClient, AppProjectResource, name, project)
+	if err != nil {
+		return nil, err
+	}
+
+	return project, nil
+}
+
+// DeleteAppProject deletes an AppProject, a project that does not exist is not
+// an error
+func DeleteAppProject(ctx context.Context, dynamicClient dynamic.Interface, name string) error {
+	return deleteArgoCDResource(ctx, dynamicClient, AppProjectResource, name)
+}
+
+// ApplyApplicationSet creates or updates an ApplicationSet with server-side apply
+func ApplyApplicationSet(ctx context.Context, dynamicClient dynamic.Interface, applicationSet *v1alpha1ArgocdApplication.ApplicationSet) error {
+	return applyArgoCDResource(ctx, dynamicClient, ApplicationSetResource, applicationSet.Namespace, applicationSet.Name, applicationSet)
+}
+
+// GetApplicationSet returns an ApplicationSet, the returned error can be checked
+// with errors.IsNotFound
+func GetApplicationSet(ctx context.Context, dynamicClient dynamic.Interface, name string) (*v1alpha1ArgocdApplication.ApplicationSet, error) {
+	applicationSet := &v1alpha1ArgocdApplication.ApplicationSet{}
+	err := getArgoCDResource(ctx, dynamicClient, ApplicationSetResource, name, applicationSet)
+	if err != nil {
+		return nil, err
+	}
+
+	return applicationSet, nil
+}
+
+// DeleteApplicationSet deletes an ApplicationSet along with the Applications it
+// generated, an ApplicationSet that does not exist is not an error
+func DeleteApplicationSet(ctx context.Context, dynamicClient dynamic.Interface, name string) error {
+	return deleteArgoCDResource(ctx, dynamicClient, ApplicationSetResource, name)
+}
+
+// newApplicationSet returns an ApplicationSet in the argocd namespace with a
+// single generator
+func newApplicationSet(name string, generator v1alpha1ArgocdApplication.ApplicationSetGenerator, template v1alpha1ArgocdApplication.ApplicationSetTemplate) *v1alpha1ArgocdApplication.ApplicationSet {
+	return &v1alpha1ArgocdApplication.ApplicationSet{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ApplicationSet",
+			APIVersion: ArgoCDAPIVersion,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "argocd",
+		},
+		Spec: v1alpha1ArgocdApplication.ApplicationSetSpec{
+			Generators: []v1alpha1ArgocdApplication.ApplicationSetGenerator{generator},
+			Template:   template,
+		},
+	}
+}
+
+// applicationSetTemplate returns the Application template of an ApplicationSet
+func applicationSetTemplate(name, project, repoURL, revision, path, server, namespace string, autoSync bool) v1alpha1ArgocdApplication.ApplicationSetTemplate {
+	if project == "" {
+		project = "default"
+	}
+
+	syncPolicy := &v1alpha1ArgocdApplication.SyncPolicy{
+		SyncOptions: []string{"CreateNamespace=true"},
+	}
+	if autoSync {
+		syncPolicy.Automated = &v1alpha1ArgocdApplication.SyncPolicyAutomated{
+			Prune:    true,
+			SelfHeal: true,
+		}
+	}
+
+	return v1alpha1ArgocdApplication.ApplicationSetTemplate{
+		ApplicationSetTemplateMeta: v1alpha1ArgocdApplication.ApplicationSetTemplateMeta{
+			Name:       name,
+			Finalizers: []string{ResourcesFinalizer},
+		},
+		Spec: v1alpha1ArgocdApplication.ApplicationSpec{
+			Project: project,
+			Source: &v1alpha1ArgocdApplication.ApplicationSource{
+				RepoURL:        repoURL,
+				TargetRevision: revisionOrHead(revision),
+				Path:           path,
+			},
+			Destination: v1alpha1ArgocdApplication.ApplicationDestination{
+				Server:    server,
+				Namespace: namespace,
+			},
+			SyncPolicy: syncPolicy,
+		},
+	}
+}
+
+func revisionOrHead(revision string) string {
+	if revision == "" {
+		return "HEAD"
+	}
+	return revision
+}
+
+// applyArgoCDResource applies a typed ArgoCD object with server-side apply
+func applyArgoCDResource(ctx context.Context, dynamicClient dynamic.Interface, resource schema.GroupVersionResource, namespace string, name string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = dynamicClient.Resource(resource).Namespace(namespace).Patch(ctx, name, types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: k8s.FieldManager,
+		Force:        &force,
+	})
+	if err != nil {
+		return fmt.Errorf("error applying %s %s: %s", resource.Resource, name, err)
+	}
+	log.Info().Msgf("applied %s %s", resource.Resource, name)
+
+	return nil
+}
+
+// getArgoCDResource gets an ArgoCD object from the argocd namespace into obj
+func getArgoCDResource(ctx context.Context, dynamicClient dynamic.Interface, resource schema.GroupVersionResource, name string, obj interface{}) error {
+	item, err := dynamicClient.Resource(resource).Namespace("argocd").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), obj)
+}
+
+// deleteArgoCDResource deletes an ArgoCD object from the argocd namespace
+func deleteArgoCDResource(ctx context.Context, dynamicClient dynamic.Interface, resource schema.GroupVersionResource, name string) error {
+	err := dynamicClient.Resource(resource).Namespace("argocd").Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info().Msgf("%s %s does not exist - skipping", resource.Resource, name)
+			return nil
+		}
+		return fmt.Errorf("error deleting %s %s: %s", resource.Resource, name, err)
+	}
+	log.Info().Msgf("deleted %s %s", resource.Resource, name)
+
+	return nil
+}
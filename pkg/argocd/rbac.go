@@ -0,0 +1,342 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	rbacConfigMapName = "argocd-rbac-cm"
+	rbacPolicyKey     = "policy.csv"
+	rbacDefaultKey    = "policy.default"
+	rbacScopesKey     = "scopes"
+)
+
+// rbacResources are the resources ArgoCD permissions can be granted on
+var rbacResources = map[string]bool{
+	"*":               true,
+	"applications":    true,
+	"applicationsets": true,
+	"clusters":        true,
+	"projects":        true,
+	"repositories":    true,
+	"accounts":        true,
+	"certificates":    true,
+	"gpgkeys":         true,
+	"logs":            true,
+	"exec":            true,
+	"extensions":      true,
+}
+
+// rbacActions are the actions ArgoCD permissions can grant, resource actions
+// use the action/<group>/<kind>/<action> form
+var rbacActions = map[string]bool{
+	"*":        true,
+	"get":      true,
+	"create":   true,
+	"update":   true,
+	"delete":   true,
+	"sync":     true,
+	"override": true,
+	"invoke":   true,
+}
+
+// RBACPermission is a `p` line of an ArgoCD policy granting a role or subject an
+// action on an object, e.g. p, role:team-a, applications, sync, team-a/*, allow
+type RBACPermission struct {
+	Subject  string
+	Resource string
+	Action   string
+	Object   string
+	// Effect is allow or deny, defaults to allow
+	Effect string
+}
+
+// RBACGroupBinding is a `g` line of an ArgoCD policy assigning a role to a user
+// or SSO group, e.g. g, my-org:team-a, role:team-a
+type RBACGroupBinding struct {
+	Subject string
+	Role    string
+}
+
+// RBACConfig is the content of the argocd-rbac-cm ConfigMap
+type RBACConfig struct {
+	// DefaultRole is granted to every authenticated user, e.g. role:readonly
+	DefaultRole string
+	// Scopes are the OIDC claims used to match subjects, e.g. groups and email
+	Scopes      []string
+	Permissions []RBACPermission
+	Bindings    []RBACGroupBinding
+}
+
+// ProjectRolePermissions returns the permissions for a role with full access to
+// the Applications of a project, or read and sync access when readOnly is set
+func ProjectRolePermissions(role string, project string, readOnly bool) []RBACPermission {
+	object := fmt.Sprintf("%s/*", project)
+	if readOnly {
+		return []RBACPermission{
+			{Subject: role, Resource: "applications", Action: "get", Object: object, Effect: "allow"},
+			{Subject: role, Resource: "applications", Action: "sync", Object: object, Effect: "allow"},
+			{Subject: role, Resource: "projects", Action: "get", Object: project, Effect: "allow"},
+		}
+	}
+
+	return []RBACPermission{
+		{Subject: role, Resource: "applications", Action: "*", Object: object, Effect: "allow"},
+		{Subject: role, Resource: "applicationsets", Action: "*", Object: object, Effect: "allow"},
+		{Subject: role, Resource: "logs", Action: "get", Object: object, Effect: "allow"},
+		{Subject: role, Resource: "projects", Action: "get", Object: project, Effect: "allow"},
+	}
+}
+
+// ParseRBACPolicy parses the policy.csv of argocd-rbac-cm, returning an error
+// for the first invalid line
+func ParseRBACPolicy(policy string) ([]RBACPermission, []RBACGroupBinding, error) {
+	permissions := make([]RBACPermission, 0)
+	bindings := make([]RBACGroupBinding, 0)
+
+	for i, line := range strings.Split(policy, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+
+		switch fields[0] {
+		case "p":
+			if len(fields) != 6 && len(fields) != 5 {
+				return nil, nil, fmt.Errorf("line %d: permission must be p, subject, resource, action, object, effect: %q", i+1, line)
+			}
+			permission := RBACPermission{
+				Subject:  fields[1],
+				Resource: fields[2],
+				Action:   fields[3],
+				Object:   fields[4],
+			}
+			if len(fields) == 6 {
+				permission.Effect = fields[5]
+			}
+			if err := permission.Validate(); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			permissions = append(permissions, permission)
+		case "g":
+			if len(fields) != 3 {
+				return nil, nil, fmt.Errorf("line %d: binding must be g, subject, role: %q", i+1, line)
+			}
+			binding := RBACGroupBinding{Subject: fields[1], Role: fields[2]}
+			if err := binding.Validate(); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			bindings = append(bindings, binding)
+		default:
+			return nil, nil, fmt.Errorf("line %d: policy lines must start with p or g: %q", i+1, line)
+		}
+	}
+
+	return permissions, bindings, nil
+}
+
+// Validate checks that a permission uses a known resource, action and effect
+func (p RBACPermission) Validate() error {
+	if p.Subject == "" || p.Object == "" {
+		return fmt.Errorf("permission subject and object are required")
+	}
+	if strings.Contains(p.Subject+p.Resource+p.Action+p.Object, ",") {
+		return fmt.Errorf("permission fields cannot contain commas")
+	}
+	if !rbacResources[p.Resource] {
+		return fmt.Errorf("unknown resource %q", p.Resource)
+	}
+	if !rbacActions[p.Action] && !strings.HasPrefix(p.Action, "action/") {
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
+	if p.Effect != "" && p.Effect != "allow" && p.Effect != "deny" {
+		return fmt.Errorf("effect must be allow or deny, got %q", p.Effect)
+	}
+
+	return nil
+}
+
+// normalized returns the permission with the default effect set
+func (p RBACPermission) normalized() RBACPermission {
+	if p.Effect == "" {
+		p.Effect = "allow"
+	}
+	return p
+}
+
+// Validate checks that a binding has a subject and a role
+func (b RBACGroupBinding) Validate() error {
+	if b.Subject == "" || b.Role == "" {
+		return fmt.Errorf("binding subject and role are required")
+	}
+	if strings.Contains(b.Subject+b.Role, ",") {
+		return fmt.Errorf("binding fields cannot contain commas")
+	}
+
+	return nil
+}
+
+// Validate checks every permission and binding of the configuration
+func (c RBACConfig) Validate() error {
+	for _, permission := range c.Permissions {
+		if err := permission.Validate(); err != nil {
+			return fmt.Errorf("invalid permission for %s: %s", permission.Subject, err)
+		}
+	}
+	for _, binding := range c.Bindings {
+		if err := binding.Validate(); err != nil {
+			return fmt.Errorf("invalid binding for %s: %s", binding.Subject, err)
+		}
+	}
+
+	return nil
+}
+
+// PolicyCSV renders the permissions and bindings as an ArgoCD policy.csv
+func (c RBACConfig) PolicyCSV() string {
+	var builder strings.Builder
+	for _, p := range c.Permissions {
+		p = p.normalized()
+		builder.WriteString(fmt.Sprintf("p, %s, %s, %s, %s, %s\n", p.Subject, p.Resource, p.Action, p.Object, p.Effect))
+	}
+	for _, b := range c.Bindings {
+		builder.WriteString(fmt.Sprintf("g, %s, %s\n", b.Subject, b.Role))
+	}
+
+	return builder.String()
+}
+
+// Merge adds the permissions and bindings of other that are not already
+// present, and takes its default role and scopes when they are set
+func (c RBACConfig) Merge(other RBACConfig) RBACConfig {
+	merged := RBACConfig{
+		DefaultRole: c.DefaultRole,
+		Scopes:      c.Scopes,
+		Permissions: append([]RBACPermission{}, c.Permissions...),
+		Bindings:    append([]RBACGroupBinding{}, c.Bindings...),
+	}
+	if other.DefaultRole != "" {
+		merged.DefaultRole = other.DefaultRole
+	}
+	if len(other.Scopes) > 0 {
+		merged.Scopes = other.Scopes
+	}
+
+	for _, permission := range other.Permissions {
+		exists := false
+		for _, existing := range merged.Permissions {
+			if existing.normalized() == permission.normalized() {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			merged.Permissions = append(merged.Permissions, permission)
+		}
+	}
+	for _, binding := range other.Bindings {
+		exists := false
+		for _, existing := range merged.Bindings {
+			if existing == binding {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			merged.Bindings = append(merged.Bindings, binding)
+		}
+	}
+
+	return merged
+}
+
+// GetRBACConfig reads the argocd-rbac-cm ConfigMap
+func GetRBACConfig(ctx context.Context, clientset kubernetes.Interface) (*RBACConfig, error) {
+	configMap, err := k8s.GetConfigMap(ctx, clientset, "argocd", rbacConfigMapName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s: %s", rbacConfigMapName, err)
+	}
+
+	permissions, bindings, err := ParseRBACPolicy(configMap.Data[rbacPolicyKey])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s %s: %s", rbacConfigMapName, rbacPolicyKey, err)
+	}
+
+	return &RBACConfig{
+		DefaultRole: configMap.Data[rbacDefaultKey],
+		Scopes:      parseRBACScopes(configMap.Data[rbacScopesKey]),
+		Permissions: permissions,
+		Bindings:    bindings,
+	}, nil
+}
+
+// WriteRBACConfig validates and replaces the policy, default role and scopes of
+// the argocd-rbac-cm ConfigMap
+func WriteRBACConfig(ctx context.Context, clientset kubernetes.Interface, config RBACConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	policy := config.PolicyCSV()
+	data := map[string]*string{rbacPolicyKey: &policy}
+	if config.DefaultRole != "" {
+		data[rbacDefaultKey] = &config.DefaultRole
+	}
+	if len(config.Scopes) > 0 {
+		scopes := fmt.Sprintf("[%s]", strings.Join(config.Scopes, ", "))
+		data[rbacScopesKey] = &scopes
+	}
+
+	_, err = k8s.PatchConfigMap(ctx, clientset, "argocd", rbacConfigMapName, data)
+	if err != nil {
+		return fmt.Errorf("error writing argocd rbac configuration: %s", err)
+	}
+
+	return nil
+}
+
+// MergeRBACConfig adds permissions and bindings to the argocd-rbac-cm ConfigMap
+// without removing existing entries - comments in policy.csv are not preserved
+func MergeRBACConfig(ctx context.Context, clientset kubernetes.Interface, additions RBACConfig) error {
+	existing, err := GetRBACConfig(ctx, clientset)
+	if err != nil {
+		return err
+	}
+
+	return WriteRBACConfig(ctx, clientset, existing.Merge(additions))
+}
+
+// parseRBACScopes parses the scopes key, e.g. [groups, email]
+func parseRBACScopes(scopes string) []string {
+	scopes = strings.Trim(strings.TrimSpace(scopes), "[]")
+	if scopes == "" {
+		return nil
+	}
+
+	result := make([]string, 0)
+	for _, scope := range strings.Split(scopes, ",") {
+		scope = strings.Trim(strings.TrimSpace(scope), `"'`)
+		if scope != "" {
+			result = append(result, scope)
+		}
+	}
+
+	return result
+}
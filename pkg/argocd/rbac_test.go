@@ -0,0 +1,127 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRBACPolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		policy          string
+		wantPermissions []RBACPermission
+		wantBindings    []RBACGroupBinding
+		wantErr         bool
+	}{
+		{
+			name: "permissions and bindings",
+			policy: `# team a
+p, role:team-a, applications, sync, team-a/*, allow
+
+p,role:team-a,logs,get,team-a/*
+p, role:team-a, applications, action/apps/Deployment/restart, team-a/*, deny
+g, my-org:team-a, role:team-a
+`,
+			wantPermissions: []RBACPermission{
+				{Subject: "role:team-a", Resource: "applications", Action: "sync", Object: "team-a/*", Effect: "allow"},
+				{Subject: "role:team-a", Resource: "logs", Action: "get", Object: "team-a/*"},
+				{Subject: "role:team-a", Resource: "applications", Action: "action/apps/Deployment/restart", Object: "team-a/*", Effect: "deny"},
+			},
+			wantBindings: []RBACGroupBinding{{Subject: "my-org:team-a", Role: "role:team-a"}},
+		},
+		{
+			name:            "empty policy",
+			policy:          "\n# nothing here\n",
+			wantPermissions: []RBACPermission{},
+			wantBindings:    []RBACGroupBinding{},
+		},
+		{name: "unknown line type", policy: "x, role:a, applications, get, */*", wantErr: true},
+		{name: "permission missing fields", policy: "p, role:a, applications, get", wantErr: true},
+		{name: "unknown resource", policy: "p, role:a, pods, get, */*", wantErr: true},
+		{name: "unknown action", policy: "p, role:a, applications, destroy, */*", wantErr: true},
+		{name: "invalid effect", policy: "p, role:a, applications, get, */*, maybe", wantErr: true},
+		{name: "binding missing role", policy: "g, my-org:team-a, ", wantErr: true},
+		{name: "binding with extra fields", policy: "g, my-org:team-a, role:a, role:b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			permissions, bindings, err := ParseRBACPolicy(tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("wanted an error, got permissions %v and bindings %v", permissions, bindings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(permissions, tt.wantPermissions) {
+				t.Errorf("wanted permissions %v, got %v", tt.wantPermissions, permissions)
+			}
+			if !reflect.DeepEqual(bindings, tt.wantBindings) {
+				t.Errorf("wanted bindings %v, got %v", tt.wantBindings, bindings)
+			}
+		})
+	}
+}
+
+func TestRBACConfigValidate(t *testing.T) {
+	valid := RBACPermission{Subject: "role:a", Resource: "applications", Action: "get", Object: "a/*"}
+
+	tests := []struct {
+		name    string
+		config  RBACConfig
+		wantErr bool
+	}{
+		{name: "empty", config: RBACConfig{}},
+		{
+			name: "valid",
+			config: RBACConfig{
+				Permissions: append(ProjectRolePermissions("role:a", "a", false), valid),
+				Bindings:    []RBACGroupBinding{{Subject: "org:a", Role: "role:a"}},
+			},
+		},
+		{name: "wildcards", config: RBACConfig{Permissions: []RBACPermission{{Subject: "role:admin", Resource: "*", Action: "*", Object: "*"}}}},
+		{name: "missing subject", config: RBACConfig{Permissions: []RBACPermission{{Resource: "applications", Action: "get", Object: "a/*"}}}, wantErr: true},
+		{name: "missing object", config: RBACConfig{Permissions: []RBACPermission{{Subject: "role:a", Resource: "applications", Action: "get"}}}, wantErr: true},
+		{name: "comma in object", config: RBACConfig{Permissions: []RBACPermission{{Subject: "role:a", Resource: "applications", Action: "get", Object: "a,b"}}}, wantErr: true},
+		{name: "unknown resource", config: RBACConfig{Permissions: []RBACPermission{{Subject: "role:a", Resource: "secrets", Action: "get", Object: "a/*"}}}, wantErr: true},
+		{name: "unknown effect", config: RBACConfig{Permissions: []RBACPermission{{Subject: "role:a", Resource: "applications", Action: "get", Object: "a/*", Effect: "permit"}}}, wantErr: true},
+		{name: "binding without role", config: RBACConfig{Bindings: []RBACGroupBinding{{Subject: "org:a"}}}, wantErr: true},
+		{name: "comma in binding", config: RBACConfig{Bindings: []RBACGroupBinding{{Subject: "org:a,org:b", Role: "role:a"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr && err == nil {
+				t.Error("wanted an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("wanted no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestRBACPolicyCSVRoundTrip(t *testing.T) {
+	config := RBACConfig{
+		Permissions: ProjectRolePermissions("role:a", "a", true),
+		Bindings:    []RBACGroupBinding{{Subject: "org:a", Role: "role:a"}},
+	}
+
+	permissions, bindings, err := ParseRBACPolicy(config.PolicyCSV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(permissions, config.Permissions) || !reflect.DeepEqual(bindings, config.Bindings) {
+		t.Errorf("wanted %v and %v, got %v and %v", config.Permissions, config.Bindings, permissions, bindings)
+	}
+}
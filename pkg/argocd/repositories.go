@@ -0,0 +1,315 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/kubefirst/runtime/pkg/argocdModel"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// SecretTypeLabel identifies the Secrets ArgoCD reads configuration from
+	SecretTypeLabel = "argocd.argoproj.io/secret-type"
+	// SecretTypeRepository is a repository ArgoCD can deploy from
+	SecretTypeRepository = "repository"
+	// SecretTypeRepoCreds is a credential template used for every repository
+	// whose URL starts with the template URL
+	SecretTypeRepoCreds = "repo-creds"
+
+	repositorySecretNamespace = "argocd"
+)
+
+// RepositoryCredentials authenticate ArgoCD against a git repository, only one
+// of SSH, HTTPS or GitHub App credentials should be set
+type RepositoryCredentials struct {
+	SSHPrivateKey string
+	// Username and Password are used for HTTPS, Password can be a token
+	Username string
+	Password string
+	// GitHub App credentials
+	GithubAppID                int64
+	GithubAppInstallationID    int64
+	GithubAppPrivateKey        string
+	GithubAppEnterpriseBaseURL string
+}
+
+// Repository is an ArgoCD repository stored as a labelled Secret
+type Repository struct {
+	// SecretName is the name of the Secret in the argocd namespace
+	SecretName string
+	// Name is the display name of the repository in ArgoCD
+	Name string
+	URL  string
+	// Type is git or helm, defaults to git
+	Type        string
+	Project     string
+	Insecure    bool
+	Credentials RepositoryCredentials
+}
+
+// RepositoryCredentialTemplate is an ArgoCD repo-creds Secret, its credentials
+// apply to every repository whose URL starts with URL
+type RepositoryCredentialTemplate struct {
+	SecretName  string
+	URL         string
+	Credentials RepositoryCredentials
+}
+
+// SSHCredentials returns credentials for an ssh private key
+func SSHCredentials(privateKey string) RepositoryCredentials {
+	return RepositoryCredentials{SSHPrivateKey: privateKey}
+}
+
+// HTTPSTokenCredentials returns credentials for a username and access token
+func HTTPSTokenCredentials(username string, token string) RepositoryCredentials {
+	return RepositoryCredentials{Username: username, Password: token}
+}
+
+// GitHubAppCredentials returns credentials for a GitHub App installation
+func GitHubAppCredentials(appID int64, installationID int64, privateKey string) RepositoryCredentials {
+	return RepositoryCredentials{
+		GithubAppID:             appID,
+		GithubAppInstallationID: installationID,
+		GithubAppPrivateKey:     privateKey,
+	}
+}
+
+// EnsureRepository creates or updates the Secret for an ArgoCD repository
+func EnsureRepository(ctx context.Context, clientset kubernetes.Interface, repo Repository) error {
+	if repo.SecretName == "" || repo.URL == "" {
+		return fmt.Errorf("repository secret name and url are required")
+	}
+	if repo.Type == "" {
+		repo.Type = "git"
+	}
+
+	data := repo.Credentials.secretData()
+	data["url"] = []byte(repo.URL)
+	data["type"] = []byte(repo.Type)
+	if repo.Name != "" {
+		data["name"] = []byte(repo.Name)
+	}
+	if repo.Project != "" {
+		data["project"] = []byte(repo.Project)
+	}
+	if repo.Insecure {
+		data["insecure"] = []byte("true")
+	}
+
+	_, err := k8s.EnsureSecret(ctx, clientset, repositorySecret(repo.SecretName, SecretTypeRepository, data))
+	if err != nil {
+		return fmt.Errorf("error ensuring argocd repository %s: %s", repo.URL, err)
+	}
+
+	return nil
+}
+
+// ListRepositories returns the repositories stored as Secrets in the argocd
+// namespace
+func ListRepositories(ctx context.Context, clientset kubernetes.Interface) ([]Repository, error) {
+	secrets, err := listRepositorySecrets(ctx, clientset, SecretTypeRepository)
+	if err != nil {
+		return []Repository{}, err
+	}
+
+	repositories := make([]Repository, 0, len(secrets))
+	for _, secret := range secrets {
+		insecure, _ := strconv.ParseBool(string(secret.Data["insecure"]))
+		repositories = append(repositories, Repository{
+			SecretName:  secret.Name,
+			Name:        string(secret.Data["name"]),
+			URL:         string(secret.Data["url"]),
+			Type:        string(secret.Data["type"]),
+			Project:     string(secret.Data["project"]),
+			Insecure:    insecure,
+			Credentials: repositoryCredentialsFromSecret(secret),
+		})
+	}
+
+	return repositories, nil
+}
+
+// DeleteRepository deletes the Secret of an ArgoCD repository, Secrets that are
+// not labelled as a repository are refused
+func DeleteRepository(ctx context.Context, clientset kubernetes.Interface, secretName string) error {
+	return deleteRepositorySecret(ctx, clientset, secretName, SecretTypeRepository)
+}
+
+// EnsureRepositoryCredentialTemplate creates or updates the Secret for an
+// ArgoCD credential template
+func EnsureRepositoryCredentialTemplate(ctx context.Context, clientset kubernetes.Interface, template RepositoryCredentialTemplate) error {
+	if template.SecretName == "" || template.URL == "" {
+		return fmt.Errorf("credential template secret name and url are required")
+	}
+
+	data := template.Credentials.secretData()
+	data["url"] = []byte(template.URL)
+
+	_, err := k8s.EnsureSecret(ctx, clientset, repositorySecret(template.SecretName, SecretTypeRepoCreds, data))
+	if err != nil {
+		return fmt.Errorf("error ensuring argocd credential template %s: %s", template.URL, err)
+	}
+
+	return nil
+}
+
+// ListRepositoryCredentialTemplates returns the credential templates stored as
+// Secrets in the argocd namespace
+func ListRepositoryCredentialTemplates(ctx context.Context, clientset kubernetes.Interface) ([]RepositoryCredentialTemplate, error) {
+	secrets, err := listRepositorySecrets(ctx, clientset, SecretTypeRepoCreds)
+	if err != nil {
+		return []RepositoryCredentialTemplate{}, err
+	}
+
+	templates := make([]RepositoryCredentialTemplate, 0, len(secrets))
+	for _, secret := range secrets {
+		templates = append(templates, RepositoryCredentialTemplate{
+			SecretName:  secret.Name,
+			URL:         string(secret.Data["url"]),
+			Credentials: repositoryCredentialsFromSecret(secret),
+		})
+	}
+
+	return templates, nil
+}
+
+// DeleteRepositoryCredentialTemplate deletes the Secret of an ArgoCD credential
+// template, Secrets that are not labelled as a credential template are refused
+func DeleteRepositoryCredentialTemplate(ctx context.Context, clientset kubernetes.Interface, secretName string) error {
+	return deleteRepositorySecret(ctx, clientset, secretName, SecretTypeRepoCreds)
+}
+
+// deleteRepositorySecret deletes a Secret in the argocd namespace only when its
+// secret-type label matches, so other ArgoCD Secrets such as argocd-secret
+// cannot be removed by name
+func deleteRepositorySecret(ctx context.Context, clientset kubernetes.Interface, secretName string, secretType string) error {
+	secret, err := clientset.CoreV1().Secrets(repositorySecretNamespace).Get(ctx, secretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Info().Msgf("secret %s/%s does not exist - skipping", repositorySecretNamespace, secretName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting secret %s/%s: %s", repositorySecretNamespace, secretName, err)
+	}
+	if secret.Labels[SecretTypeLabel] != secretType {
+		return fmt.Errorf("secret %s/%s is not an argocd %s secret, refusing to delete it", repositorySecretNamespace, secretName, secretType)
+	}
+
+	// the precondition prevents deleting a Secret recreated since it was checked
+	err = clientset.CoreV1().Secrets(repositorySecretNamespace).Delete(ctx, secretName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &secret.UID},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting secret %s/%s: %s", repositorySecretNamespace, secretName, err)
+	}
+	log.Info().Msgf("deleted argocd %s secret %s", secretType, secretName)
+
+	return nil
+}
+
+// ValidateRepository asks ArgoCD to connect to a repository with the provided
+// credentials, an error is returned if ArgoCD cannot access it
+func (c *Client) ValidateRepository(ctx context.Context, repo Repository) error {
+	query := argocdModel.RepositoryRepoAccessQuery{
+		Repo:                       repo.URL,
+		Name:                       repo.Name,
+		Type:                       repo.Type,
+		Project:                    repo.Project,
+		Insecure:                   repo.Insecure,
+		Username:                   repo.Credentials.Username,
+		Password:                   repo.Credentials.Password,
+		SSHPrivateKey:              repo.Credentials.SSHPrivateKey,
+		GithubAppID:                repo.Credentials.GithubAppID,
+		GithubAppInstallationID:    repo.Credentials.GithubAppInstallationID,
+		GithubAppPrivateKey:        repo.Credentials.GithubAppPrivateKey,
+		GithubAppEnterpriseBaseURL: repo.Credentials.GithubAppEnterpriseBaseURL,
+	}
+
+	err := c.do(ctx, http.MethodPost, "/repositories/"+url.PathEscape(repo.URL)+"/validate", nil, query, nil)
+	if err != nil {
+		return fmt.Errorf("argocd could not access repository %s: %s", repo.URL, err)
+	}
+
+	return nil
+}
+
+// secretData returns the Secret keys ArgoCD expects for the credentials
+func (c RepositoryCredentials) secretData() map[string][]byte {
+	data := make(map[string][]byte)
+	if c.SSHPrivateKey != "" {
+		data["sshPrivateKey"] = []byte(c.SSHPrivateKey)
+	}
+	if c.Username != "" {
+		data["username"] = []byte(c.Username)
+	}
+	if c.Password != "" {
+		data["password"] = []byte(c.Password)
+	}
+	if c.GithubAppID != 0 {
+		data["githubAppID"] = []byte(strconv.FormatInt(c.GithubAppID, 10))
+		data["githubAppInstallationID"] = []byte(strconv.FormatInt(c.GithubAppInstallationID, 10))
+		data["githubAppPrivateKey"] = []byte(c.GithubAppPrivateKey)
+	}
+	if c.GithubAppEnterpriseBaseURL != "" {
+		data["githubAppEnterpriseBaseUrl"] = []byte(c.GithubAppEnterpriseBaseURL)
+	}
+
+	return data
+}
+
+// repositoryCredentialsFromSecret reads credentials from an ArgoCD Secret
+func repositoryCredentialsFromSecret(secret v1.Secret) RepositoryCredentials {
+	appID, _ := strconv.ParseInt(string(secret.Data["githubAppID"]), 10, 64)
+	installationID, _ := strconv.ParseInt(string(secret.Data["githubAppInstallationID"]), 10, 64)
+
+	return RepositoryCredentials{
+		SSHPrivateKey:              string(secret.Data["sshPrivateKey"]),
+		Username:                   string(secret.Data["username"]),
+		Password:                   string(secret.Data["password"]),
+		GithubAppID:                appID,
+		GithubAppInstallationID:    installationID,
+		GithubAppPrivateKey:        string(secret.Data["githubAppPrivateKey"]),
+		GithubAppEnterpriseBaseURL: string(secret.Data["githubAppEnterpriseBaseUrl"]),
+	}
+}
+
+// repositorySecret returns a Secret labelled for ArgoCD to read
+func repositorySecret(name string, secretType string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   repositorySecretNamespace,
+			Annotations: map[string]string{"managed-by": "argocd.argoproj.io"},
+			Labels:      map[string]string{SecretTypeLabel: secretType},
+		},
+		Data: data,
+	}
+}
+
+// listRepositorySecrets returns the Secrets in the argocd namespace with a
+// secret-type label
+func listRepositorySecrets(ctx context.Context, clientset kubernetes.Interface, secretType string) ([]v1.Secret, error) {
+	secrets, err := clientset.CoreV1().Secrets(repositorySecretNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", SecretTypeLabel, secretType),
+	})
+	if err != nil {
+		return []v1.Secret{}, fmt.Errorf("error listing argocd %s secrets: %s", secretType, err)
+	}
+
+	return secrets.Items, nil
+}
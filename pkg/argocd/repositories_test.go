@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeleteRepositoryChecksSecretType(t *testing.T) {
+	secret := func(name string, secretType string) *v1.Secret {
+		labels := map[string]string{}
+		if secretType != "" {
+			labels[SecretTypeLabel] = secretType
+		}
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: repositorySecretNamespace, Labels: labels}}
+	}
+	clientset := fake.NewSimpleClientset(
+		secret("argocd-secret", ""),
+		secret("gitops", SecretTypeRepository),
+		secret("github", SecretTypeRepoCreds),
+	)
+	ctx := context.Background()
+
+	if err := DeleteRepository(ctx, clientset, "argocd-secret"); err == nil {
+		t.Error("wanted an error deleting argocd-secret as a repository")
+	}
+	if err := DeleteRepository(ctx, clientset, "github"); err == nil {
+		t.Error("wanted an error deleting a credential template as a repository")
+	}
+	if err := DeleteRepositoryCredentialTemplate(ctx, clientset, "gitops"); err == nil {
+		t.Error("wanted an error deleting a repository as a credential template")
+	}
+	if err := DeleteRepository(ctx, clientset, "missing"); err != nil {
+		t.Errorf("wanted no error deleting a missing repository, got %s", err)
+	}
+
+	if err := DeleteRepository(ctx, clientset, "gitops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRepositoryCredentialTemplate(ctx, clientset, "github"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"gitops", "github"} {
+		_, err := clientset.CoreV1().Secrets(repositorySecretNamespace).Get(ctx, name, metav1.GetOptions{})
+		if !errors.IsNotFound(err) {
+			t.Errorf("wanted secret %s to be deleted, got %v", name, err)
+		}
+	}
+	if _, err := clientset.CoreV1().Secrets(repositorySecretNamespace).Get(ctx, "argocd-secret", metav1.GetOptions{}); err != nil {
+		t.Errorf("wanted argocd-secret to be kept, got %s", err)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	argoCDConfigMapName = "argocd-cm"
+	argoCDSecretName    = "argocd-secret"
+	argoCDURLKey        = "url"
+	oidcConfigKey       = "oidc.config"
+	dexConfigKey        = "dex.config"
+	// oidcClientSecretKey is the argocd-secret key holding the OIDC client secret
+	oidcClientSecretKey = "oidc.clientSecret"
+)
+
+// OIDCConfig is the oidc.config key of argocd-cm used to authenticate against
+// an external OIDC provider such as Vault
+type OIDCConfig struct {
+	Name     string `json:"name"`
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientID"`
+	// ClientSecret is stored in argocd-secret by SetOIDCConfig and replaced with
+	// a $key reference to it, values that already start with $ are kept
+	ClientSecret    string   `json:"clientSecret,omitempty"`
+	RequestedScopes []string `json:"requestedScopes,omitempty"`
+	// RequestedIDTokenClaims, e.g. {"groups": {Essential: true}}
+	RequestedIDTokenClaims map[string]OIDCClaim `json:"requestedIDTokenClaims,omitempty"`
+	RootCA                 string               `json:"rootCA,omitempty"`
+}
+
+// OIDCClaim requests a claim in the id token
+type OIDCClaim struct {
+	Essential bool     `json:"essential"`
+	Values    []string `json:"values,omitempty"`
+}
+
+// DexConfig is the dex.config key of argocd-cm used to authenticate with the
+// bundled Dex server
+type DexConfig struct {
+	Connectors []DexConnector `json:"connectors"`
+}
+
+// DexConnector is a Dex upstream identity provider
+type DexConnector struct {
+	Type   string                 `json:"type"`
+	ID     string                 `json:"id"`
+	Name   string                 `json:"name"`
+	Config map[string]interface{} `json:"config"`
+}
+
+// GitHubDexConnector returns a Dex connector for a GitHub OAuth App restricted
+// to members of orgs, team memberships are returned as org:team groups
+//
+// SetDexConfig stores clientSecret in argocd-secret so it is not written to
+// argocd-cm
+func GitHubDexConnector(clientID string, clientSecret string, orgs ...string) DexConnector {
+	orgConfig := make([]map[string]interface{}, 0, len(orgs))
+	for _, org := range orgs {
+		orgConfig = append(orgConfig, map[string]interface{}{"name": org})
+	}
+
+	return DexConnector{
+		Type: "github",
+		ID:   "github",
+		Name: "GitHub",
+		Config: map[string]interface{}{
+			"clientID":      clientID,
+			"clientSecret":  clientSecret,
+			"orgs":          orgConfig,
+			"loadAllGroups": false,
+		},
+	}
+}
+
+// Validate checks the required OIDC settings are present
+func (c OIDCConfig) Validate() error {
+	if c.Name == "" || c.Issuer == "" || c.ClientID == "" {
+		return fmt.Errorf("oidc name, issuer and client id are required")
+	}
+
+	return nil
+}
+
+// Validate checks every connector has a type and id
+func (c DexConfig) Validate() error {
+	if len(c.Connectors) == 0 {
+		return fmt.Errorf("at least one dex connector is required")
+	}
+	for _, connector := range c.Connectors {
+		if connector.Type == "" || connector.ID == "" {
+			return fmt.Errorf("dex connector type and id are required")
+		}
+	}
+
+	return nil
+}
+
+// GetSSOConfig reads the OIDC and Dex configuration of argocd-cm, either is nil
+// when it is not configured
+func GetSSOConfig(ctx context.Context, clientset kubernetes.Interface) (*OIDCConfig, *DexConfig, error) {
+	configMap, err := k8s.GetConfigMap(ctx, clientset, "argocd", argoCDConfigMapName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting %s: %s", argoCDConfigMapName, err)
+	}
+
+	var oidcConfig *OIDCConfig
+	if data := configMap.Data[oidcConfigKey]; data != "" {
+		oidcConfig = &OIDCConfig{}
+		err = yaml.Unmarshal([]byte(data), oidcConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing %s: %s", oidcConfigKey, err)
+		}
+	}
+
+	var dexConfig *DexConfig
+	if data := configMap.Data[dexConfigKey]; data != "" {
+		dexConfig = &DexConfig{}
+		err = yaml.Unmarshal([]byte(data), dexConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing %s: %s", dexConfigKey, err)
+		}
+	}
+
+	return oidcConfig, dexConfig, nil
+}
+
+// SetOIDCConfig configures ArgoCD to authenticate with an external OIDC
+// provider, url is the external address of ArgoCD used for the redirect
+//
+// The client secret is written to argocd-secret and referenced from argocd-cm,
+// which more principals are usually allowed to read
+func SetOIDCConfig(ctx context.Context, clientset kubernetes.Interface, url string, config OIDCConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	if config.ClientSecret != "" && !strings.HasPrefix(config.ClientSecret, "$") {
+		err = writeSSOSecrets(ctx, clientset, map[string][]byte{oidcClientSecretKey: []byte(config.ClientSecret)})
+		if err != nil {
+			return err
+		}
+		config.ClientSecret = "$" + oidcClientSecretKey
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return patchSSOConfig(ctx, clientset, url, oidcConfigKey, string(data))
+}
+
+// SetDexConfig adds or replaces Dex connectors in the dex.config of argocd-cm,
+// url is the external address of ArgoCD used for the redirect
+//
+// Connectors are matched by ID, other connectors and dex.config keys are kept.
+// Client secrets are written to argocd-secret as dex.<id>.clientSecret and
+// referenced from argocd-cm
+func SetDexConfig(ctx context.Context, clientset kubernetes.Interface, url string, config DexConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	secrets := make(map[string][]byte)
+	connectors := make([]DexConnector, 0, len(config.Connectors))
+	for _, connector := range config.Connectors {
+		secret, _ := connector.Config["clientSecret"].(string)
+		if secret != "" && !strings.HasPrefix(secret, "$") {
+			key := fmt.Sprintf("dex.%s.clientSecret", connector.ID)
+			secrets[key] = []byte(secret)
+
+			connectorConfig := make(map[string]interface{}, len(connector.Config))
+			for k, v := range connector.Config {
+				connectorConfig[k] = v
+			}
+			connectorConfig["clientSecret"] = "$" + key
+			connector.Config = connectorConfig
+		}
+		connectors = append(connectors, connector)
+	}
+	if len(secrets) > 0 {
+		err = writeSSOSecrets(ctx, clientset, secrets)
+		if err != nil {
+			return err
+		}
+	}
+
+	configMap, err := k8s.GetConfigMap(ctx, clientset, "argocd", argoCDConfigMapName)
+	if err != nil {
+		return fmt.Errorf("error getting %s: %s", argoCDConfigMapName, err)
+	}
+	merged, err := mergeDexConnectors(configMap.Data[dexConfigKey], connectors)
+	if err != nil {
+		return err
+	}
+
+	return patchSSOConfig(ctx, clientset, url, dexConfigKey, merged)
+}
+
+// mergeDexConnectors replaces the connectors of an existing dex.config that
+// share an ID with connectors and appends the others, keeping the order and
+// every other key of the existing configuration
+func mergeDexConnectors(existing string, connectors []DexConnector) (string, error) {
+	config := make(map[string]interface{})
+	if existing != "" {
+		err := yaml.Unmarshal([]byte(existing), &config)
+		if err != nil {
+			return "", fmt.Errorf("error parsing %s: %s", dexConfigKey, err)
+		}
+	}
+
+	current, _ := config["connectors"].([]interface{})
+	merged := make([]interface{}, 0, len(current)+len(connectors))
+	replaced := make(map[string]bool)
+	for _, item := range current {
+		existingConnector, _ := item.(map[string]interface{})
+		id, _ := existingConnector["id"].(string)
+		for _, connector := range connectors {
+			if connector.ID == id {
+				item = connector
+				replaced[id] = true
+				break
+			}
+		}
+		merged = append(merged, item)
+	}
+	for _, connector := range connectors {
+		if !replaced[connector.ID] {
+			merged = append(merged, connector)
+		}
+	}
+	config["connectors"] = merged
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// writeSSOSecrets merges sso client secrets into argocd-secret
+func writeSSOSecrets(ctx context.Context, clientset kubernetes.Interface, secrets map[string][]byte) error {
+	_, err := k8s.PatchSecret(ctx, clientset, "argocd", argoCDSecretName, secrets)
+	if err != nil {
+		return fmt.Errorf("error writing sso client secrets to %s: %s", argoCDSecretName, err)
+	}
+
+	return nil
+}
+
+// patchSSOConfig writes an sso key and the ArgoCD url to argocd-cm
+func patchSSOConfig(ctx context.Context, clientset kubernetes.Interface, url string, key string, value string) error {
+	data := map[string]*string{key: &value}
+	if url != "" {
+		data[argoCDURLKey] = &url
+	}
+
+	_, err := k8s.PatchConfigMap(ctx, clientset, "argocd", argoCDConfigMapName, data)
+	if err != nil {
+		return fmt.Errorf("error writing argocd %s: %s", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func TestSSOConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  interface{ Validate() error }
+		wantErr bool
+	}{
+		{name: "oidc", config: OIDCConfig{Name: "Vault", Issuer: "https://vault.example.com/v1/identity/oidc/provider/kubefirst", ClientID: "argocd"}},
+		{name: "oidc without issuer", config: OIDCConfig{Name: "Vault", ClientID: "argocd"}, wantErr: true},
+		{name: "oidc without client id", config: OIDCConfig{Name: "Vault", Issuer: "https://vault.example.com"}, wantErr: true},
+		{name: "dex", config: DexConfig{Connectors: []DexConnector{GitHubDexConnector("id", "secret", "kubefirst")}}},
+		{name: "dex without connectors", config: DexConfig{}, wantErr: true},
+		{name: "dex connector without id", config: DexConfig{Connectors: []DexConnector{{Type: "github"}}}, wantErr: true},
+		{name: "dex connector without type", config: DexConfig{Connectors: []DexConnector{{ID: "github"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr && err == nil {
+				t.Error("wanted an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("wanted no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestSetSSOConfigStoresClientSecrets(t *testing.T) {
+	existingDex := `connectors:
+- type: ldap
+  id: ldap
+  name: LDAP
+  config:
+    host: ldap.example.com
+- type: github
+  id: github
+  name: GitHub
+  config:
+    clientID: old
+staticClients:
+- id: cli
+`
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: argoCDConfigMapName, Namespace: "argocd"},
+			Data:       map[string]string{dexConfigKey: existingDex},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: argoCDSecretName, Namespace: "argocd"},
+			Data:       map[string][]byte{"server.secretkey": []byte("key")},
+		},
+	)
+	ctx := context.Background()
+
+	err := SetDexConfig(ctx, clientset, "https://argocd.example.com", DexConfig{
+		Connectors: []DexConnector{GitHubDexConnector("new", "dex-secret", "kubefirst")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetOIDCConfig(ctx, clientset, "", OIDCConfig{Name: "Vault", Issuer: "https://vault.example.com", ClientID: "argocd", ClientSecret: "oidc-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("argocd").Get(ctx, argoCDConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range configMap.Data {
+		if strings.Contains(value, "dex-secret") || strings.Contains(value, "oidc-secret") {
+			t.Errorf("argocd-cm key %s contains a client secret: %s", key, value)
+		}
+	}
+	if configMap.Data[argoCDURLKey] != "https://argocd.example.com" {
+		t.Errorf("wanted the argocd url to be set, got %q", configMap.Data[argoCDURLKey])
+	}
+
+	var dexConfig struct {
+		Connectors    []DexConnector           `json:"connectors"`
+		StaticClients []map[string]interface{} `json:"staticClients"`
+	}
+	err = yaml.Unmarshal([]byte(configMap.Data[dexConfigKey]), &dexConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dexConfig.Connectors) != 2 || dexConfig.Connectors[0].ID != "ldap" || dexConfig.Connectors[1].ID != "github" {
+		t.Fatalf("wanted the ldap connector kept and the github connector replaced, got %v", dexConfig.Connectors)
+	}
+	if dexConfig.Connectors[1].Config["clientID"] != "new" || dexConfig.Connectors[1].Config["clientSecret"] != "$dex.github.clientSecret" {
+		t.Errorf("wanted the github connector to reference its secret, got %v", dexConfig.Connectors[1].Config)
+	}
+	if len(dexConfig.StaticClients) != 1 {
+		t.Errorf("wanted staticClients to be kept, got %v", dexConfig.StaticClients)
+	}
+	if !strings.Contains(configMap.Data[oidcConfigKey], "$oidc.clientSecret") {
+		t.Errorf("wanted oidc.config to reference its secret, got %s", configMap.Data[oidcConfigKey])
+	}
+
+	secret, err := clientset.CoreV1().Secrets("argocd").Get(ctx, argoCDSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["dex.github.clientSecret"]) != "dex-secret" || string(secret.Data[oidcClientSecretKey]) != "oidc-secret" {
+		t.Errorf("wanted the client secrets in %s, got keys %v", argoCDSecretName, secret.Data)
+	}
+	if string(secret.Data["server.secretkey"]) != "key" {
+		t.Errorf("wanted existing %s keys to be kept", argoCDSecretName)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg/argocdModel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// operation phases reported in Application status.operationState.phase
+	OperationRunning     = "Running"
+	OperationTerminating = "Terminating"
+	OperationFailed      = "Failed"
+	OperationError       = "Error"
+	OperationSucceeded   = "Succeeded"
+
+	// health statuses reported for Applications and their resources
+	HealthHealthy     = "Healthy"
+	HealthProgressing = "Progressing"
+	HealthDegraded    = "Degraded"
+	HealthSuspended   = "Suspended"
+	HealthMissing     = "Missing"
+
+	defaultSyncTimeout      = 10 * time.Minute
+	defaultSyncPollInterval = 5 * time.Second
+)
+
+// SyncOptions configures SyncAndWait
+type SyncOptions struct {
+	// Revision to sync to, defaults to the Application's target revision
+	Revision string
+	// Prune deletes resources that are no longer defined in git
+	Prune bool
+	// Resources limits the sync to specific resources
+	Resources []argocdModel.V1alpha1SyncOperationResource
+	// SyncOptions such as CreateNamespace=true or ServerSideApply=true
+	SyncOptions []string
+	// WaitForHealth keeps waiting after the operation succeeds until the
+	// Application is Healthy or Degraded
+	WaitForHealth bool
+	// Timeout defaults to 10 minutes
+	Timeout time.Duration
+	// PollInterval defaults to 5 seconds
+	PollInterval time.Duration
+	// Progress is called every time a resource changes, it defaults to logging
+	// the change
+	Progress SyncProgressHandler
+}
+
+// SyncResourceProgress is the state of a single resource during a sync
+type SyncResourceProgress struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	SyncWave  int64  `json:"syncWave"`
+	HookType  string `json:"hookType,omitempty"`
+	HookPhase string `json:"hookPhase,omitempty"`
+	// SyncStatus is the result of applying the resource, e.g. Synced or SyncFailed
+	SyncStatus string `json:"syncStatus,omitempty"`
+	Health     string `json:"health,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// String returns a one line description of the resource state
+func (p SyncResourceProgress) String() string {
+	resource := fmt.Sprintf("%s/%s", p.Kind, p.Name)
+	if p.Namespace != "" {
+		resource = fmt.Sprintf("%s/%s/%s", p.Namespace, p.Kind, p.Name)
+	}
+
+	state := []string{fmt.Sprintf("wave %d", p.SyncWave)}
+	if p.HookType != "" {
+		state = append(state, fmt.Sprintf("hook %s %s", p.HookType, p.HookPhase))
+	}
+	if p.SyncStatus != "" {
+		state = append(state, p.SyncStatus)
+	}
+	if p.Health != "" {
+		state = append(state, p.Health)
+	}
+	if p.Message != "" {
+		state = append(state, p.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", resource, strings.Join(state, ", "))
+}
+
+// SyncProgressHandler is called by SyncAndWait when a resource changes
+type SyncProgressHandler func(application string, progress SyncResourceProgress)
+
+// LogSyncProgressHandler logs each resource change
+func LogSyncProgressHandler(application string, progress SyncResourceProgress) {
+	log.Info().Msgf("argocd application %s: %s", application, progress)
+}
+
+// SyncFailedError is returned by SyncAndWait when the sync operation fails or
+// resources of the Application become Degraded
+type SyncFailedError struct {
+	Application string
+	Phase       string
+	Message     string
+	Degraded    []SyncResourceProgress
+}
+
+func (e *SyncFailedError) Error() string {
+	message := fmt.Sprintf("sync of argocd application %s failed", e.Application)
+	if e.Phase != "" {
+		message = fmt.Sprintf("%s with phase %s", message, e.Phase)
+	}
+	if e.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, e.Message)
+	}
+	if len(e.Degraded) > 0 {
+		resources := make([]string, 0, len(e.Degraded))
+		for _, resource := range e.Degraded {
+			resources = append(resources, resource.String())
+		}
+		message = fmt.Sprintf("%s; degraded resources: %s", message, strings.Join(resources, "; "))
+	}
+
+	return message
+}
+
+// SyncAndWait triggers a sync of an ArgoCD Application and follows the sync
+// operation until it completes, reporting the sync wave, hook and health of
+// each resource as it progresses
+//
+// A *SyncFailedError listing the Degraded resources is returned if the
+// operation fails or, when WaitForHealth is set, the Application becomes
+// Degraded
+func (c *Client) SyncAndWait(ctx context.Context, name string, opts SyncOptions) (argocdModel.V1alpha1Application, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultSyncTimeout
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultSyncPollInterval
+	}
+	if opts.Progress == nil {
+		opts.Progress = LogSyncProgressHandler
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	// the previous operation remains in the status until the new one starts
+	current, err := c.GetApplication(ctx, name)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+	previousStart := current.Status.OperationState.StartedAt
+
+	request := argocdModel.ApplicationApplicationSyncRequest{
+		Revision:  opts.Revision,
+		Prune:     opts.Prune,
+		Resources: opts.Resources,
+	}
+	if len(opts.SyncOptions) > 0 {
+		request.SyncOptions = &argocdModel.ApplicationSyncOptions{Items: opts.SyncOptions}
+	}
+	_, err = c.Sync(ctx, name, request)
+	if err != nil {
+		return argocdModel.V1alpha1Application{}, err
+	}
+
+	reported := make(map[string]string)
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return current, fmt.Errorf("timed out waiting for sync of argocd application %s: %s", name, ctx.Err())
+		case <-ticker.C:
+		}
+
+		current, err = c.GetApplication(ctx, name)
+		if err != nil {
+			log.Warn().Msgf("error getting argocd application %s, retrying: %s", name, err)
+			continue
+		}
+
+		resources := SyncProgress(current)
+		for _, resource := range resources {
+			key := resourceKey(resource.Group, resource.Kind, resource.Namespace, resource.Name)
+			state := resource.String()
+			if reported[key] != state {
+				reported[key] = state
+				opts.Progress(name, resource)
+			}
+		}
+
+		operation := current.Status.OperationState
+		if !operation.StartedAt.After(previousStart) {
+			continue
+		}
+
+		switch operation.Phase {
+		case OperationFailed, OperationError:
+			return current, &SyncFailedError{
+				Application: name,
+				Phase:       operation.Phase,
+				Message:     operation.Message,
+				Degraded:    failedResources(resources),
+			}
+		case OperationSucceeded:
+			if !opts.WaitForHealth {
+				log.Info().Msgf("sync of argocd application %s succeeded", name)
+				return current, nil
+			}
+			switch current.Status.Health.Status {
+			case HealthHealthy, HealthSuspended:
+				log.Info().Msgf("sync of argocd application %s succeeded and is %s", name, current.Status.Health.Status)
+				return current, nil
+			case HealthDegraded:
+				return current, &SyncFailedError{
+					Application: name,
+					Phase:       operation.Phase,
+					Message:     "application is Degraded",
+					Degraded:    failedResources(resources),
+				}
+			}
+		}
+	}
+}
+
+// SyncProgress returns the state of each resource of an Application ordered by
+// sync wave, combining the resource health with the result of the last sync
+// operation
+func SyncProgress(application argocdModel.V1alpha1Application) []SyncResourceProgress {
+	index := make(map[string]int)
+	resources := make([]SyncResourceProgress, 0, len(application.Status.Resources))
+
+	for _, resource := range application.Status.Resources {
+		index[resourceKey(resource.Group, resource.Kind, resource.Namespace, resource.Name)] = len(resources)
+		resources = append(resources, SyncResourceProgress{
+			Group:     resource.Group,
+			Kind:      resource.Kind,
+			Namespace: resource.Namespace,
+			Name:      resource.Name,
+			SyncWave:  resource.SyncWave,
+			Health:    resource.Health.Status,
+			Message:   resource.Health.Message,
+		})
+	}
+
+	// hooks only show up in the sync result
+	for _, result := range application.Status.OperationState.SyncResult.Resources {
+		key := resourceKey(result.Group, result.Kind, result.Namespace, result.Name)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(resources)
+			i = len(resources)
+			resources = append(resources, SyncResourceProgress{
+				Group:     result.Group,
+				Kind:      result.Kind,
+				Namespace: result.Namespace,
+				Name:      result.Name,
+			})
+		}
+		resources[i].HookType = result.HookType
+		resources[i].HookPhase = result.HookPhase
+		resources[i].SyncStatus = result.Status
+		if result.Message != "" && (resources[i].Message == "" || result.Status == "SyncFailed") {
+			resources[i].Message = result.Message
+		}
+	}
+
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resources[i].SyncWave < resources[j].SyncWave
+	})
+
+	return resources
+}
+
+// failedResources returns the resources that are Degraded, failed to apply or
+// whose hook failed
+func failedResources(resources []SyncResourceProgress) []SyncResourceProgress {
+	failed := make([]SyncResourceProgress, 0)
+	for _, resource := range resources {
+		if resource.Health == HealthDegraded ||
+			resource.SyncStatus == "SyncFailed" ||
+			resource.HookPhase == OperationFailed ||
+			resource.HookPhase == OperationError {
+			failed = append(failed, resource)
+		}
+	}
+
+	return failed
+}
+
+func resourceKey(group, kind, namespace, name string) string {
+	return strings.Join([]string{group, kind, namespace, name}, "/")
+}
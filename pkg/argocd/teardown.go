@@ -0,0 +1,420 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// ResourcesFinalizer makes ArgoCD delete the resources of an Application
+	// before the Application itself is removed
+	ResourcesFinalizer = "resources-finalizer.argocd.argoproj.io"
+	// SyncWaveAnnotation orders Applications during sync, teardown uses the
+	// reverse order
+	SyncWaveAnnotation = "argocd.argoproj.io/sync-wave"
+
+	// outcomes reported in ApplicationTeardownResult.Outcome
+	TeardownDeleted            = "Deleted"
+	TeardownNotFound           = "NotFound"
+	TeardownFinalizersStripped = "FinalizersStripped"
+	TeardownStuck              = "Stuck"
+	TeardownFailed             = "Failed"
+
+	defaultTeardownTimeout      = 2 * time.Minute
+	defaultFinalizerStripWait   = 30 * time.Second
+	defaultTeardownRootApp      = "registry"
+	defaultTeardownAppNamespace = "argocd"
+)
+
+// TeardownOptions configures TeardownApplications
+type TeardownOptions struct {
+	// Namespace of the Application CRs, defaults to argocd
+	Namespace string
+	// RootApplication has its syncPolicy removed before anything is deleted so
+	// it does not recreate its children, defaults to registry - it is only
+	// deleted when it is included in Applications
+	RootApplication string
+	// Applications to delete, every Application in Namespace when empty
+	Applications []string
+	// Cascade deletes the resources managed by every Application using the
+	// ArgoCD resources finalizer, CascadeApplications enables this for specific
+	// Applications only - other Applications keep the finalizers they already
+	// have, so their manifests decide whether resources are deleted
+	Cascade             bool
+	CascadeApplications []string
+	// Orphan removes the resources finalizer from Applications that do not
+	// cascade so their resources are left in the cluster
+	Orphan bool
+	// Timeout is how long to wait for each Application to be removed, defaults
+	// to 2 minutes
+	Timeout time.Duration
+	// StripFinalizers removes the finalizers of Applications that are still
+	// present after Timeout
+	StripFinalizers bool
+}
+
+// ApplicationTeardownResult is the outcome of deleting a single Application
+type ApplicationTeardownResult struct {
+	Name     string `json:"name"`
+	SyncWave int    `json:"syncWave"`
+	Outcome  string `json:"outcome"`
+	// Cascade is set when the resources of the Application were deleted with it
+	Cascade  bool          `json:"cascade"`
+	Duration time.Duration `json:"duration"`
+	// StuckFinalizers are the finalizers that were still present at the deadline
+	StuckFinalizers []string `json:"stuckFinalizers,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// TeardownResult reports the outcome of TeardownApplications for each
+// Application in the order they were deleted
+type TeardownResult struct {
+	Applications []ApplicationTeardownResult `json:"applications"`
+}
+
+// Failed returns the Applications that are stuck or could not be deleted
+func (r *TeardownResult) Failed() []ApplicationTeardownResult {
+	failed := make([]ApplicationTeardownResult, 0)
+	for _, app := range r.Applications {
+		if app.Outcome == TeardownStuck || app.Outcome == TeardownFailed {
+			failed = append(failed, app)
+		}
+	}
+
+	return failed
+}
+
+// TeardownApplications deletes ArgoCD Applications in reverse sync-wave order,
+// Applications in the same wave are deleted concurrently
+//
+// Each Application has its syncPolicy removed, the resources finalizer added
+// when its resources should cascade or removed when they should be orphaned,
+// and is then deleted and watched until the CR is gone. Applications still
+// present after the timeout are reported as Stuck along with their finalizers,
+// or have the finalizers stripped when StripFinalizers is set
+func TeardownApplications(ctx context.Context, dynamicClient dynamic.Interface, opts TeardownOptions) (*TeardownResult, error) {
+	if opts.Namespace == "" {
+		opts.Namespace = defaultTeardownAppNamespace
+	}
+	if opts.RootApplication == "" {
+		opts.RootApplication = defaultTeardownRootApp
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTeardownTimeout
+	}
+	client := dynamicClient.Resource(ApplicationResource).Namespace(opts.Namespace)
+	result := &TeardownResult{Applications: make([]ApplicationTeardownResult, 0)}
+
+	err := disableApplicationSync(ctx, client, opts.RootApplication)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Warn().Msgf("could not remove syncPolicy from %s: %s", opts.RootApplication, err)
+	}
+
+	list, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return result, fmt.Errorf("error listing argocd applications in namespace %s: %s", opts.Namespace, err)
+	}
+	existing := make(map[string]unstructured.Unstructured)
+	for _, item := range list.Items {
+		existing[item.GetName()] = item
+	}
+
+	names := opts.Applications
+	if len(names) == 0 {
+		for _, item := range list.Items {
+			if item.GetName() != opts.RootApplication {
+				names = append(names, item.GetName())
+			}
+		}
+	}
+
+	// group applications by wave, applications that are already gone are
+	// reported straight away
+	waves := make(map[int][]string)
+	deleteRoot := false
+	for _, name := range names {
+		app, ok := existing[name]
+		if !ok {
+			result.Applications = append(result.Applications, ApplicationTeardownResult{Name: name, Outcome: TeardownNotFound})
+			continue
+		}
+		// the root application is always deleted last since it owns the others
+		if name == opts.RootApplication {
+			deleteRoot = true
+			continue
+		}
+		wave := applicationSyncWave(app)
+		waves[wave] = append(waves[wave], name)
+	}
+	order := make([]int, 0, len(waves))
+	for wave := range waves {
+		order = append(order, wave)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(order)))
+
+	for _, wave := range order {
+		log.Info().Msgf("deleting argocd applications in sync wave %d: %s", wave, strings.Join(waves[wave], ", "))
+
+		waveResults := make([]ApplicationTeardownResult, len(waves[wave]))
+		var wg sync.WaitGroup
+		for i, name := range waves[wave] {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				waveResults[i] = teardownApplication(ctx, client, name, wave, opts)
+			}(i, name)
+		}
+		wg.Wait()
+		result.Applications = append(result.Applications, waveResults...)
+
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+
+	if deleteRoot {
+		root := existing[opts.RootApplication]
+		result.Applications = append(result.Applications, teardownApplication(ctx, client, opts.RootApplication, applicationSyncWave(root), opts))
+	}
+
+	failed := result.Failed()
+	if len(failed) > 0 {
+		names := make([]string, 0, len(failed))
+		for _, app := range failed {
+			names = append(names, fmt.Sprintf("%s (%s)", app.Name, app.Outcome))
+		}
+		return result, fmt.Errorf("unable to delete argocd applications: %s", strings.Join(names, ", "))
+	}
+
+	return result, nil
+}
+
+// teardownApplication deletes a single Application and waits for it to be removed
+func teardownApplication(ctx context.Context, client dynamic.ResourceInterface, name string, wave int, opts TeardownOptions) ApplicationTeardownResult {
+	start := time.Now()
+	result := ApplicationTeardownResult{
+		Name:     name,
+		SyncWave: wave,
+		Cascade:  opts.Cascade || contains(opts.CascadeApplications, name),
+	}
+	fail := func(outcome string, err error) ApplicationTeardownResult {
+		result.Outcome = outcome
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		log.Error().Msgf("error deleting argocd application %s: %s", name, err)
+		return result
+	}
+
+	err := disableApplicationSync(ctx, client, name)
+	if errors.IsNotFound(err) {
+		result.Outcome = TeardownNotFound
+		return result
+	}
+	if err != nil {
+		return fail(TeardownFailed, err)
+	}
+
+	cascade, err := setResourcesFinalizer(ctx, client, name, result.Cascade, opts.Orphan)
+	if err != nil && !errors.IsNotFound(err) {
+		return fail(TeardownFailed, err)
+	}
+	result.Cascade = cascade
+
+	err = client.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fail(TeardownFailed, fmt.Errorf("error deleting application: %s", err))
+	}
+	log.Info().Msgf("deleting argocd application %s (cascade: %t)", name, result.Cascade)
+
+	err = waitForApplicationRemoval(ctx, client, name, opts.Timeout)
+	if err == nil {
+		result.Outcome = TeardownDeleted
+		result.Duration = time.Since(start)
+		log.Info().Msgf("argocd application %s deleted", name)
+		return result
+	}
+
+	app, getErr := client.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(getErr) {
+		result.Outcome = TeardownDeleted
+		result.Duration = time.Since(start)
+		return result
+	}
+	if app != nil {
+		result.StuckFinalizers = app.GetFinalizers()
+	}
+	if !opts.StripFinalizers || len(result.StuckFinalizers) == 0 {
+		return fail(TeardownStuck, fmt.Errorf("application was not removed after %s, finalizers: %s", opts.Timeout, strings.Join(result.StuckFinalizers, ", ")))
+	}
+
+	log.Warn().Msgf("argocd application %s is stuck on finalizers %s, removing them", name, strings.Join(result.StuckFinalizers, ", "))
+	_, err = client.Patch(ctx, name, types.MergePatchType, []byte(`{"metadata":{"finalizers":null}}`), metav1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fail(TeardownStuck, fmt.Errorf("error removing finalizers: %s", err))
+	}
+	err = waitForApplicationRemoval(ctx, client, name, defaultFinalizerStripWait)
+	if err != nil {
+		return fail(TeardownStuck, err)
+	}
+
+	result.Outcome = TeardownFinalizersStripped
+	result.Duration = time.Since(start)
+	log.Info().Msgf("argocd application %s deleted after removing finalizers", name)
+
+	return result
+}
+
+// disableApplicationSync removes the syncPolicy of an Application so it is not
+// synced while it is being deleted
+func disableApplicationSync(ctx context.Context, client dynamic.ResourceInterface, name string) error {
+	_, err := client.Patch(ctx, name, types.MergePatchType, []byte(`{"spec":{"syncPolicy":null}}`), metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("removed syncPolicy from argocd application %s", name)
+
+	return nil
+}
+
+// setResourcesFinalizer adds the ArgoCD resources finalizer to an Application
+// when cascade is true and removes it when orphan is true, otherwise the
+// finalizers are left as they are. It returns whether the resources of the
+// Application will be deleted with it
+//
+// The finalizers are merge patched pinned to the resourceVersion that was read,
+// the ArgoCD controller writes to the Application constantly so the change is
+// retried on conflict
+func setResourcesFinalizer(ctx context.Context, client dynamic.ResourceInterface, name string, cascade bool, orphan bool) (bool, error) {
+	willCascade := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		app, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		present := contains(app.GetFinalizers(), ResourcesFinalizer)
+		willCascade = present
+		if present == cascade || (!cascade && !orphan) {
+			return nil
+		}
+
+		finalizers := make([]string, 0)
+		for _, finalizer := range app.GetFinalizers() {
+			if finalizer != ResourcesFinalizer {
+				finalizers = append(finalizers, finalizer)
+			}
+		}
+		if cascade {
+			finalizers = append(finalizers, ResourcesFinalizer)
+		}
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"finalizers":      finalizers,
+				"resourceVersion": app.GetResourceVersion(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = client.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+		willCascade = cascade
+
+		return nil
+	})
+	if err != nil {
+		return willCascade, fmt.Errorf("error updating finalizers: %s", err)
+	}
+
+	return willCascade, nil
+}
+
+// waitForApplicationRemoval watches an Application until it is deleted or the
+// timeout expires
+func waitForApplicationRemoval(ctx context.Context, client dynamic.ResourceInterface, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		app, err := client.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out waiting for argocd application %s to be removed", name)
+			}
+			log.Warn().Msgf("error getting argocd application %s, retrying: %s", name, err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		objWatch, err := client.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fmt.Sprintf("metadata.name=%s", name),
+			ResourceVersion: app.GetResourceVersion(),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out waiting for argocd application %s to be removed", name)
+			}
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		for event := range objWatch.ResultChan() {
+			if event.Type == watch.Deleted {
+				objWatch.Stop()
+				return nil
+			}
+		}
+		objWatch.Stop()
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out waiting for argocd application %s to be removed", name)
+		}
+	}
+}
+
+// applicationSyncWave returns the sync wave annotation of an Application, 0 when
+// it is unset or invalid
+func applicationSyncWave(app unstructured.Unstructured) int {
+	wave, err := strconv.Atoi(app.GetAnnotations()[SyncWaveAnnotation])
+	if err != nil {
+		return 0
+	}
+
+	return wave
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
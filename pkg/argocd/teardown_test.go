@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSetResourcesFinalizer(t *testing.T) {
+	tests := []struct {
+		name        string
+		finalizers  []string
+		cascade     bool
+		orphan      bool
+		wantCascade bool
+		want        []string
+	}{
+		{name: "default keeps existing finalizer", finalizers: []string{ResourcesFinalizer}, wantCascade: true, want: []string{ResourcesFinalizer}},
+		{name: "default does not add finalizer", finalizers: []string{}, want: []string{}},
+		{name: "cascade adds finalizer", finalizers: []string{"other"}, cascade: true, wantCascade: true, want: []string{"other", ResourcesFinalizer}},
+		{name: "orphan removes finalizer", finalizers: []string{ResourcesFinalizer, "other"}, orphan: true, want: []string{"other"}},
+		{name: "cascade wins over orphan", finalizers: []string{}, cascade: true, orphan: true, wantCascade: true, want: []string{ResourcesFinalizer}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &unstructured.Unstructured{}
+			app.SetAPIVersion("argoproj.io/v1alpha1")
+			app.SetKind("Application")
+			app.SetNamespace("argocd")
+			app.SetName("metrics")
+			app.SetFinalizers(tt.finalizers)
+
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{ApplicationResource: "ApplicationList"}, app)
+			client := dynamicClient.Resource(ApplicationResource).Namespace("argocd")
+
+			cascade, err := setResourcesFinalizer(context.Background(), client, "metrics", tt.cascade, tt.orphan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cascade != tt.wantCascade {
+				t.Errorf("wanted cascade %t, got %t", tt.wantCascade, cascade)
+			}
+
+			updated, err := client.Get(context.Background(), "metrics", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(updated.GetFinalizers(), ","); got != strings.Join(tt.want, ",") {
+				t.Errorf("wanted finalizers %v, got %v", tt.want, updated.GetFinalizers())
+			}
+		})
+	}
+}
+
+func TestSetResourcesFinalizerRetriesOnConflict(t *testing.T) {
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion("argoproj.io/v1alpha1")
+	app.SetKind("Application")
+	app.SetNamespace("argocd")
+	app.SetName("metrics")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ApplicationResource: "ApplicationList"}, app)
+	patches := 0
+	dynamicClient.PrependReactor("patch", "applications", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			// the controller updated the Application since it was read
+			return true, nil, errors.NewConflict(ApplicationResource.GroupResource(), "metrics", nil)
+		}
+		if !strings.Contains(string(action.(k8stesting.PatchAction).GetPatch()), `"resourceVersion"`) {
+			t.Errorf("wanted the patch to be pinned to a resourceVersion, got %s", action.(k8stesting.PatchAction).GetPatch())
+		}
+		return false, nil, nil
+	})
+	client := dynamicClient.Resource(ApplicationResource).Namespace("argocd")
+
+	cascade, err := setResourcesFinalizer(context.Background(), client, "metrics", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cascade || patches != 2 {
+		t.Errorf("wanted cascade after 2 patches, got cascade %t after %d patches", cascade, patches)
+	}
+
+	updated, err := client.Get(context.Background(), "metrics", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := updated.GetFinalizers(); len(got) != 1 || got[0] != ResourcesFinalizer {
+		t.Errorf("wanted finalizers [%s], got %v", ResourcesFinalizer, got)
+	}
+}
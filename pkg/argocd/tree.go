@@ -0,0 +1,224 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	v1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	health "github.com/argoproj/gitops-engine/pkg/health"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ApplicationTreeFormatTree renders an application tree as indented text
+	ApplicationTreeFormatTree = "tree"
+	// ApplicationTreeFormatJSON renders an application tree as JSON
+	ApplicationTreeFormatJSON = "json"
+)
+
+// ApplicationTreeNode is the status of an ArgoCD Application and of the child
+// Applications it manages
+type ApplicationTreeNode struct {
+	Name               string                 `json:"name"`
+	Namespace          string                 `json:"namespace"`
+	SyncStatus         string                 `json:"syncStatus"`
+	HealthStatus       string                 `json:"healthStatus"`
+	HealthMessage      string                 `json:"healthMessage,omitempty"`
+	OperationPhase     string                 `json:"operationPhase,omitempty"`
+	OperationMessage   string                 `json:"operationMessage,omitempty"`
+	UnhealthyResources []UnhealthyResource    `json:"unhealthyResources,omitempty"`
+	Children           []*ApplicationTreeNode `json:"children,omitempty"`
+	// Error is set when the Application could not be retrieved
+	Error string `json:"error,omitempty"`
+}
+
+// UnhealthyResource is a resource of an Application that is out of sync or not
+// Healthy
+type UnhealthyResource struct {
+	Group      string `json:"group,omitempty"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	SyncStatus string `json:"syncStatus,omitempty"`
+	Health     string `json:"health,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Healthy returns true if the Application and all of its children are Synced and
+// Healthy
+func (n *ApplicationTreeNode) Healthy() bool {
+	if n.Error != "" ||
+		n.SyncStatus != string(v1alpha1.SyncStatusCodeSynced) ||
+		n.HealthStatus != string(health.HealthStatusHealthy) {
+		return false
+	}
+	for _, child := range n.Children {
+		if !child.Healthy() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetApplicationTree walks the app-of-apps tree starting at the root
+// Application, e.g. registry, following the child Applications listed in each
+// Application's status.resources
+//
+// Applications that cannot be retrieved are reported with Error set rather than
+// failing the whole tree, only an error retrieving the root is returned
+func GetApplicationTree(ctx context.Context, clientset kubernetes.Interface, root string) (*ApplicationTreeNode, error) {
+	visited := make(map[string]bool)
+	tree := getApplicationTreeNode(ctx, clientset, "argocd", root, visited)
+	if tree.Error != "" {
+		return nil, fmt.Errorf("error retrieving argocd application %s: %s", root, tree.Error)
+	}
+
+	return tree, nil
+}
+
+// getApplicationTreeNode retrieves an Application and recursively its children
+func getApplicationTreeNode(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, visited map[string]bool) *ApplicationTreeNode {
+	node := &ApplicationTreeNode{
+		Name:      name,
+		Namespace: namespace,
+	}
+	visited[namespace+"/"+name] = true
+
+	data, err := clientset.CoreV1().RESTClient().Get().
+		AbsPath(fmt.Sprintf("/apis/%s", ArgoCDAPIVersion)).
+		Namespace(namespace).
+		Resource("applications").
+		Name(name).
+		DoRaw(ctx)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+
+	var application v1alpha1.Application
+	if err := json.Unmarshal(data, &application); err != nil {
+		node.Error = fmt.Sprintf("error converting argocd application data: %s", err)
+		return node
+	}
+
+	node.SyncStatus = string(application.Status.Sync.Status)
+	node.HealthStatus = string(application.Status.Health.Status)
+	node.HealthMessage = application.Status.Health.Message
+	if application.Status.OperationState != nil {
+		node.OperationPhase = string(application.Status.OperationState.Phase)
+		node.OperationMessage = application.Status.OperationState.Message
+	}
+
+	for _, resource := range application.Status.Resources {
+		if resource.Group == "argoproj.io" && resource.Kind == "Application" {
+			childNamespace := resource.Namespace
+			if childNamespace == "" {
+				childNamespace = namespace
+			}
+			if visited[childNamespace+"/"+resource.Name] {
+				continue
+			}
+			node.Children = append(node.Children, getApplicationTreeNode(ctx, clientset, childNamespace, resource.Name, visited))
+			continue
+		}
+
+		unhealthy := resource.Status == v1alpha1.SyncStatusCodeOutOfSync
+		resourceHealth, message := "", ""
+		if resource.Health != nil {
+			resourceHealth = string(resource.Health.Status)
+			message = resource.Health.Message
+			if resource.Health.Status != health.HealthStatusHealthy {
+				unhealthy = true
+			}
+		}
+		if unhealthy {
+			node.UnhealthyResources = append(node.UnhealthyResources, UnhealthyResource{
+				Group:      resource.Group,
+				Kind:       resource.Kind,
+				Namespace:  resource.Namespace,
+				Name:       resource.Name,
+				SyncStatus: string(resource.Status),
+				Health:     resourceHealth,
+				Message:    message,
+			})
+		}
+	}
+
+	return node
+}
+
+// RenderApplicationTree writes an application tree to w in the tree or json format
+func RenderApplicationTree(w io.Writer, tree *ApplicationTreeNode, format string) error {
+	switch format {
+	case ApplicationTreeFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(tree)
+	case ApplicationTreeFormatTree, "":
+		var builder strings.Builder
+		renderApplicationTreeNode(&builder, tree, "", "")
+		_, err := io.WriteString(w, builder.String())
+		return err
+	default:
+		return fmt.Errorf("unsupported application tree format %q, expected %s or %s", format, ApplicationTreeFormatTree, ApplicationTreeFormatJSON)
+	}
+}
+
+// renderApplicationTreeNode writes a node prefixed by its branch and its children
+// indented below it
+func renderApplicationTreeNode(builder *strings.Builder, node *ApplicationTreeNode, branch string, indent string) {
+	builder.WriteString(branch + node.Name)
+	if node.Error != "" {
+		builder.WriteString(fmt.Sprintf(" [error: %s]\n", node.Error))
+	} else {
+		builder.WriteString(fmt.Sprintf(" [%s/%s]", valueOrUnknown(node.SyncStatus), valueOrUnknown(node.HealthStatus)))
+		if node.OperationPhase != "" && node.OperationPhase != "Succeeded" {
+			builder.WriteString(fmt.Sprintf(" %s", node.OperationPhase))
+			if node.OperationMessage != "" {
+				builder.WriteString(fmt.Sprintf(": %s", node.OperationMessage))
+			}
+		}
+		builder.WriteString("\n")
+	}
+
+	childIndent := indent + "│   "
+	if len(node.Children) == 0 {
+		childIndent = indent + "    "
+	}
+	for _, resource := range node.UnhealthyResources {
+		resourceName := fmt.Sprintf("%s/%s", resource.Kind, resource.Name)
+		if resource.Namespace != "" {
+			resourceName = fmt.Sprintf("%s/%s", resource.Namespace, resourceName)
+		}
+		line := fmt.Sprintf("%s! %s [%s/%s]", childIndent, resourceName, valueOrUnknown(resource.SyncStatus), valueOrUnknown(resource.Health))
+		if resource.Message != "" {
+			line = fmt.Sprintf("%s %s", line, resource.Message)
+		}
+		builder.WriteString(line + "\n")
+	}
+
+	for i, child := range node.Children {
+		if i == len(node.Children)-1 {
+			renderApplicationTreeNode(builder, child, indent+"└── ", indent+"    ")
+		} else {
+			renderApplicationTreeNode(builder, child, indent+"├── ", indent+"│   ")
+		}
+	}
+}
+
+func valueOrUnknown(value string) string {
+	if value == "" {
+		return "Unknown"
+	}
+	return value
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// testApplicationTreeServer serves Applications by name, unknown names are not found
+func testApplicationTreeServer(t *testing.T, applications map[string]string) (kubernetes.Interface, map[string]int) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/apis/argoproj.io/v1alpha1/namespaces/argocd/applications/")
+		requests[name]++
+		w.Header().Set("Content-Type", "application/json")
+		application, ok := applications[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(application))
+	}))
+	t.Cleanup(server.Close)
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientset, requests
+}
+
+func testApplicationJSON(name string, sync string, health string, resources string) string {
+	return `{"metadata":{"name":"` + name + `","namespace":"argocd"},"status":{"sync":{"status":"` + sync + `"},"health":{"status":"` + health + `"},"resources":[` + resources + `]}}`
+}
+
+func testChildApplication(name string) string {
+	return `{"group":"argoproj.io","kind":"Application","namespace":"argocd","name":"` + name + `"}`
+}
+
+func TestGetApplicationTree(t *testing.T) {
+	clientset, requests := testApplicationTreeServer(t, map[string]string{
+		"registry": testApplicationJSON("registry", "Synced", "Progressing", testChildApplication("vault")+","+testChildApplication("metaphor")),
+		"vault": testApplicationJSON("vault", "Synced", "Degraded",
+			`{"kind":"StatefulSet","namespace":"vault","name":"vault","status":"Synced","health":{"status":"Degraded","message":"0 of 3 ready"}},`+
+				`{"kind":"Service","namespace":"vault","name":"vault","status":"Synced","health":{"status":"Healthy"}}`),
+		// metaphor refers back to registry and to vault, which were already visited,
+		// and to an Application that does not exist
+		"metaphor": testApplicationJSON("metaphor", "OutOfSync", "Healthy",
+			testChildApplication("registry")+","+testChildApplication("vault")+","+testChildApplication("missing")+","+
+				`{"kind":"ConfigMap","namespace":"metaphor","name":"settings","status":"OutOfSync"}`),
+	})
+
+	tree, err := GetApplicationTree(context.Background(), clientset, "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, count := range requests {
+		if count != 1 {
+			t.Errorf("wanted application %s to be retrieved once, got %d", name, count)
+		}
+	}
+	if tree.Healthy() {
+		t.Error("wanted the tree to be unhealthy")
+	}
+
+	var rendered bytes.Buffer
+	err = RenderApplicationTree(&rendered, tree, ApplicationTreeFormatTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `registry [Synced/Progressing]
+├── vault [Synced/Degraded]
+│       ! vault/StatefulSet/vault [Synced/Degraded] 0 of 3 ready
+└── metaphor [OutOfSync/Healthy]
+    │   ! metaphor/ConfigMap/settings [OutOfSync/Unknown]
+    └── missing [error: the server could not find the requested resource (get applications missing)]
+`
+	if rendered.String() != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, rendered.String())
+	}
+
+	rendered.Reset()
+	err = RenderApplicationTree(&rendered, tree, ApplicationTreeFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ApplicationTreeNode
+	err = json.Unmarshal(rendered.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Children) != 2 || decoded.Children[1].Children[0].Error == "" {
+		t.Errorf("wanted the json tree to keep children and errors, got %s", rendered.String())
+	}
+
+	if err := RenderApplicationTree(&rendered, tree, "yaml"); err == nil {
+		t.Error("wanted an error for an unsupported format")
+	}
+}
+
+func TestGetApplicationTreeMissingRoot(t *testing.T) {
+	clientset, _ := testApplicationTreeServer(t, map[string]string{})
+
+	if _, err := GetApplicationTree(context.Background(), clientset, "registry"); err == nil {
+		t.Error("wanted an error when the root application does not exist")
+	}
+}
+
+func TestApplicationTreeNodeHealthy(t *testing.T) {
+	healthy := func(children ...*ApplicationTreeNode) *ApplicationTreeNode {
+		return &ApplicationTreeNode{SyncStatus: "Synced", HealthStatus: "Healthy", Children: children}
+	}
+
+	tests := []struct {
+		name string
+		node *ApplicationTreeNode
+		want bool
+	}{
+		{name: "healthy tree", node: healthy(healthy(), healthy(healthy())), want: true},
+		{name: "out of sync", node: &ApplicationTreeNode{SyncStatus: "OutOfSync", HealthStatus: "Healthy"}},
+		{name: "unhealthy grandchild", node: healthy(healthy(&ApplicationTreeNode{SyncStatus: "Synced", HealthStatus: "Degraded"}))},
+		{name: "error", node: healthy(&ApplicationTreeNode{SyncStatus: "Synced", HealthStatus: "Healthy", Error: "not found"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.node.Healthy(); got != tt.want {
+				t.Errorf("wanted %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
@@ -6,8 +6,32 @@ See the LICENSE file for more details.
 */
 package argocd
 
+import "k8s.io/apimachinery/pkg/runtime/schema"
+
 const ArgoCDAPIVersion string = "argoproj.io/v1alpha1"
 
+// ApplicationResource is the ArgoCD Application custom resource for use with a
+// dynamic client
+var ApplicationResource = schema.GroupVersionResource{
+	Group:    "argoproj.io",
+	Version:  "v1alpha1",
+	Resource: "applications",
+}
+
+// AppProjectResource is the ArgoCD AppProject custom resource
+var AppProjectResource = schema.GroupVersionResource{
+	Group:    "argoproj.io",
+	Version:  "v1alpha1",
+	Resource: "appprojects",
+}
+
+// ApplicationSetResource is the ArgoCD ApplicationSet custom resource
+var ApplicationSetResource = schema.GroupVersionResource{
+	Group:    "argoproj.io",
+	Version:  "v1alpha1",
+	Resource: "applicationsets",
+}
+
 // PatchStringValue specifies a patch operation for a string
 type PatchStringValue struct {
 	Op    string `json:"op"`
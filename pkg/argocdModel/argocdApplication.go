@@ -172,7 +172,9 @@ type V1alpha1Application struct {
 				Status  string `json:"status"`
 				Message string `json:"message,omitempty"`
 			} `json:"health"`
-			Group string `json:"group,omitempty"`
+			Group    string `json:"group,omitempty"`
+			Hook     bool   `json:"hook,omitempty"`
+			SyncWave int64  `json:"syncWave,omitempty"`
 		} `json:"resources"`
 		Sync struct {
 			Status     string `json:"status"`
@@ -228,6 +230,7 @@ type V1alpha1Application struct {
 					Name      string `json:"name"`
 					Status    string `json:"status"`
 					Message   string `json:"message"`
+					HookType  string `json:"hookType"`
 					HookPhase string `json:"hookPhase"`
 					SyncPhase string `json:"syncPhase"`
 				} `json:"resources"`
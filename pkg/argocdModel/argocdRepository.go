@@ -0,0 +1,24 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocdModel
+
+// RepositoryRepoAccessQuery is the body of a request to validate access to a
+// repository with a set of credentials
+type RepositoryRepoAccessQuery struct {
+	Repo                       string `json:"repo"`
+	Name                       string `json:"name,omitempty"`
+	Type                       string `json:"type,omitempty"`
+	Project                    string `json:"project,omitempty"`
+	Insecure                   bool   `json:"insecure,omitempty"`
+	Username                   string `json:"username,omitempty"`
+	Password                   string `json:"password,omitempty"`
+	SSHPrivateKey              string `json:"sshPrivateKey,omitempty"`
+	GithubAppID                int64  `json:"githubAppID,omitempty,string"`
+	GithubAppInstallationID    int64  `json:"githubAppInstallationID,omitempty,string"`
+	GithubAppPrivateKey        string `json:"githubAppPrivateKey,omitempty"`
+	GithubAppEnterpriseBaseURL string `json:"githubAppEnterpriseBaseUrl,omitempty"`
+}
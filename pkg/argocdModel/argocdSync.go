@@ -0,0 +1,67 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package argocdModel
+
+// V1alpha1ApplicationList is the response of the ArgoCD list applications endpoint
+type V1alpha1ApplicationList struct {
+	Items []V1alpha1Application `json:"items"`
+}
+
+// V1alpha1SyncOperationResource identifies a single resource to sync
+type V1alpha1SyncOperationResource struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// V1alpha1SyncStrategy controls how resources are synced, apply uses
+// `kubectl apply` and hook also runs resource hooks
+type V1alpha1SyncStrategy struct {
+	Apply *V1alpha1SyncStrategyApply `json:"apply,omitempty"`
+	Hook  *V1alpha1SyncStrategyHook  `json:"hook,omitempty"`
+}
+
+type V1alpha1SyncStrategyApply struct {
+	Force bool `json:"force,omitempty"`
+}
+
+type V1alpha1SyncStrategyHook struct {
+	Force bool `json:"force,omitempty"`
+}
+
+// ApplicationApplicationSyncRequest is the body of a request to sync an application
+type ApplicationApplicationSyncRequest struct {
+	Name        string                          `json:"name,omitempty"`
+	Revision    string                          `json:"revision,omitempty"`
+	DryRun      bool                            `json:"dryRun,omitempty"`
+	Prune       bool                            `json:"prune,omitempty"`
+	Strategy    *V1alpha1SyncStrategy           `json:"strategy,omitempty"`
+	Resources   []V1alpha1SyncOperationResource `json:"resources,omitempty"`
+	SyncOptions *ApplicationSyncOptions         `json:"syncOptions,omitempty"`
+}
+
+// ApplicationSyncOptions are sync options such as CreateNamespace=true
+type ApplicationSyncOptions struct {
+	Items []string `json:"items,omitempty"`
+}
+
+// ApplicationApplicationRollbackRequest is the body of a request to roll an
+// application back to a previous deployment in its history
+type ApplicationApplicationRollbackRequest struct {
+	Name   string `json:"name,omitempty"`
+	ID     int64  `json:"id"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	Prune  bool   `json:"prune,omitempty"`
+}
+
+// RuntimeError is the error body returned by the ArgoCD API
+type RuntimeError struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
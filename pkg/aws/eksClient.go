@@ -8,12 +8,16 @@ package aws
 
 import (
 	"encoding/base64"
+	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/kubefirst/runtime/pkg/k8s"
 	"github.com/rs/zerolog/log"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
 
@@ -76,3 +80,62 @@ func NewRestConfig(cluster *eks.Cluster) (*rest.Config, error) {
 
 	return restConfig, nil
 }
+
+// MergeEKSKubeconfig merges a kubeconfig for an EKS cluster into the kubeconfig
+// at targetPath under contextName, see k8s.MergeKubeconfig
+//
+// Credentials are requested from `aws eks get-token` whenever they expire, unlike
+// NewRestConfig whose static token is only valid for 15 minutes
+func MergeEKSKubeconfig(cluster *eks.Cluster, region string, contextName string, targetPath string, setCurrent bool) error {
+	kubeconfig, err := GenerateExecKubeconfig(cluster, region, contextName)
+	if err != nil {
+		return err
+	}
+
+	return k8s.MergeKubeconfig(kubeconfig, contextName, targetPath, setCurrent)
+}
+
+// GenerateExecKubeconfig returns a kubeconfig for an EKS cluster that uses exec
+// based credentials, ready to be merged with k8s.MergeKubeconfig
+func GenerateExecKubeconfig(cluster *eks.Cluster, region string, contextName string) ([]byte, error) {
+	ca, err := base64.StdEncoding.DecodeString(aws.StringValue(cluster.CertificateAuthority.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[contextName] = &clientcmdapi.Cluster{
+		Server:                   aws.StringValue(cluster.Endpoint),
+		CertificateAuthorityData: ca,
+	}
+	config.AuthInfos[contextName] = &clientcmdapi.AuthInfo{
+		Exec: newEKSExecConfig(aws.StringValue(cluster.Name), region),
+	}
+	config.Contexts[contextName] = &clientcmdapi.Context{
+		Cluster:  contextName,
+		AuthInfo: contextName,
+	}
+	config.CurrentContext = contextName
+
+	kubeconfig, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, fmt.Errorf("error generating kubeconfig for eks cluster %s: %s", aws.StringValue(cluster.Name), err)
+	}
+
+	return kubeconfig, nil
+}
+
+// newEKSExecConfig returns the exec credential plugin configuration for an EKS cluster
+func newEKSExecConfig(clusterName string, region string) *clientcmdapi.ExecConfig {
+	args := []string{"eks", "get-token", "--cluster-name", clusterName}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+
+	return &clientcmdapi.ExecConfig{
+		APIVersion:      "client.authentication.k8s.io/v1beta1",
+		Command:         "aws",
+		Args:            args,
+		InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode,
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-github/v45/github"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// app JWTs may be valid for at most 10 minutes, a minute is taken off both
+	// ends to allow for clock drift
+	appJWTLifetime = 9 * time.Minute
+	// installation tokens are valid for an hour and replaced this long before
+	// they expire, or halfway through when they are issued with less time left
+	installationTokenRefreshMargin = 5 * time.Minute
+)
+
+// requiredAppPermissions are the installation permissions kubefirst needs,
+// the GitHub App counterpart of requiredScopes
+var requiredAppPermissions = map[string]string{
+	"administration":     "write",
+	"contents":           "write",
+	"metadata":           "read",
+	"members":            "write",
+	"organization_hooks": "write",
+	"packages":           "write",
+	"pull_requests":      "write",
+	"repository_hooks":   "write",
+	"workflows":          "write",
+}
+
+// appPermissionLevels orders permission levels
+var appPermissionLevels = map[string]int{"read": 1, "write": 2, "admin": 3}
+
+// AppConfig identifies a GitHub App installation
+type AppConfig struct {
+	AppID int64
+	// PrivateKey is the PEM encoded private key of the app
+	PrivateKey     []byte
+	InstallationID int64
+	// BaseURL of the GitHub API, defaults to https://api.github.com
+	BaseURL string
+}
+
+// AppTokenSource mints installation tokens for a GitHub App and caches them
+// until shortly before they expire, it is safe for concurrent use
+//
+// Installation tokens also authenticate git over https with the username
+// x-access-token
+type AppTokenSource struct {
+	config    AppConfig
+	appClient *github.Client
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	// permissions granted to the current token
+	permissions map[string]string
+}
+
+// NewAppTokenSource returns a token source for a GitHub App installation
+func NewAppTokenSource(config AppConfig) (*AppTokenSource, error) {
+	if config.AppID == 0 || config.InstallationID == 0 || len(config.PrivateKey) == 0 {
+		return nil, fmt.Errorf("github app id, installation id and private key are required")
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing github app private key: %s", err)
+	}
+
+	appClient := github.NewClient(&http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &appJWTTransport{
+			appID: config.AppID,
+			sign: func(claims jwt.Claims) (string, error) {
+				return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+			},
+		},
+	})
+	if config.BaseURL != "" {
+		baseURL, err := url.Parse(strings.TrimSuffix(config.BaseURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid github api url %q: %s", config.BaseURL, err)
+		}
+		appClient.BaseURL = baseURL
+	}
+
+	return &AppTokenSource{config: config, appClient: appClient}, nil
+}
+
+// Token returns the cached installation token, minting a new one when it is
+// about to expire
+func (s *AppTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && time.Now().Before(s.token.Expiry) {
+		return s.token, nil
+	}
+
+	installationToken, _, err := s.appClient.Apps.CreateInstallationToken(context.Background(), s.config.InstallationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token for github app installation %d: %s", s.config.InstallationID, err)
+	}
+	permissions, err := appPermissions(installationToken.GetPermissions())
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := installationToken.GetExpiresAt()
+	margin := installationTokenRefreshMargin
+	if remaining := time.Until(expiresAt); remaining < 2*margin {
+		margin = remaining / 2
+	}
+	s.token = &oauth2.Token{
+		AccessToken: installationToken.GetToken(),
+		TokenType:   "token",
+		Expiry:      expiresAt.Add(-margin),
+	}
+	s.permissions = permissions
+	log.Info().Msgf("created token for github app installation %d, valid until %s", s.config.InstallationID, expiresAt.Format(time.RFC3339))
+
+	return s.token, nil
+}
+
+// Permissions returns the permissions granted to the installation
+func (s *AppTokenSource) Permissions() (map[string]string, error) {
+	_, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.permissions, nil
+}
+
+// NewAppSession - Create a new client for github wrapper authenticated as a
+// GitHub App installation instead of with a personal access token
+func NewAppSession(config AppConfig) (GithubSession, error) {
+	tokenSource, err := NewAppTokenSource(config)
+	if err != nil {
+		return GithubSession{}, err
+	}
+
+	var gSession GithubSession
+	gSession.context = context.Background()
+	gSession.staticToken = tokenSource
+	gSession.oauthClient = oauth2.NewClient(gSession.context, tokenSource)
+	gSession.gitClient = github.NewClient(gSession.oauthClient)
+	if config.BaseURL != "" {
+		gSession.gitClient.BaseURL = tokenSource.appClient.BaseURL
+	}
+
+	return gSession, nil
+}
+
+// VerifyAppInstallationPermissions compares the permissions of a GitHub App
+// installation to the permissions required for kubefirst functionality
+func VerifyAppInstallationPermissions(config AppConfig) error {
+	tokenSource, err := NewAppTokenSource(config)
+	if err != nil {
+		return err
+	}
+	permissions, err := tokenSource.Permissions()
+	if err != nil {
+		return err
+	}
+
+	missing := missingAppPermissions(permissions, requiredAppPermissions)
+	if len(missing) != 0 {
+		return fmt.Errorf("the github app installation is missing permissions - please grant: %v", missing)
+	}
+
+	return nil
+}
+
+// missingAppPermissions returns the required permissions that are not granted
+// at the required level, as permission:level
+func missingAppPermissions(granted map[string]string, required map[string]string) []string {
+	missing := make([]string, 0)
+	for permission, level := range required {
+		if appPermissionLevels[granted[permission]] < appPermissionLevels[level] {
+			missing = append(missing, fmt.Sprintf("%s:%s", permission, level))
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// appPermissions converts installation permissions to a map of permission
+// names to levels
+func appPermissions(permissions *github.InstallationPermissions) (map[string]string, error) {
+	result := make(map[string]string)
+	if permissions == nil {
+		return result, nil
+	}
+
+	encoded, err := json.Marshal(permissions)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(encoded, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// appJWTTransport authenticates requests as the GitHub App itself, which is
+// only needed to mint installation tokens
+type appJWTTransport struct {
+	appID int64
+	sign  func(claims jwt.Claims) (string, error)
+}
+
+func (t *appJWTTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+	signed, err := t.sign(jwt.RegisteredClaims{
+		Issuer:    strconv.FormatInt(t.appID, 10),
+		IssuedAt:  jwt.NewNumericDate(now.Add(-time.Minute)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(appJWTLifetime)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error signing github app jwt: %s", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	minted := 0
+	expiresAt := time.Now().Add(time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/installations/42/access_tokens" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ey") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		minted++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":       "ghs_installation",
+			"expires_at":  expiresAt.Format(time.RFC3339),
+			"permissions": map[string]string{"contents": "write", "metadata": "read"},
+		})
+	}))
+	defer server.Close()
+
+	tokenSource, err := NewAppTokenSource(AppConfig{AppID: 1, InstallationID: 42, PrivateKey: privateKey, BaseURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := tokenSource.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "ghs_installation" {
+			t.Errorf("expected installation token, got %q", token.AccessToken)
+		}
+	}
+	if minted != 1 {
+		t.Errorf("expected the token to be cached, minted %d", minted)
+	}
+
+	// a token within the refresh margin of expiring is replaced
+	expiresAt = time.Now().Add(installationTokenRefreshMargin / 2)
+	tokenSource.token.Expiry = time.Now().Add(-time.Second)
+	_, err = tokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minted != 2 {
+		t.Errorf("expected an expired token to be replaced, minted %d", minted)
+	}
+
+	// a token issued with less than the refresh margin left is still cached
+	// for half of its remaining lifetime
+	_, err = tokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minted != 2 {
+		t.Errorf("expected a short lived token to be cached, minted %d", minted)
+	}
+	if !tokenSource.token.Expiry.After(time.Now()) || !tokenSource.token.Expiry.Before(expiresAt) {
+		t.Errorf("expected the token to be refreshed before %s, refresh at %s", expiresAt, tokenSource.token.Expiry)
+	}
+
+	permissions, err := tokenSource.Permissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := missingAppPermissions(permissions, map[string]string{"contents": "read", "metadata": "write", "members": "write"})
+	if strings.Join(missing, ",") != "members:write,metadata:write" {
+		t.Errorf("unexpected missing permissions %v", missing)
+	}
+}
@@ -324,6 +324,39 @@ func (g GithubSession) DeleteRepositoryWebhook(owner string, repository string,
 	return nil
 }
 
+// UpdateRepositoryWebhookSecret sets the secret of the repository webhook
+// delivering to url, keeping the rest of its configuration
+func (g GithubSession) UpdateRepositoryWebhookSecret(owner string, repository string, url string, secret string) error {
+	webhooks, err := g.ListRepoWebhooks(owner, repository)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range webhooks {
+		if url != hook.Config["url"] {
+			continue
+		}
+
+		// the existing secret is masked in responses, only the fields that
+		// are read back unchanged are sent with the new secret
+		config := map[string]interface{}{
+			"url":          url,
+			"content_type": hook.Config["content_type"],
+			"insecure_ssl": hook.Config["insecure_ssl"],
+			"secret":       secret,
+		}
+		_, _, err := g.gitClient.Repositories.EditHook(g.context, owner, repository, hook.GetID(), &github.Hook{Config: config})
+		if err != nil {
+			return fmt.Errorf("error updating secret of hook %s/%s/%s: %s", owner, repository, url, err)
+		}
+		log.Info().Msgf("updated secret of hook %s/%s/%s", owner, repository, url)
+
+		return nil
+	}
+
+	return fmt.Errorf("hook %s/%s/%s not found", owner, repository, url)
+}
+
 // ListRepoWebhooks returns all webhooks for a repository
 func (g GithubSession) ListRepoWebhooks(owner string, repo string) ([]*github.Hook, error) {
 	container := make([]*github.Hook, 0)
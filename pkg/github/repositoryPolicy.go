@@ -0,0 +1,354 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/rs/zerolog/log"
+)
+
+// CodeOwnersPath is where the CODEOWNERS file is written
+const CodeOwnersPath = ".github/CODEOWNERS"
+
+// BranchProtectionPolicy protects a branch
+type BranchProtectionPolicy struct {
+	// RequiredApprovingReviews before merging, pull requests are not required
+	// when zero and code owner reviews are not required
+	RequiredApprovingReviews int
+	DismissStaleReviews      bool
+	RequireCodeOwnerReviews  bool
+	// RequiredStatusChecks are the status check contexts that must pass
+	RequiredStatusChecks []string
+	// StrictStatusChecks requires branches to be up to date before merging
+	StrictStatusChecks bool
+	EnforceAdmins      bool
+	AllowForcePushes   bool
+	AllowDeletions     bool
+}
+
+// RepositoryPolicy is the desired configuration of a repository, settings left
+// nil or empty are not managed
+type RepositoryPolicy struct {
+	DefaultBranch       string
+	AllowMergeCommit    *bool
+	AllowSquashMerge    *bool
+	AllowRebaseMerge    *bool
+	DeleteBranchOnMerge *bool
+	VulnerabilityAlerts *bool
+	// BranchProtection applies to the default branch
+	BranchProtection *BranchProtectionPolicy
+	// CodeOwners is the content of the CODEOWNERS file
+	CodeOwners string
+}
+
+// RepositoryPolicyDrift is a setting that differs from a RepositoryPolicy
+type RepositoryPolicyDrift struct {
+	Setting  string
+	Expected string
+	Actual   string
+}
+
+func (d RepositoryPolicyDrift) String() string {
+	return fmt.Sprintf("%s expected %s, found %s", d.Setting, d.Expected, d.Actual)
+}
+
+// GitOpsRepositoryPolicy is the policy kubefirst applies to the gitops
+// repository, pull requests need a review and main cannot be force pushed
+func GitOpsRepositoryPolicy(codeOwners string) RepositoryPolicy {
+	return RepositoryPolicy{
+		DefaultBranch:       "main",
+		AllowMergeCommit:    github.Bool(false),
+		AllowSquashMerge:    github.Bool(true),
+		AllowRebaseMerge:    github.Bool(false),
+		DeleteBranchOnMerge: github.Bool(true),
+		VulnerabilityAlerts: github.Bool(true),
+		BranchProtection: &BranchProtectionPolicy{
+			RequiredApprovingReviews: 1,
+			DismissStaleReviews:      true,
+			RequireCodeOwnerReviews:  codeOwners != "",
+		},
+		CodeOwners: codeOwners,
+	}
+}
+
+// ApplyRepositoryPolicy configures a repository to match a policy
+//
+// The CODEOWNERS file is committed before the default branch is protected so
+// the commit is not blocked by required reviews. Once the branch is protected
+// with EnforceAdmins the commit would be rejected, CODEOWNERS is then left
+// unchanged and a drift error is returned after the remaining settings are
+// applied - changes to it have to go through a pull request
+func (g GithubSession) ApplyRepositoryPolicy(owner string, repository string, policy RepositoryPolicy) error {
+	repo, _, err := g.gitClient.Repositories.Get(g.context, owner, repository)
+	if err != nil {
+		return fmt.Errorf("error getting repository %s/%s: %s", owner, repository, err)
+	}
+
+	edit := &github.Repository{
+		AllowMergeCommit:    policy.AllowMergeCommit,
+		AllowSquashMerge:    policy.AllowSquashMerge,
+		AllowRebaseMerge:    policy.AllowRebaseMerge,
+		DeleteBranchOnMerge: policy.DeleteBranchOnMerge,
+	}
+	if policy.DefaultBranch != "" {
+		edit.DefaultBranch = &policy.DefaultBranch
+	}
+	repo, _, err = g.gitClient.Repositories.Edit(g.context, owner, repository, edit)
+	if err != nil {
+		return fmt.Errorf("error updating settings of repository %s/%s: %s", owner, repository, err)
+	}
+	log.Info().Msgf("updated settings of repository %s/%s", owner, repository)
+	branch := repo.GetDefaultBranch()
+
+	var codeOwnersDrift *RepositoryPolicyDrift
+	if policy.CodeOwners != "" {
+		locked, err := g.branchEnforcesAdmins(owner, repository, branch)
+		if err != nil {
+			return err
+		}
+		codeOwnersDrift, err = g.writeCodeOwners(owner, repository, branch, policy.CodeOwners, locked)
+		if err != nil {
+			return err
+		}
+	}
+
+	if policy.VulnerabilityAlerts != nil {
+		if *policy.VulnerabilityAlerts {
+			_, err = g.gitClient.Repositories.EnableVulnerabilityAlerts(g.context, owner, repository)
+		} else {
+			_, err = g.gitClient.Repositories.DisableVulnerabilityAlerts(g.context, owner, repository)
+		}
+		if err != nil {
+			return fmt.Errorf("error setting vulnerability alerts of repository %s/%s: %s", owner, repository, err)
+		}
+	}
+
+	if policy.BranchProtection != nil {
+		_, _, err = g.gitClient.Repositories.UpdateBranchProtection(g.context, owner, repository, branch, protectionRequest(*policy.BranchProtection))
+		if err != nil {
+			return fmt.Errorf("error protecting branch %s of repository %s/%s: %s", branch, owner, repository, err)
+		}
+		log.Info().Msgf("protected branch %s of repository %s/%s", branch, owner, repository)
+	}
+
+	if codeOwnersDrift != nil {
+		return fmt.Errorf("error updating %s of repository %s/%s, branch %s enforces its protection for admins: %s", CodeOwnersPath, owner, repository, branch, codeOwnersDrift)
+	}
+
+	return nil
+}
+
+// GetRepositoryPolicy reads the current settings of a repository, the branch
+// protection of its default branch and its CODEOWNERS file
+//
+// BranchProtection is nil when the default branch is not protected
+func (g GithubSession) GetRepositoryPolicy(owner string, repository string) (*RepositoryPolicy, error) {
+	repo, _, err := g.gitClient.Repositories.Get(g.context, owner, repository)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository %s/%s: %s", owner, repository, err)
+	}
+
+	policy := &RepositoryPolicy{
+		DefaultBranch:       repo.GetDefaultBranch(),
+		AllowMergeCommit:    github.Bool(repo.GetAllowMergeCommit()),
+		AllowSquashMerge:    github.Bool(repo.GetAllowSquashMerge()),
+		AllowRebaseMerge:    github.Bool(repo.GetAllowRebaseMerge()),
+		DeleteBranchOnMerge: github.Bool(repo.GetDeleteBranchOnMerge()),
+	}
+
+	alerts, _, err := g.gitClient.Repositories.GetVulnerabilityAlerts(g.context, owner, repository)
+	if err != nil {
+		return nil, fmt.Errorf("error getting vulnerability alerts of repository %s/%s: %s", owner, repository, err)
+	}
+	policy.VulnerabilityAlerts = &alerts
+
+	protection, _, err := g.gitClient.Repositories.GetBranchProtection(g.context, owner, repository, policy.DefaultBranch)
+	if err != nil && !errors.Is(err, github.ErrBranchNotProtected) {
+		return nil, fmt.Errorf("error getting protection of branch %s of repository %s/%s: %s", policy.DefaultBranch, owner, repository, err)
+	}
+	if err == nil {
+		policy.BranchProtection = branchProtectionPolicy(protection)
+	}
+
+	content, _, resp, err := g.gitClient.Repositories.GetContents(g.context, owner, repository, CodeOwnersPath, &github.RepositoryContentGetOptions{Ref: policy.DefaultBranch})
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return nil, fmt.Errorf("error getting %s of repository %s/%s: %s", CodeOwnersPath, owner, repository, err)
+	}
+	if content != nil {
+		policy.CodeOwners, err = content.GetContent()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s of repository %s/%s: %s", CodeOwnersPath, owner, repository, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Compare returns the settings of actual that differ from the policy, settings
+// the policy does not manage are ignored
+func (p RepositoryPolicy) Compare(actual *RepositoryPolicy) []RepositoryPolicyDrift {
+	drift := make([]RepositoryPolicyDrift, 0)
+	add := func(setting string, expected interface{}, found interface{}) {
+		e, a := fmt.Sprintf("%v", expected), fmt.Sprintf("%v", found)
+		if e != a {
+			drift = append(drift, RepositoryPolicyDrift{Setting: setting, Expected: e, Actual: a})
+		}
+	}
+	addBool := func(setting string, expected *bool, found *bool) {
+		if expected != nil {
+			add(setting, *expected, found != nil && *found)
+		}
+	}
+
+	if p.DefaultBranch != "" {
+		add("default branch", p.DefaultBranch, actual.DefaultBranch)
+	}
+	addBool("allow merge commit", p.AllowMergeCommit, actual.AllowMergeCommit)
+	addBool("allow squash merge", p.AllowSquashMerge, actual.AllowSquashMerge)
+	addBool("allow rebase merge", p.AllowRebaseMerge, actual.AllowRebaseMerge)
+	addBool("delete branch on merge", p.DeleteBranchOnMerge, actual.DeleteBranchOnMerge)
+	addBool("vulnerability alerts", p.VulnerabilityAlerts, actual.VulnerabilityAlerts)
+	if p.CodeOwners != "" {
+		add("codeowners", strings.TrimSpace(p.CodeOwners), strings.TrimSpace(actual.CodeOwners))
+	}
+
+	if p.BranchProtection != nil {
+		if actual.BranchProtection == nil {
+			drift = append(drift, RepositoryPolicyDrift{Setting: "branch protection", Expected: "enabled", Actual: "disabled"})
+			return drift
+		}
+		expected, found := *p.BranchProtection, *actual.BranchProtection
+		add("required approving reviews", expected.RequiredApprovingReviews, found.RequiredApprovingReviews)
+		add("dismiss stale reviews", expected.DismissStaleReviews, found.DismissStaleReviews)
+		add("require code owner reviews", expected.RequireCodeOwnerReviews, found.RequireCodeOwnerReviews)
+		add("required status checks", sortedStrings(expected.RequiredStatusChecks), sortedStrings(found.RequiredStatusChecks))
+		add("strict status checks", expected.StrictStatusChecks, found.StrictStatusChecks)
+		add("enforce admins", expected.EnforceAdmins, found.EnforceAdmins)
+		add("allow force pushes", expected.AllowForcePushes, found.AllowForcePushes)
+		add("allow deletions", expected.AllowDeletions, found.AllowDeletions)
+	}
+
+	return drift
+}
+
+// branchEnforcesAdmins returns whether the protection of a branch also applies
+// to administrators, an unprotected branch does not
+func (g GithubSession) branchEnforcesAdmins(owner string, repository string, branch string) (bool, error) {
+	protection, _, err := g.gitClient.Repositories.GetBranchProtection(g.context, owner, repository, branch)
+	if errors.Is(err, github.ErrBranchNotProtected) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error getting protection of branch %s of repository %s/%s: %s", branch, owner, repository, err)
+	}
+
+	return protection.EnforceAdmins != nil && protection.EnforceAdmins.Enabled, nil
+}
+
+// writeCodeOwners creates or updates the CODEOWNERS file on a branch
+//
+// When locked the file is not committed and the drift is returned if it
+// differs from codeOwners
+func (g GithubSession) writeCodeOwners(owner string, repository string, branch string, codeOwners string, locked bool) (*RepositoryPolicyDrift, error) {
+	options := &github.RepositoryContentFileOptions{
+		Message: github.String("add CODEOWNERS"),
+		Content: []byte(codeOwners),
+		Branch:  &branch,
+	}
+
+	existing, _, resp, err := g.gitClient.Repositories.GetContents(g.context, owner, repository, CodeOwnersPath, &github.RepositoryContentGetOptions{Ref: branch})
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return nil, fmt.Errorf("error getting %s of repository %s/%s: %s", CodeOwnersPath, owner, repository, err)
+	}
+
+	current := ""
+	if existing != nil {
+		current, err = existing.GetContent()
+		if err == nil && current == codeOwners {
+			return nil, nil
+		}
+	}
+	if locked {
+		log.Warn().Msgf("not committing %s to protected branch %s of repository %s/%s", CodeOwnersPath, branch, owner, repository)
+		return &RepositoryPolicyDrift{Setting: "codeowners", Expected: strings.TrimSpace(codeOwners), Actual: strings.TrimSpace(current)}, nil
+	}
+
+	if existing == nil {
+		_, _, err = g.gitClient.Repositories.CreateFile(g.context, owner, repository, CodeOwnersPath, options)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s in repository %s/%s: %s", CodeOwnersPath, owner, repository, err)
+		}
+		log.Info().Msgf("created %s in repository %s/%s", CodeOwnersPath, owner, repository)
+		return nil, nil
+	}
+
+	options.Message = github.String("update CODEOWNERS")
+	options.SHA = existing.SHA
+	_, _, err = g.gitClient.Repositories.UpdateFile(g.context, owner, repository, CodeOwnersPath, options)
+	if err != nil {
+		return nil, fmt.Errorf("error updating %s in repository %s/%s: %s", CodeOwnersPath, owner, repository, err)
+	}
+	log.Info().Msgf("updated %s in repository %s/%s", CodeOwnersPath, owner, repository)
+
+	return nil, nil
+}
+
+// protectionRequest converts a branch protection policy to an API request
+func protectionRequest(policy BranchProtectionPolicy) *github.ProtectionRequest {
+	request := &github.ProtectionRequest{
+		EnforceAdmins:    policy.EnforceAdmins,
+		AllowForcePushes: github.Bool(policy.AllowForcePushes),
+		AllowDeletions:   github.Bool(policy.AllowDeletions),
+	}
+	if len(policy.RequiredStatusChecks) > 0 {
+		request.RequiredStatusChecks = &github.RequiredStatusChecks{
+			Strict:   policy.StrictStatusChecks,
+			Contexts: policy.RequiredStatusChecks,
+		}
+	}
+	if policy.RequiredApprovingReviews > 0 || policy.RequireCodeOwnerReviews {
+		request.RequiredPullRequestReviews = &github.PullRequestReviewsEnforcementRequest{
+			DismissStaleReviews:          policy.DismissStaleReviews,
+			RequireCodeOwnerReviews:      policy.RequireCodeOwnerReviews,
+			RequiredApprovingReviewCount: policy.RequiredApprovingReviews,
+		}
+	}
+
+	return request
+}
+
+// branchProtectionPolicy converts the protection of a branch to a policy
+func branchProtectionPolicy(protection *github.Protection) *BranchProtectionPolicy {
+	policy := &BranchProtectionPolicy{
+		EnforceAdmins:    protection.EnforceAdmins != nil && protection.EnforceAdmins.Enabled,
+		AllowForcePushes: protection.AllowForcePushes != nil && protection.AllowForcePushes.Enabled,
+		AllowDeletions:   protection.AllowDeletions != nil && protection.AllowDeletions.Enabled,
+	}
+	if checks := protection.RequiredStatusChecks; checks != nil {
+		policy.StrictStatusChecks = checks.Strict
+		policy.RequiredStatusChecks = checks.Contexts
+	}
+	if reviews := protection.RequiredPullRequestReviews; reviews != nil {
+		policy.RequiredApprovingReviews = reviews.RequiredApprovingReviewCount
+		policy.DismissStaleReviews = reviews.DismissStaleReviews
+		policy.RequireCodeOwnerReviews = reviews.RequireCodeOwnerReviews
+	}
+
+	return policy
+}
+
+func sortedStrings(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,319 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v45/github"
+)
+
+func TestRepositoryPolicyCompare(t *testing.T) {
+	policy := GitOpsRepositoryPolicy("* @kubefirst/admins\n")
+
+	inSync := func() *RepositoryPolicy {
+		return &RepositoryPolicy{
+			DefaultBranch:       "main",
+			AllowMergeCommit:    github.Bool(false),
+			AllowSquashMerge:    github.Bool(true),
+			AllowRebaseMerge:    github.Bool(false),
+			DeleteBranchOnMerge: github.Bool(true),
+			VulnerabilityAlerts: github.Bool(true),
+			BranchProtection: &BranchProtectionPolicy{
+				RequiredApprovingReviews: 1,
+				DismissStaleReviews:      true,
+				RequireCodeOwnerReviews:  true,
+			},
+			CodeOwners: "* @kubefirst/admins",
+		}
+	}
+
+	tests := []struct {
+		name     string
+		policy   RepositoryPolicy
+		actual   func() *RepositoryPolicy
+		expected []string
+	}{
+		{
+			name:     "in sync",
+			policy:   policy,
+			actual:   inSync,
+			expected: []string{},
+		},
+		{
+			name:   "settings",
+			policy: policy,
+			actual: func() *RepositoryPolicy {
+				actual := inSync()
+				actual.DefaultBranch = "master"
+				actual.AllowMergeCommit = github.Bool(true)
+				actual.VulnerabilityAlerts = nil
+				actual.CodeOwners = "* @kubefirst/developers\n"
+				return actual
+			},
+			expected: []string{
+				"default branch expected main, found master",
+				"allow merge commit expected false, found true",
+				"vulnerability alerts expected true, found false",
+				"codeowners expected * @kubefirst/admins, found * @kubefirst/developers",
+			},
+		},
+		{
+			name:   "branch protection",
+			policy: RepositoryPolicy{BranchProtection: &BranchProtectionPolicy{RequiredStatusChecks: []string{"lint", "build"}, StrictStatusChecks: true, EnforceAdmins: true}},
+			actual: func() *RepositoryPolicy {
+				actual := inSync()
+				actual.BranchProtection.RequiredStatusChecks = []string{"build"}
+				actual.BranchProtection.AllowForcePushes = true
+				return actual
+			},
+			expected: []string{
+				"required approving reviews expected 0, found 1",
+				"dismiss stale reviews expected false, found true",
+				"require code owner reviews expected false, found true",
+				"required status checks expected [build lint], found [build]",
+				"strict status checks expected true, found false",
+				"enforce admins expected true, found false",
+				"allow force pushes expected false, found true",
+			},
+		},
+		{
+			name:   "unprotected branch",
+			policy: policy,
+			actual: func() *RepositoryPolicy {
+				actual := inSync()
+				actual.BranchProtection = nil
+				return actual
+			},
+			expected: []string{"branch protection expected enabled, found disabled"},
+		},
+		{
+			name:   "unmanaged settings",
+			policy: RepositoryPolicy{},
+			actual: func() *RepositoryPolicy {
+				return &RepositoryPolicy{DefaultBranch: "master", AllowMergeCommit: github.Bool(true), CodeOwners: "* @someone"}
+			},
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drift := tt.policy.Compare(tt.actual())
+			found := make([]string, 0, len(drift))
+			for _, d := range drift {
+				found = append(found, d.String())
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(tt.expected, "\n"), strings.Join(found, "\n"))
+			}
+		})
+	}
+}
+
+func TestProtectionRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   BranchProtectionPolicy
+		expected *github.ProtectionRequest
+	}{
+		{
+			name:   "empty",
+			policy: BranchProtectionPolicy{},
+			expected: &github.ProtectionRequest{
+				AllowForcePushes: github.Bool(false),
+				AllowDeletions:   github.Bool(false),
+			},
+		},
+		{
+			name:   "reviews",
+			policy: BranchProtectionPolicy{RequiredApprovingReviews: 2, DismissStaleReviews: true, EnforceAdmins: true},
+			expected: &github.ProtectionRequest{
+				RequiredPullRequestReviews: &github.PullRequestReviewsEnforcementRequest{
+					DismissStaleReviews:          true,
+					RequiredApprovingReviewCount: 2,
+				},
+				EnforceAdmins:    true,
+				AllowForcePushes: github.Bool(false),
+				AllowDeletions:   github.Bool(false),
+			},
+		},
+		{
+			name:   "code owner reviews without approvals",
+			policy: BranchProtectionPolicy{RequireCodeOwnerReviews: true},
+			expected: &github.ProtectionRequest{
+				RequiredPullRequestReviews: &github.PullRequestReviewsEnforcementRequest{
+					RequireCodeOwnerReviews: true,
+				},
+				AllowForcePushes: github.Bool(false),
+				AllowDeletions:   github.Bool(false),
+			},
+		},
+		{
+			name:   "status checks",
+			policy: BranchProtectionPolicy{RequiredStatusChecks: []string{"build"}, StrictStatusChecks: true, AllowForcePushes: true, AllowDeletions: true},
+			expected: &github.ProtectionRequest{
+				RequiredStatusChecks: &github.RequiredStatusChecks{
+					Strict:   true,
+					Contexts: []string{"build"},
+				},
+				AllowForcePushes: github.Bool(true),
+				AllowDeletions:   github.Bool(true),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := protectionRequest(tt.policy)
+			if !reflect.DeepEqual(request, tt.expected) {
+				t.Errorf("expected %s, got %s", github.Stringify(tt.expected), github.Stringify(request))
+			}
+		})
+	}
+}
+
+func TestBranchProtectionPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		protection *github.Protection
+		expected   *BranchProtectionPolicy
+	}{
+		{
+			name:       "empty",
+			protection: &github.Protection{},
+			expected:   &BranchProtectionPolicy{},
+		},
+		{
+			name: "everything",
+			protection: &github.Protection{
+				RequiredStatusChecks: &github.RequiredStatusChecks{Strict: true, Contexts: []string{"build"}},
+				RequiredPullRequestReviews: &github.PullRequestReviewsEnforcement{
+					DismissStaleReviews:          true,
+					RequireCodeOwnerReviews:      true,
+					RequiredApprovingReviewCount: 1,
+				},
+				EnforceAdmins:    &github.AdminEnforcement{Enabled: true},
+				AllowForcePushes: &github.AllowForcePushes{Enabled: true},
+				AllowDeletions:   &github.AllowDeletions{Enabled: false},
+			},
+			expected: &BranchProtectionPolicy{
+				RequiredApprovingReviews: 1,
+				DismissStaleReviews:      true,
+				RequireCodeOwnerReviews:  true,
+				RequiredStatusChecks:     []string{"build"},
+				StrictStatusChecks:       true,
+				EnforceAdmins:            true,
+				AllowForcePushes:         true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := branchProtectionPolicy(tt.protection)
+			if !reflect.DeepEqual(policy, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, policy)
+			}
+		})
+	}
+
+	// a policy survives the round trip through the api types
+	policy := BranchProtectionPolicy{RequiredApprovingReviews: 1, RequireCodeOwnerReviews: true, RequiredStatusChecks: []string{"build"}, EnforceAdmins: true}
+	request := protectionRequest(policy)
+	protection := &github.Protection{
+		RequiredStatusChecks:       request.RequiredStatusChecks,
+		RequiredPullRequestReviews: &github.PullRequestReviewsEnforcement{RequireCodeOwnerReviews: true, RequiredApprovingReviewCount: 1},
+		EnforceAdmins:              &github.AdminEnforcement{Enabled: request.EnforceAdmins},
+	}
+	if found := branchProtectionPolicy(protection); !reflect.DeepEqual(*found, policy) {
+		t.Errorf("expected %+v, got %+v", policy, *found)
+	}
+}
+
+func TestApplyRepositoryPolicyCodeOwners(t *testing.T) {
+	tests := []struct {
+		name          string
+		enforceAdmins bool
+		protected     bool
+		codeOwners    string
+		wantCommit    bool
+		wantErr       bool
+	}{
+		{name: "unprotected branch", codeOwners: "* @kubefirst/developers\n", wantCommit: true},
+		{name: "protected branch", protected: true, codeOwners: "* @kubefirst/developers\n", wantCommit: true},
+		{name: "enforced for admins", protected: true, enforceAdmins: true, codeOwners: "* @kubefirst/developers\n", wantErr: true},
+		{name: "enforced for admins and in sync", protected: true, enforceAdmins: true, codeOwners: "* @kubefirst/admins\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			committed, protected := false, false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/repos/kubefirst/gitops" && (r.Method == http.MethodGet || r.Method == http.MethodPatch):
+					json.NewEncoder(w).Encode(map[string]interface{}{"name": "gitops", "default_branch": "main"})
+				case r.URL.Path == "/repos/kubefirst/gitops/branches/main/protection" && r.Method == http.MethodGet:
+					if !tt.protected {
+						w.WriteHeader(http.StatusNotFound)
+						json.NewEncoder(w).Encode(map[string]string{"message": "Branch not protected"})
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{"enforce_admins": map[string]interface{}{"enabled": tt.enforceAdmins}})
+				case r.URL.Path == "/repos/kubefirst/gitops/branches/main/protection" && r.Method == http.MethodPut:
+					protected = true
+					json.NewEncoder(w).Encode(map[string]interface{}{})
+				case r.URL.Path == "/repos/kubefirst/gitops/contents/.github/CODEOWNERS" && r.Method == http.MethodGet:
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"type":     "file",
+						"encoding": "base64",
+						"sha":      "abc",
+						"content":  base64.StdEncoding.EncodeToString([]byte("* @kubefirst/admins\n")),
+					})
+				case r.URL.Path == "/repos/kubefirst/gitops/contents/.github/CODEOWNERS" && r.Method == http.MethodPut:
+					committed = true
+					json.NewEncoder(w).Encode(map[string]interface{}{})
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			gitClient := github.NewClient(nil)
+			gitClient.BaseURL, _ = url.Parse(server.URL + "/")
+			session := GithubSession{context: context.Background(), gitClient: gitClient}
+
+			policy := RepositoryPolicy{
+				BranchProtection: &BranchProtectionPolicy{RequiredApprovingReviews: 1, EnforceAdmins: true},
+				CodeOwners:       tt.codeOwners,
+			}
+			err := session.ApplyRepositoryPolicy("kubefirst", "gitops", policy)
+			if tt.wantErr && err == nil {
+				t.Error("expected a drift error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+			if committed != tt.wantCommit {
+				t.Errorf("expected CODEOWNERS committed to be %t, got %t", tt.wantCommit, committed)
+			}
+			if !protected {
+				t.Error("expected the branch to be protected")
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/rs/zerolog/log"
+)
+
+// repository permissions a team can be granted, from least to most privileged
+var teamRepoPermissions = []string{"pull", "triage", "push", "maintain", "admin"}
+
+var teamSlugPattern = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// TeamSpec is the desired state of an organization team
+type TeamSpec struct {
+	Name        string
+	Description string
+	// Parent is the name of the parent team, the team is top level when empty
+	Parent      string
+	Maintainers []string
+	Members     []string
+	// Repositories maps repository names to the permission of the team, one of
+	// pull, triage, push, maintain or admin
+	Repositories map[string]string
+}
+
+// TeamDrift is a difference between a TeamSpec and the team on GitHub
+type TeamDrift struct {
+	Team string
+	// Kind is team, description, parent, member or repository
+	Kind     string
+	Subject  string
+	Expected string
+	Actual   string
+}
+
+func (d TeamDrift) String() string {
+	if d.Subject == "" {
+		return fmt.Sprintf("team %s: %s expected %q, found %q", d.Team, d.Kind, d.Expected, d.Actual)
+	}
+	return fmt.Sprintf("team %s: %s %s expected %q, found %q", d.Team, d.Kind, d.Subject, d.Expected, d.Actual)
+}
+
+// teamState is a team as it exists on GitHub
+type teamState struct {
+	team *github.Team
+	// roles maps usernames to maintainer or member
+	roles map[string]string
+	// repositories maps repository names to permissions
+	repositories map[string]string
+}
+
+// TeamSlug returns the slug GitHub derives from a team name
+func TeamSlug(name string) string {
+	return strings.Trim(teamSlugPattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// EnsureTeams creates or updates the teams of an organization, parents before
+// their children, then syncs their members and repository permissions
+//
+// Members and repositories that are not part of a spec are removed when prune
+// is set
+func (g GithubSession) EnsureTeams(org string, specs []TeamSpec, prune bool) error {
+	ordered, err := orderTeamSpecs(specs)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range ordered {
+		team, err := g.EnsureTeam(org, spec)
+		if err != nil {
+			return err
+		}
+		err = g.SyncTeamMembers(org, team.GetSlug(), spec.Maintainers, spec.Members, prune)
+		if err != nil {
+			return err
+		}
+		err = g.SetTeamRepoPermissions(org, team.GetSlug(), spec.Repositories, prune)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnsureTeam creates a team or updates its description and parent
+//
+// New teams are visible to the organization, the privacy of an existing team
+// is only changed when it is nested under a parent, which requires it
+func (g GithubSession) EnsureTeam(org string, spec TeamSpec) (*github.Team, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("a team name is required")
+	}
+
+	newTeam := github.NewTeam{
+		Name:        spec.Name,
+		Description: &spec.Description,
+	}
+	if spec.Parent != "" {
+		// nested teams must be visible to the organization
+		newTeam.Privacy = github.String("closed")
+		parent, _, err := g.gitClient.Teams.GetTeamBySlug(g.context, org, TeamSlug(spec.Parent))
+		if err != nil {
+			return nil, fmt.Errorf("error getting parent team %s of %s: %s", spec.Parent, spec.Name, err)
+		}
+		newTeam.ParentTeamID = parent.ID
+	}
+
+	existing, resp, err := g.gitClient.Teams.GetTeamBySlug(g.context, org, TeamSlug(spec.Name))
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return nil, fmt.Errorf("error getting team %s: %s", spec.Name, err)
+	}
+
+	if existing == nil {
+		newTeam.Privacy = github.String("closed")
+		team, _, err := g.gitClient.Teams.CreateTeam(g.context, org, newTeam)
+		if err != nil {
+			return nil, fmt.Errorf("error creating team %s: %s", spec.Name, err)
+		}
+		log.Info().Msgf("created team %s/%s", org, team.GetSlug())
+		return team, nil
+	}
+
+	if existing.GetDescription() == spec.Description && existing.GetParent().GetID() == newTeam.GetParentTeamID() {
+		return existing, nil
+	}
+	team, _, err := g.gitClient.Teams.EditTeamBySlug(g.context, org, existing.GetSlug(), newTeam, spec.Parent == "")
+	if err != nil {
+		return nil, fmt.Errorf("error updating team %s: %s", spec.Name, err)
+	}
+	log.Info().Msgf("updated team %s/%s", org, team.GetSlug())
+
+	return team, nil
+}
+
+// SyncTeamMembers adds the maintainers and members to a team and corrects their
+// role, users not listed are removed when prune is set
+func (g GithubSession) SyncTeamMembers(org string, teamSlug string, maintainers []string, members []string, prune bool) error {
+	current, err := g.teamRoles(org, teamSlug)
+	if err != nil {
+		return err
+	}
+
+	desired := desiredTeamRoles(maintainers, members)
+	for _, user := range sortedKeys(desired) {
+		role := desired[user]
+		if current[user] == role {
+			continue
+		}
+		_, _, err := g.gitClient.Teams.AddTeamMembershipBySlug(g.context, org, teamSlug, user, &github.TeamAddTeamMembershipOptions{Role: role})
+		if err != nil {
+			return fmt.Errorf("error adding %s to team %s as %s: %s", user, teamSlug, role, err)
+		}
+		log.Info().Msgf("added %s to team %s/%s as %s", user, org, teamSlug, role)
+	}
+
+	if !prune {
+		return nil
+	}
+	for _, user := range sortedKeys(current) {
+		if _, ok := desired[user]; ok {
+			continue
+		}
+		_, err := g.gitClient.Teams.RemoveTeamMembershipBySlug(g.context, org, teamSlug, user)
+		if err != nil {
+			return fmt.Errorf("error removing %s from team %s: %s", user, teamSlug, err)
+		}
+		log.Info().Msgf("removed %s from team %s/%s", user, org, teamSlug)
+	}
+
+	return nil
+}
+
+// SetTeamRepoPermissions grants a team permissions on organization
+// repositories, repositories not listed are removed from the team when prune
+// is set
+func (g GithubSession) SetTeamRepoPermissions(org string, teamSlug string, repositories map[string]string, prune bool) error {
+	current, err := g.teamRepositories(org, teamSlug)
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range sortedKeys(repositories) {
+		permission := repositories[repo]
+		if !validTeamRepoPermission(permission) {
+			return fmt.Errorf("invalid permission %q for repository %s, must be one of %s", permission, repo, strings.Join(teamRepoPermissions, ", "))
+		}
+		if current[repo] == permission {
+			continue
+		}
+		_, err := g.gitClient.Teams.AddTeamRepoBySlug(g.context, org, teamSlug, org, repo, &github.TeamAddTeamRepoOptions{Permission: permission})
+		if err != nil {
+			return fmt.Errorf("error granting team %s %s on %s: %s", teamSlug, permission, repo, err)
+		}
+		log.Info().Msgf("granted team %s/%s %s on %s", org, teamSlug, permission, repo)
+	}
+
+	if !prune {
+		return nil
+	}
+	for _, repo := range sortedKeys(current) {
+		if _, ok := repositories[repo]; ok {
+			continue
+		}
+		_, err := g.gitClient.Teams.RemoveTeamRepoBySlug(g.context, org, teamSlug, org, repo)
+		if err != nil {
+			return fmt.Errorf("error removing %s from team %s: %s", repo, teamSlug, err)
+		}
+		log.Info().Msgf("removed %s from team %s/%s", repo, org, teamSlug)
+	}
+
+	return nil
+}
+
+// TeamsDrift compares the teams of an organization to the specs without
+// changing anything
+func (g GithubSession) TeamsDrift(org string, specs []TeamSpec) ([]TeamDrift, error) {
+	drift := make([]TeamDrift, 0)
+	for _, spec := range specs {
+		state, err := g.readTeamState(org, TeamSlug(spec.Name))
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, compareTeam(spec, state)...)
+	}
+
+	return drift, nil
+}
+
+// readTeamState reads a team with its members and repositories, the returned
+// team is nil when it does not exist
+func (g GithubSession) readTeamState(org string, teamSlug string) (*teamState, error) {
+	team, resp, err := g.gitClient.Teams.GetTeamBySlug(g.context, org, teamSlug)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return &teamState{}, nil
+		}
+		return nil, fmt.Errorf("error getting team %s: %s", teamSlug, err)
+	}
+
+	roles, err := g.teamRoles(org, teamSlug)
+	if err != nil {
+		return nil, err
+	}
+	repositories, err := g.teamRepositories(org, teamSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &teamState{team: team, roles: roles, repositories: repositories}, nil
+}
+
+// teamRoles returns the lowercased usernames of a team mapped to their role
+func (g GithubSession) teamRoles(org string, teamSlug string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, role := range []string{"member", "maintainer"} {
+		for nextPage := 1; nextPage > 0; {
+			users, resp, err := g.gitClient.Teams.ListTeamMembersBySlug(g.context, org, teamSlug, &github.TeamListTeamMembersOptions{
+				Role:        role,
+				ListOptions: github.ListOptions{Page: nextPage, PerPage: 100},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error listing %ss of team %s: %s", role, teamSlug, err)
+			}
+			for _, user := range users {
+				roles[strings.ToLower(user.GetLogin())] = role
+			}
+			nextPage = resp.NextPage
+		}
+	}
+
+	return roles, nil
+}
+
+// teamRepositories returns the repositories of a team mapped to the highest
+// permission the team has on them
+func (g GithubSession) teamRepositories(org string, teamSlug string) (map[string]string, error) {
+	repositories := make(map[string]string)
+	for nextPage := 1; nextPage > 0; {
+		repos, resp, err := g.gitClient.Teams.ListTeamReposBySlug(g.context, org, teamSlug, &github.ListOptions{Page: nextPage, PerPage: 100})
+		if err != nil {
+			return nil, fmt.Errorf("error listing repositories of team %s: %s", teamSlug, err)
+		}
+		for _, repo := range repos {
+			permission := ""
+			for _, p := range teamRepoPermissions {
+				if repo.GetPermissions()[p] {
+					permission = p
+				}
+			}
+			repositories[repo.GetName()] = permission
+		}
+		nextPage = resp.NextPage
+	}
+
+	return repositories, nil
+}
+
+// compareTeam returns the differences between a spec and a team
+func compareTeam(spec TeamSpec, state *teamState) []TeamDrift {
+	if state.team == nil {
+		return []TeamDrift{{Team: spec.Name, Kind: "team", Expected: "present", Actual: "missing"}}
+	}
+
+	drift := make([]TeamDrift, 0)
+	if state.team.GetDescription() != spec.Description {
+		drift = append(drift, TeamDrift{Team: spec.Name, Kind: "description", Expected: spec.Description, Actual: state.team.GetDescription()})
+	}
+	if actualParent := state.team.GetParent().GetSlug(); actualParent != TeamSlug(spec.Parent) {
+		drift = append(drift, TeamDrift{Team: spec.Name, Kind: "parent", Expected: TeamSlug(spec.Parent), Actual: actualParent})
+	}
+
+	desired := desiredTeamRoles(spec.Maintainers, spec.Members)
+	for _, user := range sortedKeys(desired) {
+		if state.roles[user] != desired[user] {
+			drift = append(drift, TeamDrift{Team: spec.Name, Kind: "member", Subject: user, Expected: desired[user], Actual: state.roles[user]})
+		}
+	}
+	for _, user := range sortedKeys(state.roles) {
+		if _, ok := desired[user]; !ok {
+			drift = append(drift, TeamDrift{Team: spec.Name, Kind: "member", Subject: user, Expected: "", Actual: state.roles[user]})
+		}
+	}
+
+	for _, repo := range sortedKeys(spec.Repositories) {
+		if state.repositories[repo] != spec.Repositories[repo] {
+			drift = append(drift, TeamDrift{Team: spec.Name, Kind: "repository", Subject: repo, Expected: spec.Repositories[repo], Actual: state.repositories[repo]})
+		}
+	}
+	for _, repo := range sortedKeys(state.repositories) {
+		if _, ok := spec.Repositories[repo]; !ok {
+			drift = append(drift, TeamDrift{Team: spec.Name, Kind: "repository", Subject: repo, Expected: "", Actual: state.repositories[repo]})
+		}
+	}
+
+	return drift
+}
+
+// orderTeamSpecs orders specs so parents come before their children
+func orderTeamSpecs(specs []TeamSpec) ([]TeamSpec, error) {
+	byName := make(map[string]TeamSpec, len(specs))
+	for _, spec := range specs {
+		byName[TeamSlug(spec.Name)] = spec
+	}
+
+	ordered := make([]TeamSpec, 0, len(specs))
+	state := make(map[string]int) // 1 visiting, 2 done
+	var visit func(spec TeamSpec) error
+	visit = func(spec TeamSpec) error {
+		slug := TeamSlug(spec.Name)
+		switch state[slug] {
+		case 1:
+			return fmt.Errorf("team %s is its own ancestor", spec.Name)
+		case 2:
+			return nil
+		}
+		state[slug] = 1
+		if parent, ok := byName[TeamSlug(spec.Parent)]; ok && spec.Parent != "" {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		state[slug] = 2
+		ordered = append(ordered, spec)
+		return nil
+	}
+
+	for _, spec := range specs {
+		if err := visit(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// desiredTeamRoles maps lowercased usernames to their role, maintainer wins
+// when a user is listed twice
+func desiredTeamRoles(maintainers []string, members []string) map[string]string {
+	roles := make(map[string]string)
+	for _, user := range members {
+		roles[strings.ToLower(user)] = "member"
+	}
+	for _, user := range maintainers {
+		roles[strings.ToLower(user)] = "maintainer"
+	}
+
+	return roles
+}
+
+func validTeamRepoPermission(permission string) bool {
+	for _, p := range teamRepoPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
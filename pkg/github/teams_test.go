@@ -0,0 +1,229 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v45/github"
+)
+
+func TestTeamSlug(t *testing.T) {
+	tests := map[string]string{
+		"developers":           "developers",
+		"Platform Engineering": "platform-engineering",
+		"  SRE / On-Call  ":    "sre-on-call",
+		"team_a.b":             "team_a-b",
+		"":                     "",
+	}
+
+	for name, expected := range tests {
+		if slug := TeamSlug(name); slug != expected {
+			t.Errorf("TeamSlug(%q): expected %q, got %q", name, expected, slug)
+		}
+	}
+}
+
+func TestOrderTeamSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		specs    []TeamSpec
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "parents before children",
+			specs:    []TeamSpec{{Name: "Frontend", Parent: "Developers"}, {Name: "Developers", Parent: "Engineering"}, {Name: "Engineering"}},
+			expected: []string{"Engineering", "Developers", "Frontend"},
+		},
+		{
+			name:     "parent matched by slug",
+			specs:    []TeamSpec{{Name: "frontend", Parent: "Platform Engineering"}, {Name: "platform-engineering"}},
+			expected: []string{"platform-engineering", "frontend"},
+		},
+		{
+			name:     "parent that is not declared",
+			specs:    []TeamSpec{{Name: "frontend", Parent: "existing"}, {Name: "admins"}},
+			expected: []string{"frontend", "admins"},
+		},
+		{
+			name:  "cycle",
+			specs: []TeamSpec{{Name: "a", Parent: "c"}, {Name: "b", Parent: "a"}, {Name: "c", Parent: "b"}},
+			err:   true,
+		},
+		{
+			name:  "own parent",
+			specs: []TeamSpec{{Name: "a", Parent: "A"}},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered, err := orderTeamSpecs(tt.specs)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, got %v", ordered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(ordered))
+			for _, spec := range ordered {
+				names = append(names, spec.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestDesiredTeamRoles(t *testing.T) {
+	roles := desiredTeamRoles([]string{"Alice", "bob"}, []string{"bob", "Carol"})
+	expected := map[string]string{"alice": "maintainer", "bob": "maintainer", "carol": "member"}
+	if !reflect.DeepEqual(roles, expected) {
+		t.Errorf("expected %v, got %v", expected, roles)
+	}
+}
+
+func TestCompareTeam(t *testing.T) {
+	spec := TeamSpec{
+		Name:         "Developers",
+		Description:  "kubefirst developers",
+		Parent:       "Engineering",
+		Maintainers:  []string{"Alice"},
+		Members:      []string{"bob"},
+		Repositories: map[string]string{"gitops": "push", "metaphor": "pull"},
+	}
+
+	tests := []struct {
+		name     string
+		state    *teamState
+		expected []string
+	}{
+		{
+			name:     "missing team",
+			state:    &teamState{},
+			expected: []string{`team Developers: team expected "present", found "missing"`},
+		},
+		{
+			name: "in sync",
+			state: &teamState{
+				team: &github.Team{
+					Description: github.String("kubefirst developers"),
+					Parent:      &github.Team{Slug: github.String("engineering")},
+				},
+				roles:        map[string]string{"alice": "maintainer", "bob": "member"},
+				repositories: map[string]string{"gitops": "push", "metaphor": "pull"},
+			},
+			expected: []string{},
+		},
+		{
+			name: "drift",
+			state: &teamState{
+				team: &github.Team{Description: github.String("old")},
+				roles: map[string]string{
+					"alice": "member",
+					"eve":   "member",
+				},
+				repositories: map[string]string{"gitops": "admin", "legacy": "pull"},
+			},
+			expected: []string{
+				`team Developers: description expected "kubefirst developers", found "old"`,
+				`team Developers: parent expected "engineering", found ""`,
+				`team Developers: member alice expected "maintainer", found "member"`,
+				`team Developers: member bob expected "member", found ""`,
+				`team Developers: member eve expected "", found "member"`,
+				`team Developers: repository gitops expected "push", found "admin"`,
+				`team Developers: repository metaphor expected "pull", found ""`,
+				`team Developers: repository legacy expected "", found "pull"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drift := compareTeam(spec, tt.state)
+			found := make([]string, 0, len(drift))
+			for _, d := range drift {
+				found = append(found, d.String())
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(tt.expected, "\n"), strings.Join(found, "\n"))
+			}
+		})
+	}
+}
+
+func TestEnsureTeamPrivacy(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    bool
+		spec        TeamSpec
+		wantMethod  string
+		wantPrivacy interface{}
+	}{
+		{name: "new team", spec: TeamSpec{Name: "developers", Description: "developers"}, wantMethod: http.MethodPost, wantPrivacy: "closed"},
+		{name: "existing secret team", existing: true, spec: TeamSpec{Name: "developers", Description: "updated"}, wantMethod: http.MethodPatch},
+		{name: "existing secret team nested under a parent", existing: true, spec: TeamSpec{Name: "developers", Description: "updated", Parent: "engineering"}, wantMethod: http.MethodPatch, wantPrivacy: "closed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method string
+			var request map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/orgs/kubefirst/teams/engineering":
+					json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "slug": "engineering", "privacy": "closed"})
+				case r.Method == http.MethodGet && r.URL.Path == "/orgs/kubefirst/teams/developers":
+					if !tt.existing {
+						w.WriteHeader(http.StatusNotFound)
+						w.Write([]byte(`{"message":"Not Found"}`))
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "slug": "developers", "description": "developers", "privacy": "secret"})
+				case r.Method == http.MethodPost && r.URL.Path == "/orgs/kubefirst/teams",
+					r.Method == http.MethodPatch && r.URL.Path == "/orgs/kubefirst/teams/developers":
+					method = r.Method
+					json.NewDecoder(r.Body).Decode(&request)
+					json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "slug": "developers"})
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			gitClient := github.NewClient(nil)
+			gitClient.BaseURL, _ = url.Parse(server.URL + "/")
+			session := GithubSession{context: context.Background(), gitClient: gitClient}
+
+			_, err := session.EnsureTeam("kubefirst", tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != tt.wantMethod {
+				t.Errorf("expected a %s request, got %q", tt.wantMethod, method)
+			}
+			if request["privacy"] != tt.wantPrivacy {
+				t.Errorf("expected privacy %v, got %v", tt.wantPrivacy, request["privacy"])
+			}
+		})
+	}
+}
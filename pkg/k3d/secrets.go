@@ -51,20 +51,10 @@ func AddK3DSecrets(
 		fmt.Sprintf("%s-runner", gitProvider),
 	}
 
-	for i, s := range newNamespaces {
-		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: s}}
-		_, err := clientset.CoreV1().Namespaces().Get(context.TODO(), s, metav1.GetOptions{})
-		if err != nil {
-			_, err = clientset.CoreV1().Namespaces().Create(context.TODO(), namespace, metav1.CreateOptions{})
-			if err != nil {
-				log.Error().Err(err).Msg("")
-				return fmt.Errorf("error creating namespace")
-			}
-			log.Info().Msgf("%d, %s", i, s)
-			log.Info().Msgf("namespace created: %s", s)
-		} else {
-			log.Warn().Msgf("namespace %s already exists - skipping", s)
-		}
+	_, err = k8s.EnsureNamespaces(context.TODO(), clientset, k8s.NamespaceSpecs(newNamespaces...))
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return fmt.Errorf("error creating namespace")
 	}
 
 	// Create secrets
@@ -104,16 +94,10 @@ func AddK3DSecrets(
 		},
 	}
 	for _, secret := range createSecrets {
-		_, err := clientset.CoreV1().Secrets(secret.ObjectMeta.Namespace).Get(context.TODO(), secret.ObjectMeta.Name, metav1.GetOptions{})
-		if err == nil {
-			log.Info().Msgf("kubernetes secret %s/%s already created - skipping", secret.Namespace, secret.Name)
-		} else if strings.Contains(err.Error(), "not found") {
-			_, err = clientset.CoreV1().Secrets(secret.ObjectMeta.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
-			if err != nil {
-				log.Error().Msgf("error creating kubernetes secret %s/%s: %s", secret.Namespace, secret.Name, err)
-				return err
-			}
-			log.Info().Msgf("created kubernetes secret: %s/%s", secret.Namespace, secret.Name)
+		_, err := k8s.EnsureSecret(context.TODO(), clientset, secret)
+		if err != nil {
+			log.Error().Msgf("error creating kubernetes secret %s/%s: %s", secret.Namespace, secret.Name, err)
+			return err
 		}
 	}
 
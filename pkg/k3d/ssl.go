@@ -10,12 +10,10 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/kubefirst/runtime/pkg"
+	"github.com/kubefirst/runtime/pkg/k8s"
 	"github.com/rs/zerolog/log"
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -29,21 +27,18 @@ func GenerateTLSSecrets(clientset *kubernetes.Clientset, config K3dConfig) error
 		}
 	}
 
-	for i, app := range pkg.GetCertificateAppList() {
-		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: app.Namespace}}
-		_, err := clientset.CoreV1().Namespaces().Get(context.TODO(), app.Namespace, metav1.GetOptions{})
-		if err != nil {
-			_, err = clientset.CoreV1().Namespaces().Create(context.TODO(), namespace, metav1.CreateOptions{})
-			if err != nil {
-				log.Error().Err(err).Msg("")
-				return fmt.Errorf("error creating namespace")
-			}
-			log.Info().Msgf("%d, %s", i, app.Namespace)
-			log.Info().Msgf("namespace created: %s", app.Namespace)
-		} else {
-			log.Warn().Msgf("namespace %s already exists - skipping", app.Namespace)
-		}
+	certificateApps := pkg.GetCertificateAppList()
+	namespaces := make([]string, 0, len(certificateApps))
+	for _, app := range certificateApps {
+		namespaces = append(namespaces, app.Namespace)
+	}
+	_, err := k8s.EnsureNamespaces(context.TODO(), clientset, k8s.NamespaceSpecs(namespaces...))
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return fmt.Errorf("error creating namespace")
+	}
 
+	for _, app := range certificateApps {
 		//* generate certificate
 		fullAppAddress := app.AppName + "." + DomainName                      // example: app-name.kubefirst.dev
 		certFileName := config.MkCertPemDir + "/" + app.AppName + "-cert.pem" // example: app-name-cert.pem
@@ -74,26 +69,11 @@ func GenerateTLSSecrets(clientset *kubernetes.Clientset, config K3dConfig) error
 			return fmt.Errorf("error reading %s file %s", fmt.Sprintf("%s/ssl/%s/pem/%s-key.pem", config.K1Dir, DomainName, app.AppName), err)
 		}
 
-		_, err = clientset.CoreV1().Secrets(app.Namespace).Get(context.TODO(), app.AppName, metav1.GetOptions{})
-		if err == nil {
-			log.Info().Msgf("kubernetes secret %s/%s already created - skipping", app.Namespace, app.AppName)
-		} else if strings.Contains(err.Error(), "not found") {
-			_, err = clientset.CoreV1().Secrets(app.Namespace).Create(context.TODO(), &v1.Secret{
-				Type: "kubernetes.io/tls",
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      fmt.Sprintf("%s-tls", app.AppName),
-					Namespace: app.Namespace,
-				},
-				Data: map[string][]byte{
-					"tls.crt": []byte(certPem),
-					"tls.key": []byte(keyPem),
-				},
-			}, metav1.CreateOptions{})
-			if err != nil {
-				log.Error().Msgf("error creating kubernetes secret %s/%s: %s", app.Namespace, app.AppName, err)
-				return err
-			}
-			log.Info().Msgf("created kubernetes secret: %s/%s", app.Namespace, app.AppName)
+		tlsSecret := k8s.NewTLSSecret(app.Namespace, fmt.Sprintf("%s-tls", app.AppName), certPem, keyPem)
+		_, err = k8s.EnsureSecret(context.TODO(), clientset, tlsSecret)
+		if err != nil {
+			log.Error().Msgf("error creating kubernetes secret %s/%s: %s", tlsSecret.Namespace, tlsSecret.Name, err)
+			return err
 		}
 	}
 	return nil
@@ -106,17 +86,10 @@ func GenerateSingleTLSSecret(
 	app string,
 	ns string,
 ) error {
-	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: app}}
-	_, err := clientset.CoreV1().Namespaces().Get(context.TODO(), ns, metav1.GetOptions{})
+	_, err := k8s.EnsureNamespaces(context.TODO(), clientset, k8s.NamespaceSpecs(ns))
 	if err != nil {
-		_, err = clientset.CoreV1().Namespaces().Create(context.TODO(), namespace, metav1.CreateOptions{})
-		if err != nil {
-			log.Error().Err(err).Msg("")
-			return fmt.Errorf("error creating namespace")
-		}
-		log.Info().Msgf("namespace created: %s", ns)
-	} else {
-		log.Warn().Msgf("namespace %s already exists - skipping", ns)
+		log.Error().Err(err).Msg("")
+		return fmt.Errorf("error creating namespace")
 	}
 
 	//* generate certificate
@@ -149,26 +122,11 @@ func GenerateSingleTLSSecret(
 		return fmt.Errorf("error reading %s file %s", fmt.Sprintf("%s/ssl/%s/pem/%s-key.pem", config.K1Dir, DomainName, app), err)
 	}
 
-	_, err = clientset.CoreV1().Secrets(ns).Get(context.TODO(), app, metav1.GetOptions{})
-	if err == nil {
-		log.Info().Msgf("kubernetes secret %s/%s already created - skipping", ns, app)
-	} else if strings.Contains(err.Error(), "not found") {
-		_, err = clientset.CoreV1().Secrets(ns).Create(context.TODO(), &v1.Secret{
-			Type: "kubernetes.io/tls",
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-tls", app),
-				Namespace: ns,
-			},
-			Data: map[string][]byte{
-				"tls.crt": []byte(certPem),
-				"tls.key": []byte(keyPem),
-			},
-		}, metav1.CreateOptions{})
-		if err != nil {
-			log.Error().Msgf("error creating kubernetes secret %s/%s: %s", ns, app, err)
-			return err
-		}
-		log.Info().Msgf("created kubernetes secret: %s/%s", ns, app)
+	tlsSecret := k8s.NewTLSSecret(ns, fmt.Sprintf("%s-tls", app), certPem, keyPem)
+	_, err = k8s.EnsureSecret(context.TODO(), clientset, tlsSecret)
+	if err != nil {
+		log.Error().Msgf("error creating kubernetes secret %s/%s: %s", tlsSecret.Namespace, tlsSecret.Name, err)
+		return err
 	}
 
 	return nil
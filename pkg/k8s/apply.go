@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	goyaml "github.com/go-yaml/yaml"
 	"github.com/rs/zerolog/log"
@@ -95,6 +96,93 @@ func (kcl KubernetesClient) ApplyObjects(namespace string, yamlData [][]byte) er
 	return nil
 }
 
+// ApplyManifests applies every object in yamlData to a target Kubernetes cluster
+// with server-side apply, taking ownership of conflicting fields
+//
+// CustomResourceDefinitions and Namespaces are applied before other objects and
+// the REST mapping cache is reset afterwards so custom resources defined in the
+// same manifests can be resolved. Namespaced objects without a namespace are
+// applied in defaultNamespace
+func (kcl KubernetesClient) ApplyManifests(ctx context.Context, yamlData [][]byte, defaultNamespace string) error {
+	dc, err := discovery.NewDiscoveryClientForConfig(kcl.RestConfig)
+	if err != nil {
+		return err
+	}
+	cachedDiscovery := memory.NewMemCacheClient(dc)
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscovery)
+
+	dyn, err := dynamic.NewForConfig(kcl.RestConfig)
+	if err != nil {
+		return err
+	}
+
+	prerequisites := make([]*unstructured.Unstructured, 0)
+	objects := make([]*unstructured.Unstructured, 0)
+	for _, resource := range yamlData {
+		if len(bytes.TrimSpace(resource)) == 0 || string(bytes.TrimSpace(resource)) == "null" {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		_, _, err := decUnstructured.Decode(resource, nil, obj)
+		if err != nil {
+			return fmt.Errorf("error decoding manifest: %s", err)
+		}
+		switch obj.GetKind() {
+		case "CustomResourceDefinition", "Namespace":
+			prerequisites = append(prerequisites, obj)
+		default:
+			objects = append(objects, obj)
+		}
+	}
+
+	for _, batch := range [][]*unstructured.Unstructured{prerequisites, objects} {
+		for _, obj := range batch {
+			gvk := obj.GroupVersionKind()
+			mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+			// a CustomResourceDefinition takes a moment to be established
+			for i := 0; i < 15 && meta.IsNoMatchError(err); i++ {
+				time.Sleep(2 * time.Second)
+				mapper.Reset()
+				mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+			}
+			if err != nil {
+				return fmt.Errorf("error finding resource for %s %s: %s", gvk.Kind, obj.GetName(), err)
+			}
+
+			var dr dynamic.ResourceInterface
+			if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+				if obj.GetNamespace() == "" {
+					obj.SetNamespace(defaultNamespace)
+				}
+				dr = dyn.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+			} else {
+				dr = dyn.Resource(mapping.Resource)
+			}
+
+			data, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+
+			force := true
+			_, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+				FieldManager: FieldManager,
+				Force:        &force,
+			})
+			if err != nil {
+				return fmt.Errorf("error applying %s %s: %s", gvk.Kind, obj.GetName(), err)
+			}
+			log.Info().Msgf("applied %s %s", gvk.Kind, obj.GetName())
+		}
+
+		// pick up the resources of any CustomResourceDefinitions just applied
+		cachedDiscovery.Invalidate()
+		mapper.Reset()
+	}
+
+	return nil
+}
+
 // KustomizeBuild parses a file path and returns manifests built via
 // kustomization.yaml if present
 //
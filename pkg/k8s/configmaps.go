@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigMapEventHandler is called for every change to a watched ConfigMap
+type ConfigMapEventHandler func(eventType watch.EventType, configMap *v1.ConfigMap)
+
+// EnsureConfigMap creates the ConfigMap or updates it to match the provided
+// object using server-side apply
+//
+// Only the keys set on configMap are managed, keys added to the ConfigMap by
+// other field managers are left in place
+func EnsureConfigMap(ctx context.Context, clientset kubernetes.Interface, configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	applyConfig := corev1ac.ConfigMap(configMap.Name, configMap.Namespace).
+		WithLabels(configMap.Labels).
+		WithAnnotations(configMap.Annotations).
+		WithData(configMap.Data).
+		WithBinaryData(configMap.BinaryData)
+	if configMap.Immutable != nil {
+		applyConfig = applyConfig.WithImmutable(*configMap.Immutable)
+	}
+
+	applied, err := clientset.CoreV1().ConfigMaps(configMap.Namespace).Apply(ctx, applyConfig, metav1.ApplyOptions{
+		FieldManager: FieldManager,
+		Force:        true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error applying configmap %s/%s: %s", configMap.Namespace, configMap.Name, err)
+	}
+	log.Info().Msgf("applied configmap %s/%s", configMap.Namespace, configMap.Name)
+
+	return applied, nil
+}
+
+// GetConfigMap returns a ConfigMap, the returned error can be checked with
+// errors.IsNotFound
+func GetConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (*v1.ConfigMap, error) {
+	return clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// PatchConfigMap merges data into an existing ConfigMap - keys set to a nil value
+// are removed from the ConfigMap
+func PatchConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, data map[string]*string) (*v1.ConfigMap, error) {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := clientset.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error patching configmap %s/%s: %s", namespace, name, err)
+	}
+	log.Info().Msgf("patched configmap %s/%s", namespace, name)
+
+	return patched, nil
+}
+
+// DeleteConfigMap deletes a ConfigMap, a ConfigMap that does not exist is not an
+// error
+func DeleteConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) error {
+	err := clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info().Msgf("configmap %s/%s does not exist - skipping", namespace, name)
+			return nil
+		}
+		return fmt.Errorf("error deleting configmap %s/%s: %s", namespace, name, err)
+	}
+	log.Info().Msgf("deleted configmap %s/%s", namespace, name)
+
+	return nil
+}
+
+// WatchConfigMap calls handler for every change to a ConfigMap until the context
+// is cancelled or the API server closes the watch
+func WatchConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, handler ConfigMapEventHandler) error {
+	objWatch, err := clientset.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", name),
+	})
+	if err != nil {
+		return fmt.Errorf("error watching configmap %s/%s: %s", namespace, name, err)
+	}
+	defer objWatch.Stop()
+
+	objChan := objWatch.ResultChan()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-objChan:
+			if !ok {
+				return nil
+			}
+			if event.Type == watch.Error {
+				return fmt.Errorf("error watching configmap %s/%s: %v", namespace, name, errors.FromObject(event.Object))
+			}
+			configMap, ok := event.Object.(*v1.ConfigMap)
+			if !ok {
+				continue
+			}
+			handler(event.Type, configMap)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/kubefirst/runtime/pkg/progressPrinter"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// eventWatcherRetryInterval is how long to wait before re-establishing a watch
+// that was closed by the API server or failed to start
+const eventWatcherRetryInterval = 5 * time.Second
+
+// DefaultEventWatcherNamespaces are the namespaces whose warnings are most
+// relevant while a platform is being installed
+var DefaultEventWatcherNamespaces = []string{
+	pkg.ArgoCDNamespace,
+	pkg.VaultNamespace,
+	pkg.MinioNamespace,
+	pkg.AtlantisNamespace,
+	pkg.ArgoNamespace,
+	pkg.ChartmuseumNamespace,
+	"cert-manager",
+	"external-dns",
+	"external-secrets-operator",
+	"ingress-nginx",
+}
+
+// WarningEventHandler is called once for every unique Warning event observed
+type WarningEventHandler func(event *v1.Event)
+
+// EventWatcher watches Warning events in a set of namespaces and delivers each
+// unique warning to a handler
+type EventWatcher struct {
+	clientset  kubernetes.Interface
+	namespaces []string
+	handler    WarningEventHandler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// StartEventWatcher begins watching Warning events in the provided namespaces in
+// the background - call Stop on the returned EventWatcher once the operation
+// being observed has finished
+//
+// Example:
+//
+//	watcher := k8s.StartEventWatcher(ctx, clientset, k8s.DefaultEventWatcherNamespaces, k8s.ProgressPrinterEventHandler)
+//	defer watcher.Stop()
+//	_, err = k8s.WaitForStatefulSetReady(clientset, vaultStatefulSet, 120, true)
+func StartEventWatcher(ctx context.Context, clientset kubernetes.Interface, namespaces []string, handler WarningEventHandler) *EventWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+
+	watcher := &EventWatcher{
+		clientset:  clientset,
+		namespaces: namespaces,
+		handler:    handler,
+		cancel:     cancel,
+		seen:       make(map[string]struct{}),
+	}
+
+	for _, namespace := range namespaces {
+		watcher.wg.Add(1)
+		go func(namespace string) {
+			defer watcher.wg.Done()
+			watcher.watchNamespace(ctx, namespace)
+		}(namespace)
+	}
+
+	return watcher
+}
+
+// Stop ends all watches and waits for them to return
+func (w *EventWatcher) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// watchNamespace watches Warning events in a single namespace until the context
+// is cancelled, re-establishing the watch whenever it closes
+func (w *EventWatcher) watchNamespace(ctx context.Context, namespace string) {
+	listOptions := metav1.ListOptions{FieldSelector: "type=" + v1.EventTypeWarning}
+
+	// Warnings that happened before the watcher started are not reported, only
+	// what happens during the operation being observed
+	resourceVersion := ""
+	for resourceVersion == "" {
+		events, err := w.clientset.CoreV1().Events(namespace).List(ctx, listOptions)
+		if err == nil {
+			resourceVersion = events.ResourceVersion
+			for i := range events.Items {
+				w.markSeen(&events.Items[i])
+			}
+			break
+		}
+		log.Debug().Msgf("unable to list events in namespace %s, retrying: %s", namespace, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventWatcherRetryInterval):
+		}
+	}
+
+	for {
+		listOptions.ResourceVersion = resourceVersion
+		objWatch, err := w.clientset.CoreV1().Events(namespace).Watch(ctx, listOptions)
+		if err != nil {
+			log.Debug().Msgf("unable to watch events in namespace %s, retrying: %s", namespace, err)
+		} else {
+			resourceVersion = w.consume(ctx, objWatch, resourceVersion)
+			objWatch.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventWatcherRetryInterval):
+		}
+	}
+}
+
+// consume reads events from a watch until it closes or the context is cancelled
+// and returns the last resource version seen so the watch can be resumed
+func (w *EventWatcher) consume(ctx context.Context, objWatch watch.Interface, resourceVersion string) string {
+	objChan := objWatch.ResultChan()
+	for {
+		select {
+		case <-ctx.Done():
+			return resourceVersion
+		case event, ok := <-objChan:
+			if !ok {
+				return resourceVersion
+			}
+			switch event.Type {
+			case watch.Error:
+				// A 410 Gone means the resource version is too old, start over
+				// from the current state of the namespace
+				if status, ok := event.Object.(*metav1.Status); ok && status.Code == 410 {
+					return ""
+				}
+				log.Debug().Msgf("event watch error: %v", errors.FromObject(event.Object))
+				return resourceVersion
+			case watch.Added, watch.Modified:
+				obj, ok := event.Object.(*v1.Event)
+				if !ok {
+					continue
+				}
+				resourceVersion = obj.ResourceVersion
+				if w.markSeen(obj) {
+					w.handler(obj)
+				}
+			}
+		}
+	}
+}
+
+// markSeen records an event and returns true if an equivalent warning has not
+// been reported before
+//
+// Kubernetes creates a new Event or bumps the count of an existing one each
+// time a warning repeats, so warnings are keyed on the object, reason and
+// message rather than the Event name
+func (w *EventWatcher) markSeen(event *v1.Event) bool {
+	key := strings.Join([]string{
+		event.InvolvedObject.Namespace,
+		event.InvolvedObject.Kind,
+		event.InvolvedObject.Name,
+		event.Reason,
+		event.Message,
+	}, "/")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.seen[key]; ok {
+		return false
+	}
+	w.seen[key] = struct{}{}
+
+	return true
+}
+
+// FormatWarningEvent returns a single line, human readable description of an event
+func FormatWarningEvent(event *v1.Event) string {
+	return fmt.Sprintf(
+		"%s/%s/%s: %s - %s",
+		event.InvolvedObject.Namespace,
+		strings.ToLower(event.InvolvedObject.Kind),
+		event.InvolvedObject.Name,
+		event.Reason,
+		strings.TrimSpace(event.Message),
+	)
+}
+
+// LogWarningEventHandler writes warnings to the log
+func LogWarningEventHandler(event *v1.Event) {
+	log.Warn().Msg(FormatWarningEvent(event))
+}
+
+// ProgressPrinterEventHandler writes warnings near the active progress tracker -
+// progressPrinter.GetInstance and progressPrinter.SetupProgress must have been
+// called beforehand
+func ProgressPrinterEventHandler(event *v1.Event) {
+	progressPrinter.LogMessage(fmt.Sprintf("- warning: %s", FormatWarningEvent(event)))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testWarningEvent(name string, pod string, reason string, message string) *v1.Event {
+	return &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "vault", ResourceVersion: name},
+		InvolvedObject: v1.ObjectReference{Namespace: "vault", Kind: "Pod", Name: pod},
+		Type:           v1.EventTypeWarning,
+		Reason:         reason,
+		Message:        message,
+	}
+}
+
+func TestEventWatcherMarkSeen(t *testing.T) {
+	watcher := &EventWatcher{seen: make(map[string]struct{})}
+
+	tests := []struct {
+		name  string
+		event *v1.Event
+		want  bool
+	}{
+		{name: "first warning", event: testWarningEvent("vault-0.1", "vault-0", "BackOff", "Back-off restarting failed container"), want: true},
+		{name: "same warning with a new event name", event: testWarningEvent("vault-0.2", "vault-0", "BackOff", "Back-off restarting failed container"), want: false},
+		{name: "different message", event: testWarningEvent("vault-0.3", "vault-0", "BackOff", "Back-off pulling image"), want: true},
+		{name: "different reason", event: testWarningEvent("vault-0.4", "vault-0", "Unhealthy", "Back-off pulling image"), want: true},
+		{name: "different object", event: testWarningEvent("vault-1.1", "vault-1", "BackOff", "Back-off restarting failed container"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := watcher.markSeen(tt.event); got != tt.want {
+				t.Errorf("wanted markSeen %t, got %t", tt.want, got)
+			}
+		})
+	}
+
+	kind := testWarningEvent("vault-0.5", "vault-0", "BackOff", "Back-off restarting failed container")
+	kind.InvolvedObject.Kind = "StatefulSet"
+	if !watcher.markSeen(kind) {
+		t.Error("wanted a warning for another kind of object to be reported")
+	}
+}
+
+func TestEventWatcherReportsUniqueWarnings(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testWarningEvent("old", "vault-0", "FailedMount", "volume not ready"))
+	fakeWatch := watch.NewFake()
+	clientset.PrependWatchReactor("events", k8stesting.DefaultWatchReactor(fakeWatch, nil))
+
+	reported := make(chan string, 10)
+	watcher := StartEventWatcher(context.Background(), clientset, []string{"vault"}, func(event *v1.Event) {
+		reported <- FormatWarningEvent(event)
+	})
+
+	// warnings from before the watcher started are only marked as seen
+	fakeWatch.Add(testWarningEvent("old-again", "vault-0", "FailedMount", "volume not ready"))
+	fakeWatch.Add(testWarningEvent("new", "vault-0", "BackOff", "Back-off restarting failed container"))
+	fakeWatch.Modify(testWarningEvent("new", "vault-0", "BackOff", "Back-off restarting failed container"))
+	fakeWatch.Add(testWarningEvent("other", "vault-1", "BackOff", "Back-off restarting failed container"))
+	// the last event is only consumed once the previous ones were handled
+	fakeWatch.Add(testWarningEvent("other", "vault-1", "BackOff", "Back-off restarting failed container"))
+	watcher.Stop()
+	close(reported)
+
+	got := make([]string, 0)
+	for line := range reported {
+		got = append(got, line)
+	}
+	want := []string{
+		"vault/pod/vault-0: BackOff - Back-off restarting failed container",
+		"vault/pod/vault-1: BackOff - Back-off restarting failed container",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wanted %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("wanted %s, got %s", want[i], got[i])
+		}
+	}
+}
+
+func TestEventWatcherStopsWhenCancelled(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := StartEventWatcher(ctx, clientset, []string{"vault", "argocd"}, func(event *v1.Event) {})
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		watcher.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wanted the watcher to stop once its context is cancelled")
+	}
+}
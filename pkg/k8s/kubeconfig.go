@@ -0,0 +1,327 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// kubeconfigValidationTimeout bounds how long ValidateKubeconfigContext waits on
+// the API server
+const kubeconfigValidationTimeout = 15 * time.Second
+
+// KubefirstContextName returns the name used for the cluster, user and context
+// entries of a kubefirst cluster in a merged kubeconfig
+func KubefirstContextName(cloudProvider string, clusterName string) string {
+	if cloudProvider == "" {
+		return fmt.Sprintf("kubefirst-%s", clusterName)
+	}
+	return fmt.Sprintf("kubefirst-%s-%s", cloudProvider, clusterName)
+}
+
+// MergeKubeconfig merges the current context of a provider generated kubeconfig
+// into the kubeconfig at targetPath under contextName, replacing any entries
+// that already use that name
+//
+// An empty targetPath merges into the file of $KUBECONFIG that already holds
+// contextName, otherwise into the first file of $KUBECONFIG, or ~/.kube/config,
+// as kubectl does
+func MergeKubeconfig(kubeconfig []byte, contextName string, targetPath string, setCurrent bool) error {
+	source, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error parsing kubeconfig for %s: %s", contextName, err)
+	}
+
+	sourceContextName := source.CurrentContext
+	if sourceContextName == "" {
+		for name := range source.Contexts {
+			sourceContextName = name
+			break
+		}
+	}
+	sourceContext, ok := source.Contexts[sourceContextName]
+	if !ok {
+		return fmt.Errorf("kubeconfig for %s does not contain a context", contextName)
+	}
+	cluster, ok := source.Clusters[sourceContext.Cluster]
+	if !ok {
+		return fmt.Errorf("kubeconfig for %s does not contain cluster %s", contextName, sourceContext.Cluster)
+	}
+	authInfo, ok := source.AuthInfos[sourceContext.AuthInfo]
+	if !ok {
+		return fmt.Errorf("kubeconfig for %s does not contain user %s", contextName, sourceContext.AuthInfo)
+	}
+
+	targetPath = kubeconfigFilePath(targetPath, contextName)
+	target, err := loadKubeconfigFile(targetPath)
+	if err != nil {
+		return err
+	}
+
+	target.Clusters[contextName] = cluster
+	target.AuthInfos[contextName] = authInfo
+	target.Contexts[contextName] = &clientcmdapi.Context{
+		Cluster:   contextName,
+		AuthInfo:  contextName,
+		Namespace: sourceContext.Namespace,
+	}
+	if setCurrent || target.CurrentContext == "" {
+		target.CurrentContext = contextName
+	}
+
+	err = writeKubeconfigFile(target, targetPath)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("merged kubeconfig context %s into %s", contextName, targetPath)
+
+	return nil
+}
+
+// MergeKubeconfigFile merges the kubeconfig written by a provider (for example
+// by k3d.ClusterCreate) into the kubeconfig at targetPath
+func MergeKubeconfigFile(kubeconfigPath string, contextName string, targetPath string, setCurrent bool) error {
+	kubeconfig, err := os.ReadFile(kubeconfigPath)
+	if err != nil {
+		return fmt.Errorf("error reading kubeconfig %s: %s", kubeconfigPath, err)
+	}
+
+	return MergeKubeconfig(kubeconfig, contextName, targetPath, setCurrent)
+}
+
+// RemoveKubeconfigContext removes a context from the kubeconfig at targetPath,
+// along with its cluster and user entries when no other context refers to them
+//
+// This is intended to be called when a cluster is destroyed, a missing context
+// is not an error
+func RemoveKubeconfigContext(contextName string, targetPath string) error {
+	targetPath = kubeconfigFilePath(targetPath, contextName)
+	target, err := loadKubeconfigFile(targetPath)
+	if err != nil {
+		return err
+	}
+
+	kubeContext, ok := target.Contexts[contextName]
+	if !ok {
+		log.Info().Msgf("kubeconfig context %s not found in %s - skipping", contextName, targetPath)
+		return nil
+	}
+	delete(target.Contexts, contextName)
+
+	clusterInUse, authInfoInUse := false, false
+	for _, other := range target.Contexts {
+		if other.Cluster == kubeContext.Cluster {
+			clusterInUse = true
+		}
+		if other.AuthInfo == kubeContext.AuthInfo {
+			authInfoInUse = true
+		}
+	}
+	if !clusterInUse {
+		delete(target.Clusters, kubeContext.Cluster)
+	}
+	if !authInfoInUse {
+		delete(target.AuthInfos, kubeContext.AuthInfo)
+	}
+	if target.CurrentContext == contextName {
+		target.CurrentContext = ""
+	}
+
+	err = writeKubeconfigFile(target, targetPath)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("removed kubeconfig context %s from %s", contextName, targetPath)
+
+	return nil
+}
+
+// RenameKubeconfigContext renames a context in the kubeconfig at targetPath
+func RenameKubeconfigContext(contextName string, newContextName string, targetPath string) error {
+	targetPath = kubeconfigFilePath(targetPath, contextName)
+	target, err := loadKubeconfigFile(targetPath)
+	if err != nil {
+		return err
+	}
+
+	kubeContext, ok := target.Contexts[contextName]
+	if !ok {
+		return fmt.Errorf("kubeconfig context %s not found in %s", contextName, targetPath)
+	}
+	if _, ok := target.Contexts[newContextName]; ok {
+		return fmt.Errorf("kubeconfig context %s already exists in %s", newContextName, targetPath)
+	}
+
+	target.Contexts[newContextName] = kubeContext
+	delete(target.Contexts, contextName)
+	if target.CurrentContext == contextName {
+		target.CurrentContext = newContextName
+	}
+
+	err = writeKubeconfigFile(target, targetPath)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("renamed kubeconfig context %s to %s", contextName, newContextName)
+
+	return nil
+}
+
+// UseKubeconfigContext sets the current context of the kubeconfig at targetPath
+func UseKubeconfigContext(contextName string, targetPath string) error {
+	targetPath = kubeconfigFilePath(targetPath, contextName)
+	target, err := loadKubeconfigFile(targetPath)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := target.Contexts[contextName]; !ok {
+		return fmt.Errorf("kubeconfig context %s not found in %s", contextName, targetPath)
+	}
+	target.CurrentContext = contextName
+
+	err = writeKubeconfigFile(target, targetPath)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("switched kubeconfig context to %s", contextName)
+
+	return nil
+}
+
+// CreateKubeConfigForContext returns a KubernetesClient for a specific context of
+// the kubeconfig at kubeConfigPath rather than its current context
+func CreateKubeConfigForContext(contextName string, kubeConfigPath string) (*KubernetesClient, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeConfigPath
+	kubeconfig := kubeconfigFilePath(kubeConfigPath, contextName)
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: contextName},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubeconfig context %s from %s: %s", contextName, kubeconfig, err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client: %s", err)
+	}
+
+	return &KubernetesClient{
+		Clientset:      clientset,
+		RestConfig:     config,
+		KubeConfigPath: kubeconfig,
+	}, nil
+}
+
+// ValidateKubeconfigContext verifies that the API server behind a context is
+// reachable and that its credentials are accepted
+func ValidateKubeconfigContext(ctx context.Context, contextName string, targetPath string) error {
+	kcl, err := CreateKubeConfigForContext(contextName, targetPath)
+	if err != nil {
+		return err
+	}
+
+	// An unreachable API server should fail fast rather than hang the caller
+	restConfig := *kcl.RestConfig
+	restConfig.Timeout = kubeconfigValidationTimeout
+	clientset, err := kubernetes.NewForConfig(&restConfig)
+	if err != nil {
+		return fmt.Errorf("error creating kubernetes client: %s", err)
+	}
+
+	// ServerVersion does not require credentials, listing namespaces proves
+	// they are accepted
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("kubernetes api for context %s is not reachable: %s", contextName, err)
+	}
+	_, err = clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("credentials for context %s were not accepted: %s", contextName, err)
+	}
+	log.Info().Msgf("kubeconfig context %s is reachable, kubernetes version %s", contextName, version.GitVersion)
+
+	return nil
+}
+
+// kubeconfigFilePath returns the kubeconfig file to modify, targetPath when it
+// is set and otherwise a file of $KUBECONFIG or ~/.kube/config
+//
+// $KUBECONFIG may list several files, the file defining contextName is used
+// and the first file of the list when none does, which is what kubectl does
+func kubeconfigFilePath(targetPath string, contextName string) string {
+	if targetPath != "" {
+		return targetPath
+	}
+
+	precedence := make([]string, 0)
+	for _, path := range clientcmd.NewDefaultClientConfigLoadingRules().GetLoadingPrecedence() {
+		if path != "" {
+			precedence = append(precedence, path)
+		}
+	}
+	if len(precedence) == 0 {
+		return clientcmd.RecommendedHomeFile
+	}
+	if contextName != "" {
+		for _, path := range precedence {
+			config, err := clientcmd.LoadFromFile(path)
+			if err != nil {
+				continue
+			}
+			if _, ok := config.Contexts[contextName]; ok {
+				return path
+			}
+		}
+	}
+
+	return precedence[0]
+}
+
+// loadKubeconfigFile loads the kubeconfig at path, returning an empty config if
+// the file does not exist yet
+func loadKubeconfigFile(path string) (*clientcmdapi.Config, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return clientcmdapi.NewConfig(), nil
+	}
+
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubeconfig %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// writeKubeconfigFile writes config to path with permissions that only allow
+// the current user to read the credentials it contains
+func writeKubeconfigFile(config *clientcmdapi.Config, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating kubeconfig directory for %s: %s", path, err)
+	}
+
+	err = clientcmd.WriteToFile(*config, path)
+	if err != nil {
+		return fmt.Errorf("error writing kubeconfig %s: %s", path, err)
+	}
+
+	return os.Chmod(path, 0600)
+}
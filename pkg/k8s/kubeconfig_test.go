@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const testProviderKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: k3d-kubefirst
+  cluster:
+    server: https://0.0.0.0:6443
+contexts:
+- name: k3d-kubefirst
+  context:
+    cluster: k3d-kubefirst
+    user: admin@k3d-kubefirst
+current-context: k3d-kubefirst
+users:
+- name: admin@k3d-kubefirst
+  user:
+    token: abc
+`
+
+func TestMergeAndRemoveKubeconfigContext(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "config")
+	contextName := KubefirstContextName("k3d", "kubefirst")
+
+	err := MergeKubeconfig([]byte(testProviderKubeconfig), contextName, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := clientcmd.LoadFromFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.CurrentContext != contextName {
+		t.Errorf("wanted current context %s, got %s", contextName, merged.CurrentContext)
+	}
+	if merged.Clusters[contextName] == nil || merged.Clusters[contextName].Server != "https://0.0.0.0:6443" {
+		t.Errorf("cluster %s was not merged", contextName)
+	}
+	if merged.AuthInfos[contextName] == nil || merged.AuthInfos[contextName].Token != "abc" {
+		t.Errorf("user %s was not merged", contextName)
+	}
+
+	err = RenameKubeconfigContext(contextName, "renamed", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RemoveKubeconfigContext("renamed", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := clientcmd.LoadFromFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed.Contexts) != 0 || len(removed.Clusters) != 0 || len(removed.AuthInfos) != 0 {
+		t.Errorf("wanted an empty kubeconfig, got %d contexts, %d clusters, %d users", len(removed.Contexts), len(removed.Clusters), len(removed.AuthInfos))
+	}
+	if removed.CurrentContext != "" {
+		t.Errorf("wanted current context to be unset, got %s", removed.CurrentContext)
+	}
+}
+
+func TestKubeconfigFilePathWithKubeconfigList(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	t.Setenv("KUBECONFIG", first+string(filepath.ListSeparator)+second)
+
+	err := MergeKubeconfig([]byte(testProviderKubeconfig), "in-second", second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MergeKubeconfig([]byte(testProviderKubeconfig), "in-first", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := clientcmd.LoadFromFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Contexts["in-first"] == nil {
+		t.Errorf("wanted context in-first to be merged into %s", first)
+	}
+
+	// merging a context that lives in a later file updates it in place
+	err = MergeKubeconfig([]byte(strings.Replace(testProviderKubeconfig, "token: abc", "token: def", 1)), "in-second", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = clientcmd.LoadFromFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Contexts["in-second"] != nil {
+		t.Errorf("wanted context in-second not to be duplicated into %s", first)
+	}
+	updated, err := clientcmd.LoadFromFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.AuthInfos["in-second"] == nil || updated.AuthInfos["in-second"].Token != "def" {
+		t.Errorf("wanted context in-second to be updated in %s", second)
+	}
+
+	if path := kubeconfigFilePath("", "in-second"); path != second {
+		t.Errorf("wanted %s for context in-second, got %s", second, path)
+	}
+	if path := kubeconfigFilePath("", "missing"); path != first {
+		t.Errorf("wanted %s for a missing context, got %s", first, path)
+	}
+
+	err = RemoveKubeconfigContext("in-second", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := clientcmd.LoadFromFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed.Contexts["in-second"] != nil {
+		t.Errorf("wanted context in-second to be removed from %s", second)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// namespaceResourceQuotaName is the name of the ResourceQuota created by EnsureNamespaces
+	namespaceResourceQuotaName = "kubefirst-quota"
+	// namespaceLimitRangeName is the name of the LimitRange created by EnsureNamespaces
+	namespaceLimitRangeName = "kubefirst-limits"
+	// namespaceNetworkPolicyName is the name of the NetworkPolicy created by EnsureNamespaces
+	namespaceNetworkPolicyName = "kubefirst-default"
+)
+
+// NamespaceSpec describes a namespace to bootstrap with EnsureNamespaces
+type NamespaceSpec struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+	// ResourceQuota, LimitRange and NetworkPolicy are optional and are created
+	// in the namespace, or updated to match, when set
+	ResourceQuota *v1.ResourceQuotaSpec
+	LimitRange    *v1.LimitRangeSpec
+	NetworkPolicy *networkingv1.NetworkPolicySpec
+}
+
+// EnsureNamespacesResult reports which namespaces were created by
+// EnsureNamespaces and which already existed
+type EnsureNamespacesResult struct {
+	Created  []string
+	Existing []string
+}
+
+// NamespaceSpecs returns a NamespaceSpec without any additional configuration
+// for each namespace name
+func NamespaceSpecs(names ...string) []NamespaceSpec {
+	specs := make([]NamespaceSpec, 0, len(names))
+	for _, name := range names {
+		specs = append(specs, NamespaceSpec{Name: name})
+	}
+
+	return specs
+}
+
+// SameNamespaceNetworkPolicy returns a NetworkPolicySpec that only allows ingress
+// traffic from Pods in the same namespace and from the ingress controller
+func SameNamespaceNetworkPolicy() *networkingv1.NetworkPolicySpec {
+	return &networkingv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		Ingress: []networkingv1.NetworkPolicyIngressRule{
+			{
+				From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{
+						NamespaceSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"kubernetes.io/metadata.name": "ingress-nginx"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// EnsureNamespaces creates each namespace in specs if it does not exist and
+// reconciles its labels, annotations and optional ResourceQuota, LimitRange and
+// NetworkPolicy
+//
+// It is safe to call repeatedly, namespaces that already exist are reported in
+// EnsureNamespacesResult.Existing rather than returning an error
+func EnsureNamespaces(ctx context.Context, clientset kubernetes.Interface, specs []NamespaceSpec) (*EnsureNamespacesResult, error) {
+	result := &EnsureNamespacesResult{
+		Created:  make([]string, 0),
+		Existing: make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.Name == "" || seen[spec.Name] {
+			continue
+		}
+		seen[spec.Name] = true
+
+		created, err := ensureNamespace(ctx, clientset, spec)
+		if err != nil {
+			return result, err
+		}
+		if created {
+			result.Created = append(result.Created, spec.Name)
+		} else {
+			result.Existing = append(result.Existing, spec.Name)
+		}
+
+		if spec.ResourceQuota != nil {
+			err = ensureResourceQuota(ctx, clientset, spec.Name, spec.ResourceQuota)
+			if err != nil {
+				return result, err
+			}
+		}
+		if spec.LimitRange != nil {
+			err = ensureLimitRange(ctx, clientset, spec.Name, spec.LimitRange)
+			if err != nil {
+				return result, err
+			}
+		}
+		if spec.NetworkPolicy != nil {
+			err = ensureNetworkPolicy(ctx, clientset, spec.Name, spec.NetworkPolicy)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ensureNamespace creates a namespace and returns true, or applies its labels and
+// annotations to the existing namespace and returns false
+func ensureNamespace(ctx context.Context, clientset kubernetes.Interface, spec NamespaceSpec) (bool, error) {
+	_, err := clientset.CoreV1().Namespaces().Get(ctx, spec.Name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("error getting namespace %s: %s", spec.Name, err)
+	}
+
+	if errors.IsNotFound(err) {
+		_, err = clientset.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        spec.Name,
+				Labels:      spec.Labels,
+				Annotations: spec.Annotations,
+			},
+		}, metav1.CreateOptions{FieldManager: FieldManager})
+		// another caller may have created the namespace in the meantime
+		if err == nil {
+			log.Info().Msgf("namespace created: %s", spec.Name)
+			return true, nil
+		}
+		if !errors.IsAlreadyExists(err) {
+			return false, fmt.Errorf("error creating namespace %s: %s", spec.Name, err)
+		}
+	}
+
+	log.Info().Msgf("namespace %s already exists - skipping", spec.Name)
+	if len(spec.Labels) == 0 && len(spec.Annotations) == 0 {
+		return false, nil
+	}
+
+	applyConfig := corev1ac.Namespace(spec.Name).
+		WithLabels(spec.Labels).
+		WithAnnotations(spec.Annotations)
+	_, err = clientset.CoreV1().Namespaces().Apply(ctx, applyConfig, metav1.ApplyOptions{
+		FieldManager: FieldManager,
+		Force:        true,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error applying labels to namespace %s: %s", spec.Name, err)
+	}
+
+	return false, nil
+}
+
+// ensureResourceQuota creates or updates the kubefirst ResourceQuota of a namespace
+func ensureResourceQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, spec *v1.ResourceQuotaSpec) error {
+	client := clientset.CoreV1().ResourceQuotas(namespace)
+
+	existing, err := client.Get(ctx, namespaceResourceQuotaName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = client.Create(ctx, &v1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: namespaceResourceQuotaName, Namespace: namespace},
+			Spec:       *spec,
+		}, metav1.CreateOptions{FieldManager: FieldManager})
+	case err == nil:
+		existing.Spec = *spec
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{FieldManager: FieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("error ensuring resource quota in namespace %s: %s", namespace, err)
+	}
+
+	return nil
+}
+
+// ensureLimitRange creates or updates the kubefirst LimitRange of a namespace
+func ensureLimitRange(ctx context.Context, clientset kubernetes.Interface, namespace string, spec *v1.LimitRangeSpec) error {
+	client := clientset.CoreV1().LimitRanges(namespace)
+
+	existing, err := client.Get(ctx, namespaceLimitRangeName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = client.Create(ctx, &v1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Name: namespaceLimitRangeName, Namespace: namespace},
+			Spec:       *spec,
+		}, metav1.CreateOptions{FieldManager: FieldManager})
+	case err == nil:
+		existing.Spec = *spec
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{FieldManager: FieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("error ensuring limit range in namespace %s: %s", namespace, err)
+	}
+
+	return nil
+}
+
+// ensureNetworkPolicy creates or updates the kubefirst NetworkPolicy of a namespace
+func ensureNetworkPolicy(ctx context.Context, clientset kubernetes.Interface, namespace string, spec *networkingv1.NetworkPolicySpec) error {
+	client := clientset.NetworkingV1().NetworkPolicies(namespace)
+
+	existing, err := client.Get(ctx, namespaceNetworkPolicyName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = client.Create(ctx, &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: namespaceNetworkPolicyName, Namespace: namespace},
+			Spec:       *spec,
+		}, metav1.CreateOptions{FieldManager: FieldManager})
+	case err == nil:
+		existing.Spec = *spec
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{FieldManager: FieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("error ensuring network policy in namespace %s: %s", namespace, err)
+	}
+
+	return nil
+}
@@ -9,11 +9,13 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
@@ -146,3 +148,85 @@ func PortForwardPod(clientset *kubernetes.Clientset, req PortForwardAPodRequest)
 
 	return nil
 }
+
+// PodPortForward is an open port forward to a single pod
+type PodPortForward struct {
+	// LocalPort is the local port traffic is forwarded from
+	LocalPort int
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+}
+
+// Close stops the port forward
+func (p *PodPortForward) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+}
+
+// OpenPodPortForward forwards a free local port to podPort of the named pod and
+// waits until the tunnel is ready to receive traffic
+//
+// Unlike PortForwardPod the pod name must match exactly, which is needed to
+// reach an individual StatefulSet replica, and the port forward runs until
+// Close is called or ctx is cancelled
+func OpenPodPortForward(ctx context.Context, clientset kubernetes.Interface, restConfig *rest.Config, namespace string, podName string, podPort int) (*PodPortForward, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	portForwardURL := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, portForwardURL)
+
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	fw, err := portforward.NewOnAddresses(
+		dialer,
+		[]string{"localhost"},
+		[]string{fmt.Sprintf("0:%d", podPort)},
+		stopCh,
+		readyCh,
+		io.Discard,
+		io.Discard,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fw.ForwardPorts()
+	}()
+
+	select {
+	case <-readyCh:
+	case err := <-errCh:
+		return nil, fmt.Errorf("error opening port forward to pod %s/%s: %s", namespace, podName, err)
+	case <-ctx.Done():
+		close(stopCh)
+		return nil, ctx.Err()
+	}
+
+	ports, err := fw.GetPorts()
+	if err != nil || len(ports) == 0 {
+		close(stopCh)
+		return nil, fmt.Errorf("error reading local port for pod %s/%s: %v", namespace, podName, err)
+	}
+
+	forward := &PodPortForward{LocalPort: int(ports[0].Local), stopCh: stopCh}
+	go func() {
+		select {
+		case <-ctx.Done():
+			forward.Close()
+		case <-stopCh:
+		}
+	}()
+
+	return forward, nil
+}
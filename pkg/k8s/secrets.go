@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FieldManager identifies kubefirst as the owner of fields it applies with
+// server-side apply
+const FieldManager = "kubefirst"
+
+// SecretEventHandler is called for every change to a watched Secret
+type SecretEventHandler func(eventType watch.EventType, secret *v1.Secret)
+
+// EnsureSecret creates the Secret or updates it to match the provided object
+// using server-side apply
+//
+// Only the fields set on secret are managed, keys added to the Secret by other
+// field managers are left in place
+func EnsureSecret(ctx context.Context, clientset kubernetes.Interface, secret *v1.Secret) (*v1.Secret, error) {
+	applyConfig := corev1ac.Secret(secret.Name, secret.Namespace).
+		WithLabels(secret.Labels).
+		WithAnnotations(secret.Annotations).
+		WithData(secret.Data).
+		WithStringData(secret.StringData)
+	if secret.Type != "" {
+		applyConfig = applyConfig.WithType(secret.Type)
+	}
+	if secret.Immutable != nil {
+		applyConfig = applyConfig.WithImmutable(*secret.Immutable)
+	}
+
+	applied, err := clientset.CoreV1().Secrets(secret.Namespace).Apply(ctx, applyConfig, metav1.ApplyOptions{
+		FieldManager: FieldManager,
+		Force:        true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error applying secret %s/%s: %s", secret.Namespace, secret.Name, err)
+	}
+	log.Info().Msgf("applied secret %s/%s", secret.Namespace, secret.Name)
+
+	return applied, nil
+}
+
+// GetSecret returns a Secret, the returned error can be checked with
+// errors.IsNotFound
+func GetSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (*v1.Secret, error) {
+	return clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// PatchSecret merges data into an existing Secret - keys set to a nil value are
+// removed from the Secret
+func PatchSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, data map[string][]byte) (*v1.Secret, error) {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := clientset.CoreV1().Secrets(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error patching secret %s/%s: %s", namespace, name, err)
+	}
+	log.Info().Msgf("patched secret %s/%s", namespace, name)
+
+	return patched, nil
+}
+
+// DeleteSecret deletes a Secret, a Secret that does not exist is not an error
+func DeleteSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) error {
+	err := clientset.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info().Msgf("secret %s/%s does not exist - skipping", namespace, name)
+			return nil
+		}
+		return fmt.Errorf("error deleting secret %s/%s: %s", namespace, name, err)
+	}
+	log.Info().Msgf("deleted secret %s/%s", namespace, name)
+
+	return nil
+}
+
+// EnsureServiceAccountToken creates a long lived token Secret for a
+// ServiceAccount and returns the token once the token controller populated it,
+// an existing Secret is reused
+//
+// Tokens are no longer created automatically for ServiceAccounts since
+// Kubernetes 1.24
+func EnsureServiceAccountToken(ctx context.Context, clientset kubernetes.Interface, namespace string, serviceAccount string, secretName string, timeout time.Duration) (string, error) {
+	_, err := clientset.CoreV1().Secrets(namespace).Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName,
+			Namespace:   namespace,
+			Annotations: map[string]string{v1.ServiceAccountNameKey: serviceAccount},
+		},
+		Type: v1.SecretTypeServiceAccountToken,
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating token for service account %s/%s: %s", namespace, serviceAccount, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("error getting token for service account %s/%s: %s", namespace, serviceAccount, err)
+		}
+		if token := secret.Data[v1.ServiceAccountTokenKey]; len(token) > 0 {
+			return string(token), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("timed out waiting for token of service account %s/%s to be populated", namespace, serviceAccount)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// WatchSecret calls handler for every change to a Secret until the context is
+// cancelled or the API server closes the watch
+func WatchSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, handler SecretEventHandler) error {
+	objWatch, err := clientset.CoreV1().Secrets(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", name),
+	})
+	if err != nil {
+		return fmt.Errorf("error watching secret %s/%s: %s", namespace, name, err)
+	}
+	defer objWatch.Stop()
+
+	objChan := objWatch.ResultChan()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-objChan:
+			if !ok {
+				return nil
+			}
+			if event.Type == watch.Error {
+				return fmt.Errorf("error watching secret %s/%s: %v", namespace, name, errors.FromObject(event.Object))
+			}
+			secret, ok := event.Object.(*v1.Secret)
+			if !ok {
+				continue
+			}
+			handler(event.Type, secret)
+		}
+	}
+}
+
+// NewTLSSecret returns a kubernetes.io/tls Secret for a PEM encoded certificate
+// and key
+func NewTLSSecret(namespace string, name string, certPem []byte, keyPem []byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       certPem,
+			v1.TLSPrivateKeyKey: keyPem,
+		},
+	}
+}
+
+// NewBasicAuthSecret returns a kubernetes.io/basic-auth Secret
+func NewBasicAuthSecret(namespace string, name string, username string, password string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: v1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			v1.BasicAuthUsernameKey: []byte(username),
+			v1.BasicAuthPasswordKey: []byte(password),
+		},
+	}
+}
+
+// NewDockerRegistrySecret returns a kubernetes.io/dockerconfigjson Secret that can
+// be used as an imagePullSecret for server, e.g. ghcr.io
+func NewDockerRegistrySecret(namespace string, name string, server string, username string, password string) (*v1.Secret, error) {
+	type dockerAuth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}
+
+	dockerConfig, err := json.Marshal(map[string]map[string]dockerAuth{
+		"auths": {
+			server: {
+				Username: username,
+				Password: password,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error building docker config for %s: %s", server, err)
+	}
+
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: dockerConfig,
+		},
+	}, nil
+}
@@ -0,0 +1,716 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k8s
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// supportBundleRedacted replaces any sensitive value written to a support bundle
+	supportBundleRedacted = "<REDACTED>"
+	// defaultSupportBundleLogLines is the number of log lines collected per container
+	defaultSupportBundleLogLines int64 = 500
+)
+
+var (
+	argoCDApplicationResource = schema.GroupVersionResource{
+		Group:    "argoproj.io",
+		Version:  "v1alpha1",
+		Resource: "applications",
+	}
+
+	// supportBundleTokenPatterns match well known credential formats that may
+	// show up in logs or configuration files
+	supportBundleTokenPatterns = []redactionPattern{
+		// GitHub personal access, oauth, app and refresh tokens
+		{pattern: regexp.MustCompile(`\b(ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{20,}\b`)},
+		{pattern: regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{20,}\b`)},
+		// GitLab personal access tokens
+		{pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_\-]{20,}\b`)},
+		// AWS access key ids
+		{pattern: regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`)},
+		// Vault service and batch tokens
+		{pattern: regexp.MustCompile(`\bhv[sb]\.[A-Za-z0-9_\-]{20,}\b`)},
+		// JSON web tokens, including Kubernetes service account tokens
+		{pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\b`)},
+		// bearer authorization headers keep the scheme so the log line still reads well
+		{pattern: regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9_\-.=]{16,}`), keepPrefix: true},
+		// PEM encoded private keys
+		{pattern: regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	}
+
+	// supportBundleSensitiveKey matches yaml keys whose values should never leave
+	// the machine, e.g. github.token or kbot.private-key
+	supportBundleSensitiveKey = regexp.MustCompile(
+		`(?im)^([ \t]*-?[ \t]*[\w.\-]*` + supportBundleSensitiveWords + `[\w.\-]*[ \t]*:[ \t]*)(\S.*)$`,
+	)
+	// supportBundleSensitiveBlockKey matches a sensitive yaml key whose value is
+	// a block scalar, e.g. `password: |`, the first group is the indentation of
+	// the key
+	supportBundleSensitiveBlockKey = regexp.MustCompile(
+		`(?i)^([ \t]*-?[ \t]*)([\w.\-]*` + supportBundleSensitiveWords + `[\w.\-]*[ \t]*:[ \t]*)[|>][-+0-9]*[ \t]*(#.*)?$`,
+	)
+	// supportBundleSensitiveJSONKey matches JSON string pairs with a sensitive
+	// key, e.g. "token":"abc"
+	supportBundleSensitiveJSONKey = regexp.MustCompile(
+		`(?i)("[\w.\-]*` + supportBundleSensitiveWords + `[\w.\-]*"[ \t]*:[ \t]*")(?:[^"\\]|\\.)*"`,
+	)
+)
+
+// supportBundleSensitiveWords are the parts of key names whose values are redacted
+const supportBundleSensitiveWords = `(token|password|secret|private[-_]?key|access[-_]?key|api[-_]?key|credentials?)`
+
+// redactionPattern is a credential format removed from support bundle content
+type redactionPattern struct {
+	pattern *regexp.Regexp
+	// keepPrefix retains the first capture group of the match
+	keepPrefix bool
+}
+
+// SupportBundleOptions controls what CollectSupportBundle gathers and where the
+// resulting archive is written
+type SupportBundleOptions struct {
+	// OutputPath is the path of the tar.gz to create - defaults to
+	// kubefirst-support-bundle-<timestamp>.tar.gz in the current directory
+	OutputPath string
+	// Namespaces limits pod, event and secret collection - all namespaces are
+	// collected when empty
+	Namespaces []string
+	// LogLines is the number of trailing log lines collected per container
+	LogLines int64
+	// K1Dir is the kubefirst directory (usually ~/.k1) whose logs are collected
+	K1Dir string
+	// KubefirstConfigPath is the path to the .kubefirst config file, which is
+	// redacted before being added to the bundle
+	KubefirstConfigPath string
+}
+
+// supportBundle wraps the tar writer so every file added to the archive is
+// redacted in one place
+type supportBundle struct {
+	tw      *tar.Writer
+	created time.Time
+	errors  []string
+}
+
+// CollectSupportBundle gathers diagnostics from the cluster and the local
+// kubefirst directory into a tar.gz that is safe to attach to a GitHub issue
+//
+// Collection of individual sections is best effort, failures are recorded in
+// errors.txt within the bundle rather than aborting the collection
+//
+// The return value is the path of the created archive
+func CollectSupportBundle(ctx context.Context, kcl *KubernetesClient, opts SupportBundleOptions) (string, error) {
+	now := time.Now().UTC()
+	if opts.OutputPath == "" {
+		opts.OutputPath = fmt.Sprintf("kubefirst-support-bundle-%s.tar.gz", now.Format("20060102-150405"))
+	}
+	if opts.LogLines <= 0 {
+		opts.LogLines = defaultSupportBundleLogLines
+	}
+
+	file, err := os.OpenFile(opts.OutputPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error creating support bundle %s: %s", opts.OutputPath, err)
+	}
+	defer file.Close()
+
+	gzw := gzip.NewWriter(file)
+	bundle := &supportBundle{tw: tar.NewWriter(gzw), created: now}
+
+	log.Info().Msgf("collecting support bundle into %s", opts.OutputPath)
+
+	var clientset kubernetes.Interface
+	if kcl != nil && kcl.Clientset != nil {
+		clientset = kcl.Clientset
+	}
+	if clientset != nil {
+		namespaces, err := supportBundleNamespaces(ctx, clientset, opts.Namespaces)
+		if err != nil {
+			bundle.recordError("namespaces", err)
+		}
+
+		bundle.collectNodes(ctx, clientset)
+		for _, namespace := range namespaces {
+			bundle.collectEvents(ctx, clientset, namespace)
+			bundle.collectPods(ctx, clientset, namespace, opts.LogLines)
+			bundle.collectSecrets(ctx, clientset, namespace)
+		}
+	} else {
+		bundle.recordError("cluster", fmt.Errorf("no kubernetes client provided, skipping cluster collection"))
+	}
+
+	if kcl != nil && kcl.RestConfig != nil {
+		dynamicClient, err := dynamic.NewForConfig(kcl.RestConfig)
+		if err != nil {
+			bundle.recordError("argocd", err)
+		} else {
+			bundle.collectArgoCDApplications(ctx, dynamicClient)
+		}
+	}
+
+	if opts.K1Dir != "" {
+		bundle.collectK1Logs(opts.K1Dir)
+	}
+	if opts.KubefirstConfigPath != "" {
+		bundle.collectKubefirstConfig(opts.KubefirstConfigPath)
+	}
+
+	if len(bundle.errors) > 0 {
+		if err := bundle.addFile("errors.txt", []byte(strings.Join(bundle.errors, "\n")+"\n")); err != nil {
+			return "", err
+		}
+	}
+
+	if err := bundle.tw.Close(); err != nil {
+		return "", fmt.Errorf("error closing support bundle archive: %s", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return "", fmt.Errorf("error closing support bundle archive: %s", err)
+	}
+
+	log.Info().Msgf("support bundle written to %s", opts.OutputPath)
+
+	return opts.OutputPath, nil
+}
+
+// RedactSupportBundleContent removes known credential formats and the values of
+// sensitive looking yaml and JSON keys from content
+func RedactSupportBundleContent(content []byte) []byte {
+	redacted := redactSupportBundleBlockScalars(content)
+	redacted = supportBundleSensitiveKey.ReplaceAll(redacted, []byte("${1}"+supportBundleRedacted))
+	redacted = supportBundleSensitiveJSONKey.ReplaceAll(redacted, []byte("${1}"+supportBundleRedacted+`"`))
+	for _, p := range supportBundleTokenPatterns {
+		replacement := supportBundleRedacted
+		if p.keepPrefix {
+			replacement = "${1}" + supportBundleRedacted
+		}
+		redacted = p.pattern.ReplaceAll(redacted, []byte(replacement))
+	}
+
+	return redacted
+}
+
+// redactSupportBundleBlockScalars replaces the value of sensitive yaml keys that
+// use block scalars, every following line indented deeper than the key is part
+// of the value
+func redactSupportBundleBlockScalars(content []byte) []byte {
+	lines := strings.SplitAfter(string(content), "\n")
+	var redacted strings.Builder
+	indent := -1
+	for _, line := range lines {
+		if indent >= 0 {
+			trimmed := strings.TrimLeft(line, " \t")
+			if strings.TrimSpace(line) == "" || len(line)-len(trimmed) > indent {
+				continue
+			}
+			indent = -1
+		}
+
+		match := supportBundleSensitiveBlockKey.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if match == nil {
+			redacted.WriteString(line)
+			continue
+		}
+		indent = len(match[1])
+		redacted.WriteString(match[1] + match[2] + supportBundleRedacted)
+		if strings.HasSuffix(line, "\n") {
+			redacted.WriteString("\n")
+		}
+	}
+
+	return []byte(redacted.String())
+}
+
+// supportBundleNamespaces returns the namespaces to collect, every namespace in
+// the cluster is returned when none were requested
+func supportBundleNamespaces(ctx context.Context, clientset kubernetes.Interface, requested []string) ([]string, error) {
+	if len(requested) > 0 {
+		return requested, nil
+	}
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []string{}, err
+	}
+
+	result := make([]string, 0, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		result = append(result, namespace.Name)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// addFile redacts data and writes it to the archive at name
+func (b *supportBundle) addFile(name string, data []byte) error {
+	data = RedactSupportBundleContent(data)
+
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.created,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing %s to support bundle: %s", name, err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return fmt.Errorf("error writing %s to support bundle: %s", name, err)
+	}
+
+	return nil
+}
+
+// addYAML marshals obj and writes it to the archive at name
+func (b *supportBundle) addYAML(name string, obj interface{}) {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		b.recordError(name, err)
+		return
+	}
+	if err := b.addFile(name, data); err != nil {
+		b.recordError(name, err)
+	}
+}
+
+// recordError keeps track of a section that could not be collected
+func (b *supportBundle) recordError(section string, err error) {
+	log.Warn().Msgf("support bundle: unable to collect %s: %s", section, err)
+	b.errors = append(b.errors, fmt.Sprintf("%s: %s", section, err))
+}
+
+// collectNodes writes the node list and a short summary of each node
+func (b *supportBundle) collectNodes(ctx context.Context, clientset kubernetes.Interface) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError("nodes", err)
+		return
+	}
+
+	var summary bytes.Buffer
+	w := tabwriter.NewWriter(&summary, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREADY\tVERSION\tOS-IMAGE\tCONDITIONS")
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		node.SetManagedFields(nil)
+
+		ready := "Unknown"
+		pressure := make([]string, 0)
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady {
+				ready = string(condition.Status)
+			} else if condition.Status == v1.ConditionTrue {
+				pressure = append(pressure, string(condition.Type))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			node.Name,
+			ready,
+			node.Status.NodeInfo.KubeletVersion,
+			node.Status.NodeInfo.OSImage,
+			strings.Join(pressure, ","),
+		)
+	}
+	w.Flush()
+
+	b.addYAML("cluster/nodes.yaml", nodes)
+	if err := b.addFile("cluster/nodes.txt", summary.Bytes()); err != nil {
+		b.recordError("nodes", err)
+	}
+}
+
+// collectEvents writes the events of a namespace sorted by last occurrence
+func (b *supportBundle) collectEvents(ctx context.Context, clientset kubernetes.Interface, namespace string) {
+	events, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError(fmt.Sprintf("events in namespace %s", namespace), err)
+		return
+	}
+	if len(events.Items) == 0 {
+		return
+	}
+
+	if err := b.addFile(fmt.Sprintf("namespaces/%s/events.txt", namespace), formatEvents(events.Items)); err != nil {
+		b.recordError(fmt.Sprintf("events in namespace %s", namespace), err)
+	}
+}
+
+// collectPods writes a status summary of every pod in a namespace, a describe-like
+// report for each pod and the logs of any pod that is failing
+func (b *supportBundle) collectPods(ctx context.Context, clientset kubernetes.Interface, namespace string, logLines int64) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError(fmt.Sprintf("pods in namespace %s", namespace), err)
+		return
+	}
+	if len(pods.Items) == 0 {
+		return
+	}
+
+	var summary bytes.Buffer
+	w := tabwriter.NewWriter(&summary, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPHASE\tREADY\tRESTARTS\tNODE\tREASON")
+	for _, pod := range pods.Items {
+		ready, total, restarts := podContainerCounts(&pod)
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%d\t%s\t%s\n",
+			pod.Name,
+			pod.Status.Phase,
+			ready,
+			total,
+			restarts,
+			pod.Spec.NodeName,
+			podFailureReason(&pod),
+		)
+	}
+	w.Flush()
+	if err := b.addFile(fmt.Sprintf("namespaces/%s/pods.txt", namespace), summary.Bytes()); err != nil {
+		b.recordError(fmt.Sprintf("pods in namespace %s", namespace), err)
+	}
+
+	for _, pod := range pods.Items {
+		pod := pod
+		podEvents, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", pod.Name),
+		})
+		if err != nil {
+			podEvents = &v1.EventList{}
+		}
+		describe := describePod(&pod, podEvents.Items)
+		if err := b.addFile(fmt.Sprintf("namespaces/%s/describe/%s.txt", namespace, pod.Name), describe); err != nil {
+			b.recordError(fmt.Sprintf("pod %s/%s", namespace, pod.Name), err)
+		}
+
+		if podFailureReason(&pod) != "" {
+			b.collectPodLogs(ctx, clientset, &pod, logLines)
+		}
+	}
+}
+
+// collectPodLogs writes the current and previous logs of every container in pod
+func (b *supportBundle) collectPodLogs(ctx context.Context, clientset kubernetes.Interface, pod *v1.Pod, logLines int64) {
+	containers := make([]string, 0)
+	for _, container := range pod.Spec.InitContainers {
+		containers = append(containers, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		containers = append(containers, container.Name)
+	}
+
+	for _, container := range containers {
+		for _, previous := range []bool{false, true} {
+			tail := logLines
+			stream, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+				Container: container,
+				Previous:  previous,
+				TailLines: &tail,
+			}).Stream(ctx)
+			if err != nil {
+				// previous logs only exist after a restart
+				if !previous {
+					b.recordError(fmt.Sprintf("logs for %s/%s container %s", pod.Namespace, pod.Name, container), err)
+				}
+				continue
+			}
+			data, err := io.ReadAll(stream)
+			stream.Close()
+			if err != nil || len(data) == 0 {
+				continue
+			}
+
+			name := fmt.Sprintf("namespaces/%s/logs/%s/%s.log", pod.Namespace, pod.Name, container)
+			if previous {
+				name = fmt.Sprintf("namespaces/%s/logs/%s/%s.previous.log", pod.Namespace, pod.Name, container)
+			}
+			if err := b.addFile(name, data); err != nil {
+				b.recordError(name, err)
+			}
+		}
+	}
+}
+
+// collectSecrets writes the name, type and keys of every Secret in a namespace,
+// Secret data is never added to the bundle
+func (b *supportBundle) collectSecrets(ctx context.Context, clientset kubernetes.Interface, namespace string) {
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError(fmt.Sprintf("secrets in namespace %s", namespace), err)
+		return
+	}
+	if len(secrets.Items) == 0 {
+		return
+	}
+
+	var summary bytes.Buffer
+	w := tabwriter.NewWriter(&summary, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tKEYS")
+	for _, secret := range secrets.Items {
+		keys := make([]string, 0, len(secret.Data))
+		for key := range secret.Data {
+			keys = append(keys, fmt.Sprintf("%s=%s", key, supportBundleRedacted))
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", secret.Name, secret.Type, strings.Join(keys, ","))
+	}
+	w.Flush()
+
+	if err := b.addFile(fmt.Sprintf("namespaces/%s/secrets.txt", namespace), summary.Bytes()); err != nil {
+		b.recordError(fmt.Sprintf("secrets in namespace %s", namespace), err)
+	}
+}
+
+// collectArgoCDApplications writes the sync and health status of every ArgoCD
+// Application in the cluster
+func (b *supportBundle) collectArgoCDApplications(ctx context.Context, dynamicClient dynamic.Interface) {
+	applications, err := dynamicClient.Resource(argoCDApplicationResource).Namespace("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError("argocd applications", err)
+		return
+	}
+
+	var summary bytes.Buffer
+	w := tabwriter.NewWriter(&summary, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tSYNC\tHEALTH\tOPERATION\tMESSAGE")
+	for _, application := range applications.Items {
+		syncStatus, _, _ := unstructured.NestedString(application.Object, "status", "sync", "status")
+		healthStatus, _, _ := unstructured.NestedString(application.Object, "status", "health", "status")
+		phase, _, _ := unstructured.NestedString(application.Object, "status", "operationState", "phase")
+		message, _, _ := unstructured.NestedString(application.Object, "status", "operationState", "message")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			application.GetNamespace(),
+			application.GetName(),
+			syncStatus,
+			healthStatus,
+			phase,
+			strings.ReplaceAll(message, "\n", " "),
+		)
+
+		// spec may carry helm values, only keep what is useful for debugging
+		application.SetManagedFields(nil)
+		unstructured.RemoveNestedField(application.Object, "spec", "source", "helm")
+		unstructured.RemoveNestedField(application.Object, "spec", "sources")
+		b.addYAML(fmt.Sprintf("argocd/applications/%s/%s.yaml", application.GetNamespace(), application.GetName()), application.Object)
+	}
+	w.Flush()
+
+	if err := b.addFile("argocd/applications.txt", summary.Bytes()); err != nil {
+		b.recordError("argocd applications", err)
+	}
+}
+
+// collectK1Logs adds every log file found in the logs folder of the kubefirst directory
+func (b *supportBundle) collectK1Logs(k1Dir string) {
+	logDir := filepath.Join(k1Dir, "logs")
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		b.recordError("kubefirst logs", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(logDir, entry.Name()))
+		if err != nil {
+			b.recordError(fmt.Sprintf("kubefirst log %s", entry.Name()), err)
+			continue
+		}
+		if err := b.addFile(fmt.Sprintf("k1/logs/%s", entry.Name()), data); err != nil {
+			b.recordError(fmt.Sprintf("kubefirst log %s", entry.Name()), err)
+		}
+	}
+}
+
+// collectKubefirstConfig adds the redacted .kubefirst configuration file
+func (b *supportBundle) collectKubefirstConfig(configPath string) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		b.recordError("kubefirst config", err)
+		return
+	}
+
+	if err := b.addFile("k1/kubefirst.yaml", data); err != nil {
+		b.recordError("kubefirst config", err)
+	}
+}
+
+// describePod renders a kubectl describe style report for a pod
+func describePod(pod *v1.Pod, events []v1.Event) []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Name:         %s\n", pod.Name)
+	fmt.Fprintf(&out, "Namespace:    %s\n", pod.Namespace)
+	fmt.Fprintf(&out, "Node:         %s\n", pod.Spec.NodeName)
+	if pod.Status.StartTime != nil {
+		fmt.Fprintf(&out, "Start Time:   %s\n", pod.Status.StartTime.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&out, "Phase:        %s\n", pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		fmt.Fprintf(&out, "Reason:       %s\n", pod.Status.Reason)
+	}
+	if pod.Status.Message != "" {
+		fmt.Fprintf(&out, "Message:      %s\n", pod.Status.Message)
+	}
+
+	fmt.Fprintln(&out, "Conditions:")
+	for _, condition := range pod.Status.Conditions {
+		fmt.Fprintf(&out, "  %-16s %s", condition.Type, condition.Status)
+		if condition.Reason != "" {
+			fmt.Fprintf(&out, " (%s: %s)", condition.Reason, condition.Message)
+		}
+		fmt.Fprintln(&out)
+	}
+
+	fmt.Fprintln(&out, "Containers:")
+	statuses := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		fmt.Fprintf(&out, "  %s:\n", status.Name)
+		fmt.Fprintf(&out, "    Image:          %s\n", status.Image)
+		fmt.Fprintf(&out, "    Ready:          %t\n", status.Ready)
+		fmt.Fprintf(&out, "    Restart Count:  %d\n", status.RestartCount)
+		fmt.Fprintf(&out, "    State:          %s\n", describeContainerState(status.State))
+		if status.LastTerminationState.Terminated != nil {
+			fmt.Fprintf(&out, "    Last State:     %s\n", describeContainerState(status.LastTerminationState))
+		}
+	}
+
+	fmt.Fprintln(&out, "Events:")
+	if len(events) == 0 {
+		fmt.Fprintln(&out, "  <none>")
+	} else {
+		out.Write(formatEvents(events))
+	}
+
+	return out.Bytes()
+}
+
+// describeContainerState returns a single line description of a container state
+func describeContainerState(state v1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return fmt.Sprintf("Running since %s", state.Running.StartedAt.Format(time.RFC3339))
+	case state.Waiting != nil:
+		return fmt.Sprintf("Waiting (%s) %s", state.Waiting.Reason, state.Waiting.Message)
+	case state.Terminated != nil:
+		return fmt.Sprintf("Terminated (%s) exit code %d %s", state.Terminated.Reason, state.Terminated.ExitCode, state.Terminated.Message)
+	}
+
+	return "Unknown"
+}
+
+// formatEvents renders events as a table sorted by last occurrence
+func formatEvents(events []v1.Event) []byte {
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+
+	var out bytes.Buffer
+	w := tabwriter.NewWriter(&out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "LAST SEEN\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%d\t%s\n",
+			eventTime(event).Format(time.RFC3339),
+			event.Type,
+			event.Reason,
+			strings.ToLower(event.InvolvedObject.Kind),
+			event.InvolvedObject.Name,
+			event.Count,
+			strings.ReplaceAll(event.Message, "\n", " "),
+		)
+	}
+	w.Flush()
+
+	return out.Bytes()
+}
+
+// eventTime returns the most relevant timestamp of an event
+func eventTime(event v1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+
+	return event.CreationTimestamp.Time
+}
+
+// podContainerCounts returns the number of ready containers, total containers and
+// restarts across all containers of a pod
+func podContainerCounts(pod *v1.Pod) (int, int, int32) {
+	ready := 0
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Ready {
+			ready++
+		}
+		restarts += status.RestartCount
+	}
+
+	return ready, len(pod.Spec.Containers), restarts
+}
+
+// podFailureReason returns why a pod is considered failing, or an empty string
+// for a healthy pod
+func podFailureReason(pod *v1.Pod) string {
+	if pod.Status.Phase == v1.PodFailed {
+		if pod.Status.Reason != "" {
+			return pod.Status.Reason
+		}
+		return string(v1.PodFailed)
+	}
+	if pod.Status.Phase == v1.PodSucceeded {
+		return ""
+	}
+
+	statuses := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason != "" && status.State.Waiting.Reason != "PodInitializing" && status.State.Waiting.Reason != "ContainerCreating" {
+			return status.State.Waiting.Reason
+		}
+		if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+			return status.State.Terminated.Reason
+		}
+		if status.RestartCount > 0 && !status.Ready {
+			return "Restarting"
+		}
+	}
+	if pod.Status.Phase == v1.PodPending {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse {
+				return condition.Reason
+			}
+		}
+	}
+
+	return ""
+}
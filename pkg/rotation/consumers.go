@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package rotation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kubefirst/runtime/pkg/github"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Consumer is updated with the values of a rotated secret, Apply is also called
+// with the previous values to roll back a failed rotation
+type Consumer interface {
+	Name() string
+	Apply(ctx context.Context, values map[string]string) error
+}
+
+// GitHubWebhookConsumer updates the secret of a repository webhook, e.g. the
+// Atlantis webhook of the gitops repository
+type GitHubWebhookConsumer struct {
+	Session    github.GithubSession
+	Owner      string
+	Repository string
+	// URL the webhook delivers to
+	URL string
+	// SecretKey is the key of the webhook secret in the rotated values
+	SecretKey string
+}
+
+// KubernetesSecretConsumer updates keys of a Kubernetes Secret
+type KubernetesSecretConsumer struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Secret    string
+	// Keys maps keys of the Kubernetes Secret to keys of the rotated values,
+	// every rotated value is written under its own key when empty
+	Keys map[string]string
+}
+
+// Name identifies the webhook
+func (c GitHubWebhookConsumer) Name() string {
+	return fmt.Sprintf("github webhook %s/%s %s", c.Owner, c.Repository, c.URL)
+}
+
+// Apply sets the webhook secret
+func (c GitHubWebhookConsumer) Apply(ctx context.Context, values map[string]string) error {
+	secret, ok := values[c.SecretKey]
+	if !ok {
+		return fmt.Errorf("rotated values do not contain %s", c.SecretKey)
+	}
+
+	return c.Session.UpdateRepositoryWebhookSecret(c.Owner, c.Repository, c.URL, secret)
+}
+
+// Name identifies the Secret
+func (c KubernetesSecretConsumer) Name() string {
+	return fmt.Sprintf("kubernetes secret %s/%s", c.Namespace, c.Secret)
+}
+
+// Apply merges the values into the Secret, keeping keys that are not rotated
+func (c KubernetesSecretConsumer) Apply(ctx context.Context, values map[string]string) error {
+	data := make(map[string][]byte)
+	if len(c.Keys) == 0 {
+		for key, value := range values {
+			data[key] = []byte(value)
+		}
+	}
+	for secretKey, valueKey := range c.Keys {
+		value, ok := values[valueKey]
+		if !ok {
+			return fmt.Errorf("rotated values do not contain %s", valueKey)
+		}
+		data[secretKey] = []byte(value)
+	}
+
+	_, err := k8s.PatchSecret(ctx, c.Clientset, c.Namespace, c.Secret, data)
+	return err
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package rotation
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultRandomStringLength = 32
+	defaultWebhookSecretBytes = 32
+)
+
+// Generator produces the new values of a rotated secret, keyed by the keys of
+// the Vault secret they replace
+type Generator interface {
+	Generate() (map[string]string, error)
+}
+
+// RandomStringGenerator generates a random alphanumeric string, e.g. a password
+type RandomStringGenerator struct {
+	Key string
+	// Length of the string, defaults to 32
+	Length int
+}
+
+// SSHKeyPairGenerator generates an ed25519 SSH key pair, the private key in
+// OpenSSH format and the public key in authorized_keys format
+type SSHKeyPairGenerator struct {
+	PrivateKeyKey string
+	PublicKeyKey  string
+	// Comment added to the keys, e.g. kbot@kubefirst.io
+	Comment string
+}
+
+// WebhookSecretGenerator generates a hex encoded secret for signing webhooks
+type WebhookSecretGenerator struct {
+	Key string
+	// Bytes of randomness, defaults to 32
+	Bytes int
+}
+
+// Generate returns a new random string
+func (g RandomStringGenerator) Generate() (map[string]string, error) {
+	if g.Key == "" {
+		return nil, fmt.Errorf("random string generator requires a key")
+	}
+	length := g.Length
+	if length == 0 {
+		length = defaultRandomStringLength
+	}
+
+	value, err := vault.GeneratePassword(length)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{g.Key: value}, nil
+}
+
+// Generate returns a new SSH key pair
+func (g SSHKeyPairGenerator) Generate() (map[string]string, error) {
+	if g.PrivateKeyKey == "" || g.PublicKeyKey == "" {
+		return nil, fmt.Errorf("ssh key pair generator requires private and public key keys")
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ssh key pair: %s", err)
+	}
+
+	privateBlock, err := ssh.MarshalPrivateKey(privateKey, g.Comment)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding ssh private key: %s", err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding ssh public key: %s", err)
+	}
+	authorizedKey := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sshPublicKey)), "\n")
+	if g.Comment != "" {
+		authorizedKey = fmt.Sprintf("%s %s", authorizedKey, g.Comment)
+	}
+
+	return map[string]string{
+		g.PrivateKeyKey: string(pem.EncodeToMemory(privateBlock)),
+		g.PublicKeyKey:  authorizedKey,
+	}, nil
+}
+
+// Generate returns a new webhook secret
+func (g WebhookSecretGenerator) Generate() (map[string]string, error) {
+	if g.Key == "" {
+		return nil, fmt.Errorf("webhook secret generator requires a key")
+	}
+	size := g.Bytes
+	if size == 0 {
+		size = defaultWebhookSecretBytes
+	}
+
+	secret := make([]byte, size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("error generating webhook secret: %s", err)
+	}
+
+	return map[string]string{g.Key: hex.EncodeToString(secret)}, nil
+}
@@ -0,0 +1,281 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package rotation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/kubefirst/runtime/pkg/vault"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultCheckInterval = time.Minute
+
+// Secret is a rotatable secret stored in a Vault KV v2 mount
+type Secret struct {
+	Name string
+	// Mount of the KV v2 secrets engine, defaults to secret
+	Mount string
+	// Path of the secret in the mount, e.g. atlantis
+	Path      string
+	Generator Generator
+	// Consumers are updated in order after the new values are stored in Vault
+	Consumers []Consumer
+	// Interval between scheduled rotations, the secret is only rotated on
+	// demand when zero
+	Interval time.Duration
+}
+
+// Result describes a rotation
+type Result struct {
+	Secret string
+	// Version of the Vault secret holding the rotated values
+	Version int
+	// Consumers that were updated
+	Consumers []string
+	// RolledBack is set when a consumer failed and the rotation was undone, it
+	// is not set when the secret had no previous values to restore
+	RolledBack bool
+}
+
+// Error is returned when a rotation fails after the new values were stored,
+// RollbackErrors lists what could not be restored
+type Error struct {
+	Secret         string
+	Consumer       string
+	Err            error
+	RollbackErrors []error
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("rotation of %s failed updating %s: %s", e.Secret, e.Consumer, e.Err)
+	if len(e.RollbackErrors) > 0 {
+		rollbackErrors := make([]string, 0, len(e.RollbackErrors))
+		for _, err := range e.RollbackErrors {
+			rollbackErrors = append(rollbackErrors, err.Error())
+		}
+		message = fmt.Sprintf("%s, rollback incomplete: %s", message, strings.Join(rollbackErrors, "; "))
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Rotator rotates secrets in Vault and updates their consumers
+type Rotator struct {
+	vault   *vault.Client
+	secrets map[string]Secret
+	// CheckInterval is how often Run checks for secrets due for rotation,
+	// defaults to a minute
+	CheckInterval time.Duration
+
+	// locks serialize rotations of the same secret
+	locks map[string]*sync.Mutex
+}
+
+// NewRotator returns a Rotator for the secrets, the Vault client needs write
+// access to their paths
+func NewRotator(client *vault.Client, secrets ...Secret) (*Rotator, error) {
+	rotator := &Rotator{
+		vault:         client,
+		secrets:       make(map[string]Secret),
+		CheckInterval: defaultCheckInterval,
+		locks:         make(map[string]*sync.Mutex),
+	}
+	for _, secret := range secrets {
+		if secret.Name == "" || secret.Path == "" || secret.Generator == nil {
+			return nil, fmt.Errorf("rotatable secrets require a name, path and generator")
+		}
+		if _, exists := rotator.secrets[secret.Name]; exists {
+			return nil, fmt.Errorf("rotatable secret %s is declared twice", secret.Name)
+		}
+		if secret.Mount == "" {
+			secret.Mount = "secret"
+		}
+		rotator.secrets[secret.Name] = secret
+		rotator.locks[secret.Name] = &sync.Mutex{}
+	}
+
+	return rotator, nil
+}
+
+// Rotate generates new values for a secret, stores them in Vault and updates
+// every consumer
+//
+// When a consumer fails the previous Vault version is restored and consumers
+// that were already updated, including the failing one, are given the previous
+// values again. A secret without previous values keeps the rotated version in
+// Vault, so consumers that were updated still match it. An *Error is returned
+// in both cases
+func (r *Rotator) Rotate(ctx context.Context, name string) (*Result, error) {
+	secret, ok := r.secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rotatable secret %s", name)
+	}
+
+	lock := r.locks[name]
+	lock.Lock()
+	defer lock.Unlock()
+
+	kv := r.vault.API().KVv2(secret.Mount)
+	previousVersion := 0
+	previous := make(map[string]interface{})
+	current, err := kv.Get(ctx, secret.Path)
+	if err != nil && !errors.Is(err, vaultapi.ErrSecretNotFound) {
+		return nil, fmt.Errorf("error reading %s/%s: %s", secret.Mount, secret.Path, err)
+	}
+	if err == nil {
+		previousVersion = current.VersionMetadata.Version
+		previous = current.Data
+	}
+
+	generated, err := secret.Generator.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("error generating values for %s: %s", name, err)
+	}
+
+	// keys that are not rotated are carried over to the new version
+	data := make(map[string]interface{}, len(previous)+len(generated))
+	for key, value := range previous {
+		data[key] = value
+	}
+	for key, value := range generated {
+		data[key] = value
+	}
+
+	written, err := kv.Put(ctx, secret.Path, data)
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s/%s: %s", secret.Mount, secret.Path, err)
+	}
+	result := &Result{Secret: name, Version: written.VersionMetadata.Version}
+	log.Info().Msgf("stored rotated values of %s in %s/%s version %d", name, secret.Mount, secret.Path, result.Version)
+
+	values := stringValues(data)
+	for i, consumer := range secret.Consumers {
+		err = consumer.Apply(ctx, values)
+		if err == nil {
+			result.Consumers = append(result.Consumers, consumer.Name())
+			log.Info().Msgf("updated %s with rotated %s", consumer.Name(), name)
+			continue
+		}
+
+		log.Error().Msgf("error updating %s with rotated %s, rolling back: %s", consumer.Name(), name, err)
+		rotationErr := &Error{Secret: name, Consumer: consumer.Name(), Err: err}
+		if previousVersion == 0 {
+			// there is nothing to restore the consumers to, deleting the new
+			// version would leave the updated consumers with values that exist
+			// nowhere in Vault
+			log.Warn().Msgf("%s had no previous values, keeping %s/%s version %d", name, secret.Mount, secret.Path, result.Version)
+			rotationErr.RollbackErrors = []error{fmt.Errorf("%s had no previous values to restore, the rotated values were kept in %s/%s version %d", name, secret.Mount, secret.Path, result.Version)}
+			return result, rotationErr
+		}
+		rotationErr.RollbackErrors = r.rollback(ctx, secret, secret.Consumers[:i+1], previousVersion, stringValues(previous))
+		result.RolledBack = true
+
+		return result, rotationErr
+	}
+	log.Info().Msgf("rotated %s", name)
+
+	return result, nil
+}
+
+// Run rotates secrets with an interval whenever their Vault secret is older
+// than the interval, until ctx is cancelled
+//
+// The age is read from Vault so the schedule survives restarts. Failed
+// rotations are logged and retried at the next check
+func (r *Rotator) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for name, secret := range r.secrets {
+			if secret.Interval == 0 {
+				continue
+			}
+			due, err := r.due(ctx, secret)
+			if err != nil {
+				log.Error().Msgf("error checking rotation of %s: %s", name, err)
+				continue
+			}
+			if !due {
+				continue
+			}
+			_, err = r.Rotate(ctx, name)
+			if err != nil {
+				log.Error().Msgf("scheduled rotation failed: %s", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// due reports whether the secret was last written longer than its interval ago
+func (r *Rotator) due(ctx context.Context, secret Secret) (bool, error) {
+	metadata, err := r.vault.API().KVv2(secret.Mount).GetMetadata(ctx, secret.Path)
+	if err != nil {
+		if errors.Is(err, vaultapi.ErrSecretNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return time.Since(metadata.UpdatedTime) >= secret.Interval, nil
+}
+
+// rollback restores the previous Vault version and gives the consumers the
+// previous values again, returning what could not be restored
+func (r *Rotator) rollback(ctx context.Context, secret Secret, consumers []Consumer, previousVersion int, previous map[string]string) []error {
+	rollbackErrors := make([]error, 0)
+	kv := r.vault.API().KVv2(secret.Mount)
+
+	_, err := kv.Rollback(ctx, secret.Path, previousVersion)
+	if err != nil {
+		rollbackErrors = append(rollbackErrors, fmt.Errorf("error restoring %s/%s version %d: %s", secret.Mount, secret.Path, previousVersion, err))
+	} else {
+		log.Info().Msgf("restored %s/%s version %d", secret.Mount, secret.Path, previousVersion)
+	}
+
+	for i := len(consumers) - 1; i >= 0; i-- {
+		err := consumers[i].Apply(ctx, previous)
+		if err != nil {
+			rollbackErrors = append(rollbackErrors, fmt.Errorf("error restoring %s: %s", consumers[i].Name(), err))
+			continue
+		}
+		log.Info().Msgf("restored previous %s on %s", secret.Name, consumers[i].Name())
+	}
+
+	return rollbackErrors
+}
+
+// stringValues converts Vault secret data to strings, values that are not
+// strings are formatted with %v
+func stringValues(data map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			values[key] = s
+			continue
+		}
+		values[key] = fmt.Sprintf("%v", value)
+	}
+
+	return values
+}
@@ -0,0 +1,312 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package rotation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg/vault"
+)
+
+// testKVv2 is a KV v2 mount named secret that keeps every version of each path
+type testKVv2 struct {
+	mu       sync.Mutex
+	versions map[string][]map[string]interface{}
+	deleted  map[string]bool
+}
+
+func newTestVault(t *testing.T, existing map[string]map[string]interface{}) (*testKVv2, *vault.Client) {
+	kv := &testKVv2{versions: map[string][]map[string]interface{}{}, deleted: map[string]bool{}}
+	for path, data := range existing {
+		kv.versions[path] = []map[string]interface{}{data}
+	}
+	server := httptest.NewServer(kv)
+	t.Cleanup(server.Close)
+
+	client, err := vault.NewClient(context.Background(), vault.ClientConfig{Address: server.URL, Token: "token", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kv, client
+}
+
+func (kv *testKVv2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+	if path == r.URL.Path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	versions := kv.versions[path]
+
+	switch r.Method {
+	case http.MethodGet:
+		version := len(versions)
+		if requested := r.URL.Query().Get("version"); requested != "" {
+			version, _ = strconv.Atoi(requested)
+		} else if kv.deleted[path] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if version == 0 || version > len(versions) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"data": versions[version-1],
+			"metadata": map[string]interface{}{
+				"version":       version,
+				"created_time":  time.Now().Format(time.RFC3339),
+				"deletion_time": "",
+				"destroyed":     false,
+			},
+		}})
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]interface{} `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if cas, ok := body.Options["cas"].(float64); ok && int(cas) != len(versions) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		kv.versions[path] = append(versions, body.Data)
+		delete(kv.deleted, path)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"version":      len(kv.versions[path]),
+			"created_time": time.Now().Format(time.RFC3339),
+		}})
+	case http.MethodDelete:
+		kv.deleted[path] = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// latest returns the current data of a path, nil when it is deleted
+func (kv *testKVv2) latest(path string) map[string]interface{} {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	versions := kv.versions[path]
+	if len(versions) == 0 || kv.deleted[path] {
+		return nil
+	}
+
+	return versions[len(versions)-1]
+}
+
+type testGenerator map[string]string
+
+func (g testGenerator) Generate() (map[string]string, error) {
+	return g, nil
+}
+
+// testConsumer records the values applied to it and fails when failOn is
+// applied
+type testConsumer struct {
+	name    string
+	failOn  string
+	applied []map[string]string
+	// block delays Apply until it is closed
+	block chan struct{}
+}
+
+func (c *testConsumer) Name() string {
+	return c.name
+}
+
+func (c *testConsumer) Apply(ctx context.Context, values map[string]string) error {
+	if c.block != nil {
+		select {
+		case <-c.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.failOn != "" && values["token"] == c.failOn {
+		return fmt.Errorf("%s rejected the token", c.name)
+	}
+	c.applied = append(c.applied, values)
+
+	return nil
+}
+
+func (c *testConsumer) current() string {
+	if len(c.applied) == 0 {
+		return ""
+	}
+	return c.applied[len(c.applied)-1]["token"]
+}
+
+func TestRotate(t *testing.T) {
+	kv, client := newTestVault(t, map[string]map[string]interface{}{
+		"atlantis": {"token": "old", "username": "kbot"},
+	})
+	webhook := &testConsumer{name: "webhook"}
+	k8sSecret := &testConsumer{name: "secret"}
+
+	rotator, err := NewRotator(client, Secret{
+		Name:      "atlantis",
+		Path:      "atlantis",
+		Generator: testGenerator{"token": "new"},
+		Consumers: []Consumer{webhook, k8sSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rotator.Rotate(context.Background(), "atlantis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Version != 2 || result.RolledBack {
+		t.Errorf("expected version 2 without a rollback, got %+v", result)
+	}
+	if strings.Join(result.Consumers, ",") != "webhook,secret" {
+		t.Errorf("expected both consumers to be updated, got %v", result.Consumers)
+	}
+
+	latest := kv.latest("atlantis")
+	if latest["token"] != "new" || latest["username"] != "kbot" {
+		t.Errorf("expected the rotated token with other keys kept, got %v", latest)
+	}
+	for _, consumer := range []*testConsumer{webhook, k8sSecret} {
+		if consumer.current() != "new" || consumer.applied[0]["username"] != "kbot" {
+			t.Errorf("expected %s to have the rotated values, got %v", consumer.name, consumer.applied)
+		}
+	}
+
+	_, err = rotator.Rotate(context.Background(), "missing")
+	if err == nil {
+		t.Error("expected an error rotating an unknown secret")
+	}
+}
+
+func TestRotateRollsBackWhenAConsumerFails(t *testing.T) {
+	kv, client := newTestVault(t, map[string]map[string]interface{}{
+		"atlantis": {"token": "old"},
+	})
+	webhook := &testConsumer{name: "webhook"}
+	k8sSecret := &testConsumer{name: "secret", failOn: "new"}
+	notReached := &testConsumer{name: "not-reached"}
+
+	rotator, err := NewRotator(client, Secret{
+		Name:      "atlantis",
+		Path:      "atlantis",
+		Generator: testGenerator{"token": "new"},
+		Consumers: []Consumer{webhook, k8sSecret, notReached},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rotator.Rotate(context.Background(), "atlantis")
+	var rotationErr *Error
+	if !errors.As(err, &rotationErr) {
+		t.Fatalf("expected a rotation error, got %v", err)
+	}
+	if rotationErr.Consumer != "secret" || len(rotationErr.RollbackErrors) != 0 {
+		t.Errorf("expected the secret consumer to fail with a complete rollback, got %s", rotationErr)
+	}
+	if !result.RolledBack {
+		t.Error("expected the rotation to be rolled back")
+	}
+
+	if latest := kv.latest("atlantis"); latest["token"] != "old" {
+		t.Errorf("expected the previous token to be restored in vault, got %v", latest)
+	}
+	if webhook.current() != "old" || k8sSecret.current() != "old" {
+		t.Errorf("expected consumers to have the previous token, got %s and %s", webhook.current(), k8sSecret.current())
+	}
+	if len(notReached.applied) != 0 {
+		t.Errorf("expected consumers after the failure not to be updated, got %v", notReached.applied)
+	}
+}
+
+func TestRotateKeepsValuesWithoutAPreviousVersion(t *testing.T) {
+	kv, client := newTestVault(t, nil)
+	webhook := &testConsumer{name: "webhook"}
+	k8sSecret := &testConsumer{name: "secret", failOn: "new"}
+
+	rotator, err := NewRotator(client, Secret{
+		Name:      "atlantis",
+		Path:      "atlantis",
+		Generator: testGenerator{"token": "new"},
+		Consumers: []Consumer{webhook, k8sSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rotator.Rotate(context.Background(), "atlantis")
+	var rotationErr *Error
+	if !errors.As(err, &rotationErr) {
+		t.Fatalf("expected a rotation error, got %v", err)
+	}
+	if len(rotationErr.RollbackErrors) == 0 {
+		t.Error("expected the error to report that nothing could be restored")
+	}
+	if result.RolledBack {
+		t.Error("expected the rotation not to be reported as rolled back")
+	}
+
+	if latest := kv.latest("atlantis"); latest["token"] != "new" {
+		t.Errorf("expected the rotated token to be kept in vault, got %v", latest)
+	}
+	if webhook.current() != "new" {
+		t.Errorf("expected the updated consumer to match vault, got %s", webhook.current())
+	}
+}
+
+func TestRotateLocksPerSecret(t *testing.T) {
+	_, client := newTestVault(t, nil)
+	blocked := &testConsumer{name: "blocked", block: make(chan struct{})}
+
+	rotator, err := NewRotator(client,
+		Secret{Name: "atlantis", Path: "atlantis", Generator: testGenerator{"token": "a"}, Consumers: []Consumer{blocked}},
+		Secret{Name: "chartmuseum", Path: "chartmuseum", Generator: testGenerator{"token": "b"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := rotator.Rotate(ctx, "atlantis")
+		done <- err
+	}()
+
+	// the atlantis rotation is blocked in its consumer and holds its lock
+	time.Sleep(50 * time.Millisecond)
+	_, err = rotator.Rotate(ctx, "chartmuseum")
+	if err != nil {
+		t.Fatalf("expected another secret to rotate while atlantis is rotating, got %s", err)
+	}
+
+	close(blocked.block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
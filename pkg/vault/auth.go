@@ -0,0 +1,365 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultKubernetesAuthPath = "kubernetes"
+	defaultKubernetesHost     = "https://kubernetes.default.svc"
+	defaultReviewerName       = "vault"
+	defaultOIDCAuthPath       = "oidc"
+	reviewerTokenTimeout      = 30 * time.Second
+)
+
+// KubernetesAuthOptions configures the Kubernetes auth method
+type KubernetesAuthOptions struct {
+	// Path the auth method is mounted at, defaults to kubernetes
+	Path string
+	// KubernetesHost is the API server address as seen from Vault, defaults to
+	// the in cluster service
+	KubernetesHost string
+	// Namespace of the token reviewer ServiceAccount, defaults to vault
+	Namespace string
+	// ReviewerServiceAccount is bound to system:auth-delegator so Vault can
+	// review ServiceAccount tokens, defaults to vault
+	ReviewerServiceAccount string
+}
+
+// KubernetesAuthRole binds Kubernetes ServiceAccounts to Vault policies
+type KubernetesAuthRole struct {
+	Name                     string
+	ServiceAccountNames      []string
+	ServiceAccountNamespaces []string
+	Policies                 []string
+	// TTL of issued tokens, Vault's default when zero
+	TTL time.Duration
+}
+
+// OIDCAuthOptions configures the OIDC auth method
+type OIDCAuthOptions struct {
+	// Path the auth method is mounted at, defaults to oidc
+	Path         string
+	DiscoveryURL string
+	ClientID     string
+	ClientSecret string
+	// DiscoveryCA is a PEM encoded CA bundle for the discovery URL
+	DiscoveryCA string
+	// DefaultRole is used when a login does not name a role
+	DefaultRole string
+}
+
+// OIDCRole maps OIDC logins to Vault policies
+type OIDCRole struct {
+	Name                string
+	AllowedRedirectURIs []string
+	// UserClaim identifies the user, defaults to sub
+	UserClaim string
+	// GroupsClaim lists the groups of the user, defaults to groups
+	GroupsClaim string
+	// Scopes requested in addition to openid
+	Scopes      []string
+	BoundClaims map[string]string
+	Policies    []string
+	// TTL of issued tokens, Vault's default when zero
+	TTL time.Duration
+}
+
+// OIDCGroupMapping grants the members of an OIDC group Vault policies through
+// an external identity group
+type OIDCGroupMapping struct {
+	// Group as it appears in the groups claim
+	Group    string
+	Policies []string
+}
+
+// EnableKubernetesAuth enables and configures the Kubernetes auth method
+//
+// The cluster CA is read from the kube-root-ca.crt ConfigMap and a long lived
+// token is created for the reviewer ServiceAccount, which is bound to
+// system:auth-delegator. It is safe to call repeatedly
+func (c *Client) EnableKubernetesAuth(ctx context.Context, clientset kubernetes.Interface, opts KubernetesAuthOptions) error {
+	if opts.Path == "" {
+		opts.Path = defaultKubernetesAuthPath
+	}
+	if opts.KubernetesHost == "" {
+		opts.KubernetesHost = defaultKubernetesHost
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = VaultNamespace
+	}
+	if opts.ReviewerServiceAccount == "" {
+		opts.ReviewerServiceAccount = defaultReviewerName
+	}
+
+	caConfigMap, err := clientset.CoreV1().ConfigMaps(opts.Namespace).Get(ctx, "kube-root-ca.crt", metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading cluster ca: %s", err)
+	}
+
+	reviewerJWT, err := ensureTokenReviewer(ctx, clientset, opts.Namespace, opts.ReviewerServiceAccount)
+	if err != nil {
+		return fmt.Errorf("error creating token reviewer %s: %s", opts.ReviewerServiceAccount, err)
+	}
+
+	err = c.enableAuthMethod(ctx, opts.Path, "kubernetes")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/config", opts.Path), map[string]interface{}{
+		"kubernetes_host":    opts.KubernetesHost,
+		"kubernetes_ca_cert": caConfigMap.Data["ca.crt"],
+		"token_reviewer_jwt": reviewerJWT,
+	})
+	if err != nil {
+		return fmt.Errorf("error configuring kubernetes auth at %s: %s", opts.Path, err)
+	}
+	log.Info().Msgf("configured vault kubernetes auth at auth/%s", opts.Path)
+
+	return nil
+}
+
+// WriteKubernetesAuthRole creates or updates a role of the Kubernetes auth
+// method mounted at path
+func (c *Client) WriteKubernetesAuthRole(ctx context.Context, path string, role KubernetesAuthRole) error {
+	if path == "" {
+		path = defaultKubernetesAuthPath
+	}
+	if role.Name == "" || len(role.ServiceAccountNames) == 0 || len(role.ServiceAccountNamespaces) == 0 {
+		return fmt.Errorf("kubernetes auth role requires a name, service account names and namespaces")
+	}
+
+	data := map[string]interface{}{
+		"bound_service_account_names":      role.ServiceAccountNames,
+		"bound_service_account_namespaces": role.ServiceAccountNamespaces,
+		"token_policies":                   role.Policies,
+	}
+	if role.TTL > 0 {
+		data["token_ttl"] = int(role.TTL.Seconds())
+	}
+
+	_, err := c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/role/%s", path, role.Name), data)
+	if err != nil {
+		return fmt.Errorf("error writing kubernetes auth role %s: %s", role.Name, err)
+	}
+	log.Info().Msgf("wrote vault kubernetes auth role %s", role.Name)
+
+	return nil
+}
+
+// EnableOIDCAuth enables and configures the OIDC auth method, it is safe to
+// call repeatedly
+func (c *Client) EnableOIDCAuth(ctx context.Context, opts OIDCAuthOptions) error {
+	if opts.Path == "" {
+		opts.Path = defaultOIDCAuthPath
+	}
+	if opts.DiscoveryURL == "" || opts.ClientID == "" {
+		return fmt.Errorf("oidc auth requires a discovery url and client id")
+	}
+
+	err := c.enableAuthMethod(ctx, opts.Path, "oidc")
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"oidc_discovery_url": opts.DiscoveryURL,
+		"oidc_client_id":     opts.ClientID,
+		"oidc_client_secret": opts.ClientSecret,
+	}
+	if opts.DiscoveryCA != "" {
+		data["oidc_discovery_ca_pem"] = opts.DiscoveryCA
+	}
+	if opts.DefaultRole != "" {
+		data["default_role"] = opts.DefaultRole
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/config", opts.Path), data)
+	if err != nil {
+		return fmt.Errorf("error configuring oidc auth at %s: %s", opts.Path, err)
+	}
+	log.Info().Msgf("configured vault oidc auth at auth/%s", opts.Path)
+
+	return nil
+}
+
+// WriteOIDCRole creates or updates a role of the OIDC auth method mounted at
+// path
+func (c *Client) WriteOIDCRole(ctx context.Context, path string, role OIDCRole) error {
+	if path == "" {
+		path = defaultOIDCAuthPath
+	}
+	if role.Name == "" || len(role.AllowedRedirectURIs) == 0 {
+		return fmt.Errorf("oidc role requires a name and allowed redirect uris")
+	}
+	if role.UserClaim == "" {
+		role.UserClaim = "sub"
+	}
+	if role.GroupsClaim == "" {
+		role.GroupsClaim = "groups"
+	}
+
+	data := map[string]interface{}{
+		"role_type":             "oidc",
+		"allowed_redirect_uris": role.AllowedRedirectURIs,
+		"user_claim":            role.UserClaim,
+		"groups_claim":          role.GroupsClaim,
+		"token_policies":        role.Policies,
+	}
+	if len(role.Scopes) > 0 {
+		data["oidc_scopes"] = role.Scopes
+	}
+	if len(role.BoundClaims) > 0 {
+		data["bound_claims"] = role.BoundClaims
+	}
+	if role.TTL > 0 {
+		data["token_ttl"] = int(role.TTL.Seconds())
+	}
+
+	_, err := c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/role/%s", path, role.Name), data)
+	if err != nil {
+		return fmt.Errorf("error writing oidc role %s: %s", role.Name, err)
+	}
+	log.Info().Msgf("wrote vault oidc role %s", role.Name)
+
+	return nil
+}
+
+// MapOIDCGroup creates an external identity group for an OIDC group with the
+// policies of the mapping and aliases it to the OIDC auth method mounted at
+// path, members of the OIDC group receive the policies when they log in
+func (c *Client) MapOIDCGroup(ctx context.Context, path string, mapping OIDCGroupMapping) error {
+	if path == "" {
+		path = defaultOIDCAuthPath
+	}
+	if mapping.Group == "" {
+		return fmt.Errorf("oidc group mapping requires a group")
+	}
+
+	accessor, err := c.authMountAccessor(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("identity/group/name/%s", mapping.Group), map[string]interface{}{
+		"type":     "external",
+		"policies": mapping.Policies,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing identity group %s: %s", mapping.Group, err)
+	}
+
+	group, err := c.api.Logical().ReadWithContext(ctx, fmt.Sprintf("identity/group/name/%s", mapping.Group))
+	if err != nil || group == nil {
+		return fmt.Errorf("error reading identity group %s: %v", mapping.Group, err)
+	}
+	groupID, _ := group.Data["id"].(string)
+
+	// an external group has at most one alias, keep it when it already points
+	// at this auth method
+	if alias, ok := group.Data["alias"].(map[string]interface{}); ok && len(alias) > 0 {
+		if alias["mount_accessor"] == accessor && alias["name"] == mapping.Group {
+			return nil
+		}
+		aliasID, _ := alias["id"].(string)
+		_, err = c.api.Logical().DeleteWithContext(ctx, fmt.Sprintf("identity/group-alias/id/%s", aliasID))
+		if err != nil {
+			return fmt.Errorf("error removing stale alias of identity group %s: %s", mapping.Group, err)
+		}
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, "identity/group-alias", map[string]interface{}{
+		"name":           mapping.Group,
+		"mount_accessor": accessor,
+		"canonical_id":   groupID,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing alias of identity group %s: %s", mapping.Group, err)
+	}
+	log.Info().Msgf("mapped oidc group %s to vault policies %s", mapping.Group, strings.Join(mapping.Policies, ", "))
+
+	return nil
+}
+
+// enableAuthMethod mounts an auth method at path unless one is already mounted
+func (c *Client) enableAuthMethod(ctx context.Context, path string, methodType string) error {
+	mounts, err := c.api.Sys().ListAuthWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing vault auth methods: %s", err)
+	}
+	if mount, ok := mounts[path+"/"]; ok {
+		if mount.Type != methodType {
+			return fmt.Errorf("auth method %s is already mounted at %s", mount.Type, path)
+		}
+		return nil
+	}
+
+	err = c.api.Sys().EnableAuthWithOptionsWithContext(ctx, path, &vaultapi.EnableAuthOptions{Type: methodType})
+	if err != nil {
+		return fmt.Errorf("error enabling %s auth at %s: %s", methodType, path, err)
+	}
+	log.Info().Msgf("enabled vault %s auth at auth/%s", methodType, path)
+
+	return nil
+}
+
+// authMountAccessor returns the accessor of the auth method mounted at path
+func (c *Client) authMountAccessor(ctx context.Context, path string) (string, error) {
+	mounts, err := c.api.Sys().ListAuthWithContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error listing vault auth methods: %s", err)
+	}
+	mount, ok := mounts[path+"/"]
+	if !ok {
+		return "", fmt.Errorf("no auth method is mounted at %s", path)
+	}
+
+	return mount.Accessor, nil
+}
+
+// ensureTokenReviewer creates a ServiceAccount bound to system:auth-delegator
+// with a long lived token and returns the token
+func ensureTokenReviewer(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (string, error) {
+	_, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating service account: %s", err)
+	}
+
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-auth-delegator", name)},
+		Subjects: []rbacv1.Subject{
+			{Kind: "ServiceAccount", Name: name, Namespace: namespace},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     "system:auth-delegator",
+		},
+	}, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating cluster role binding: %s", err)
+	}
+
+	return k8s.EnsureServiceAccountToken(ctx, clientset, namespace, name, fmt.Sprintf("%s-token", name), reviewerTokenTimeout)
+}
@@ -6,23 +6,27 @@ See the LICENSE file for more details.
 package vault
 
 import (
+	"context"
+
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog/log"
 )
 
 func (conf *VaultConfiguration) AutoUnseal() (*vaultapi.InitResponse, error) {
-	vaultClient, err := vaultapi.NewClient(&vaultapi.Config{
-		Address: VaultDefaultAddress,
-	})
+	ctx := context.Background()
+	vaultClient, err := conf.newClient(ctx, VaultDefaultAddress, "")
 	if err != nil {
 		return &vaultapi.InitResponse{}, err
 	}
-	vaultClient.CloneConfig().ConfigureTLS(&vaultapi.TLSConfig{
-		Insecure: true,
-	})
-	log.Info().Msg("created vault client, initializing vault with auto unseal")
+	log.Info().Msg("initializing vault with auto unseal")
+
+	return vaultClient.AutoUnseal(ctx)
+}
 
-	initResponse, err := vaultClient.Sys().Init(&vaultapi.InitRequest{
+// AutoUnseal initializes a Vault configured with an auto unseal mechanism,
+// which only produces recovery keys
+func (c *Client) AutoUnseal(ctx context.Context) (*vaultapi.InitResponse, error) {
+	initResponse, err := c.api.Sys().InitWithContext(ctx, &vaultapi.InitRequest{
 		RecoveryShares:    RecoveryShares,
 		RecoveryThreshold: RecoveryThreshold,
 		SecretShares:      SecretShares,
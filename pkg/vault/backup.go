@@ -0,0 +1,336 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// SnapshotExtension is the file extension of encrypted Vault snapshots
+	SnapshotExtension = ".snap.enc"
+
+	// snapshotMagic prefixes encrypted snapshots and versions the format
+	snapshotMagic     = "K1VSNAP1"
+	snapshotSaltSize  = 16
+	snapshotKeyLength = 32
+)
+
+// SnapshotInfo describes a stored Vault snapshot
+type SnapshotInfo struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// SnapshotStorage stores encrypted Vault snapshots
+type SnapshotStorage interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	List(ctx context.Context) ([]SnapshotInfo, error)
+}
+
+// LocalSnapshotStorage stores snapshots in a local directory
+type LocalSnapshotStorage struct {
+	Dir string
+}
+
+// BucketSnapshotStorage stores snapshots in an S3 compatible bucket, such as
+// the in cluster minio, DigitalOcean Spaces or Vultr object storage
+type BucketSnapshotStorage struct {
+	// Endpoint of the object storage without a scheme, e.g. minio.example.com
+	Endpoint        string
+	AccessKey       string
+	SecretAccessKey string
+	Bucket          string
+	// Prefix of the object names, e.g. vault/
+	Prefix string
+	Secure bool
+}
+
+// BackupOptions configures BackupSnapshot
+type BackupOptions struct {
+	Storage SnapshotStorage
+	// Passphrase the snapshot is encrypted with
+	Passphrase string
+	// Name of the snapshot, defaults to vault-<timestamp>.snap.enc
+	Name string
+}
+
+// RestoreOptions configures RestoreSnapshot
+type RestoreOptions struct {
+	Storage    SnapshotStorage
+	Passphrase string
+	Name       string
+	// Force restores a snapshot taken from a different Vault, which is required
+	// when restoring into a freshly initialized Vault
+	Force bool
+}
+
+// BackupSnapshot takes a raft snapshot of Vault, encrypts it with the
+// passphrase and writes it to the storage
+//
+// The client must use a token allowed to read sys/storage/raft/snapshot, such
+// as the root token
+func (c *Client) BackupSnapshot(ctx context.Context, opts BackupOptions) (*SnapshotInfo, error) {
+	if opts.Storage == nil || opts.Passphrase == "" {
+		return nil, fmt.Errorf("snapshot storage and passphrase are required")
+	}
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("vault-%s%s", time.Now().UTC().Format("20060102-150405"), SnapshotExtension)
+	}
+
+	var snapshot bytes.Buffer
+	err := c.api.Sys().RaftSnapshotWithContext(ctx, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error taking vault raft snapshot: %s", err)
+	}
+
+	encrypted, err := encryptSnapshot(snapshot.Bytes(), opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Storage.Put(ctx, opts.Name, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("error storing vault snapshot %s: %s", opts.Name, err)
+	}
+	log.Info().Msgf("saved vault snapshot %s (%d bytes)", opts.Name, len(encrypted))
+
+	return &SnapshotInfo{Name: opts.Name, Size: int64(len(encrypted)), Created: time.Now().UTC()}, nil
+}
+
+// RestoreSnapshot decrypts a stored snapshot and restores it into Vault
+//
+// After restoring into a fresh Vault with Force, the Vault is sealed with the
+// keys and root token of the Vault the snapshot was taken from, so those have
+// to be available to unseal it
+func (c *Client) RestoreSnapshot(ctx context.Context, opts RestoreOptions) error {
+	if opts.Storage == nil || opts.Passphrase == "" || opts.Name == "" {
+		return fmt.Errorf("snapshot storage, passphrase and name are required")
+	}
+
+	encrypted, err := opts.Storage.Get(ctx, opts.Name)
+	if err != nil {
+		return fmt.Errorf("error reading vault snapshot %s: %s", opts.Name, err)
+	}
+
+	snapshot, err := decryptSnapshot(encrypted, opts.Passphrase)
+	if err != nil {
+		return fmt.Errorf("error decrypting vault snapshot %s: %s", opts.Name, err)
+	}
+
+	err = c.api.Sys().RaftSnapshotRestoreWithContext(ctx, bytes.NewReader(snapshot), opts.Force)
+	if err != nil {
+		return fmt.Errorf("error restoring vault snapshot %s: %s", opts.Name, err)
+	}
+	log.Info().Msgf("restored vault snapshot %s", opts.Name)
+
+	return nil
+}
+
+// ListSnapshots returns the snapshots in the storage, newest first
+func ListSnapshots(ctx context.Context, storage SnapshotStorage) ([]SnapshotInfo, error) {
+	snapshots, err := storage.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing vault snapshots: %s", err)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+
+	return snapshots, nil
+}
+
+// Put writes a snapshot to the directory, readable only by the owner
+func (s LocalSnapshotStorage) Put(ctx context.Context, name string, data []byte) error {
+	err := os.MkdirAll(s.Dir, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating directory %s: %s", s.Dir, err)
+	}
+
+	return os.WriteFile(filepath.Join(s.Dir, filepath.Base(name)), data, 0600)
+}
+
+// Get reads a snapshot from the directory
+func (s LocalSnapshotStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+// List returns the snapshots in the directory
+func (s LocalSnapshotStorage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []SnapshotInfo{}, nil
+		}
+		return nil, err
+	}
+
+	snapshots := make([]SnapshotInfo, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SnapshotExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotInfo{Name: entry.Name(), Size: info.Size(), Created: info.ModTime()})
+	}
+
+	return snapshots, nil
+}
+
+// Put uploads a snapshot to the bucket
+func (s BucketSnapshotStorage) Put(ctx context.Context, name string, data []byte) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutObject(ctx, s.Bucket, s.Prefix+name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+// Get downloads a snapshot from the bucket
+func (s BucketSnapshotStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := client.GetObject(ctx, s.Bucket, s.Prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+// List returns the snapshots in the bucket below the prefix
+func (s BucketSnapshotStorage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]SnapshotInfo, 0)
+	for object := range client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.Prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if !strings.HasSuffix(object.Key, SnapshotExtension) {
+			continue
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:    strings.TrimPrefix(object.Key, s.Prefix),
+			Size:    object.Size,
+			Created: object.LastModified,
+		})
+	}
+
+	return snapshots, nil
+}
+
+func (s BucketSnapshotStorage) client() (*minio.Client, error) {
+	client, err := minio.New(s.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s.AccessKey, s.SecretAccessKey, ""),
+		Secure: s.Secure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing minio client for %s: %s", s.Endpoint, err)
+	}
+
+	return client, nil
+}
+
+// encryptSnapshot encrypts a snapshot with AES-256-GCM using a key derived
+// from the passphrase with scrypt, the salt and nonce are stored in the output
+func encryptSnapshot(snapshot []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, snapshotSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := snapshotCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]byte, 0, len(snapshotMagic)+len(salt)+len(nonce)+len(snapshot)+gcm.Overhead())
+	output = append(output, snapshotMagic...)
+	output = append(output, salt...)
+	output = append(output, nonce...)
+
+	return gcm.Seal(output, nonce, snapshot, []byte(snapshotMagic)), nil
+}
+
+// decryptSnapshot reverses encryptSnapshot
+func decryptSnapshot(encrypted []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(encrypted, []byte(snapshotMagic)) {
+		return nil, fmt.Errorf("not an encrypted vault snapshot")
+	}
+	encrypted = encrypted[len(snapshotMagic):]
+	if len(encrypted) < snapshotSaltSize {
+		return nil, fmt.Errorf("snapshot is truncated")
+	}
+
+	gcm, err := snapshotCipher(passphrase, encrypted[:snapshotSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	encrypted = encrypted[snapshotSaltSize:]
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, fmt.Errorf("snapshot is truncated")
+	}
+
+	snapshot, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], []byte(snapshotMagic))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted snapshot")
+	}
+
+	return snapshot, nil
+}
+
+func snapshotCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, snapshotKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptSnapshot(t *testing.T) {
+	snapshot := []byte("raft snapshot contents")
+	encrypted, err := encryptSnapshot(snapshot, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encrypted, []byte(snapshotMagic)) {
+		t.Errorf("expected the snapshot to start with %s", snapshotMagic)
+	}
+	if bytes.Contains(encrypted, snapshot) {
+		t.Error("expected the snapshot to be encrypted")
+	}
+
+	again, err := encryptSnapshot(snapshot, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encrypted, again) {
+		t.Error("expected a new salt and nonce for every snapshot")
+	}
+
+	decrypted, err := decryptSnapshot(encrypted, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, snapshot) {
+		t.Errorf("expected %q, got %q", snapshot, decrypted)
+	}
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		encrypted  []byte
+		passphrase string
+		err        string
+	}{
+		{name: "wrong passphrase", encrypted: encrypted, passphrase: "wrong", err: "wrong passphrase"},
+		{name: "tampered", encrypted: tampered, passphrase: "passphrase", err: "wrong passphrase"},
+		{name: "bad magic", encrypted: append([]byte("K1VSNAP0"), encrypted[len(snapshotMagic):]...), passphrase: "passphrase", err: "not an encrypted vault snapshot"},
+		{name: "empty", encrypted: []byte{}, passphrase: "passphrase", err: "not an encrypted vault snapshot"},
+		{name: "truncated salt", encrypted: encrypted[:len(snapshotMagic)+snapshotSaltSize-1], passphrase: "passphrase", err: "truncated"},
+		{name: "truncated nonce", encrypted: encrypted[:len(snapshotMagic)+snapshotSaltSize+4], passphrase: "passphrase", err: "truncated"},
+		{name: "truncated ciphertext", encrypted: encrypted[:len(encrypted)-4], passphrase: "passphrase", err: "wrong passphrase"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decryptSnapshot(tt.encrypted, tt.passphrase)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLocalSnapshotStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := LocalSnapshotStorage{Dir: filepath.Join(t.TempDir(), "snapshots")}
+
+	snapshots, err := ListSnapshots(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Errorf("expected no snapshots before the directory exists, got %v", snapshots)
+	}
+
+	now := time.Now()
+	created := map[string]time.Time{
+		"vault-a" + SnapshotExtension: now.Add(-2 * time.Hour),
+		"vault-b" + SnapshotExtension: now,
+		"vault-c" + SnapshotExtension: now.Add(-time.Hour),
+	}
+	for name, modTime := range created {
+		err = storage.Put(ctx, name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filepath.Join(storage.Dir, name), modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// names are reduced to their base so nothing is written outside the directory
+	err = storage.Put(ctx, "../vault-d"+SnapshotExtension, []byte("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filepath.Join(storage.Dir, "vault-d"+SnapshotExtension), now.Add(-3*time.Hour), now.Add(-3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(storage.Dir, "notes.txt"), []byte("not a snapshot"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(storage.Dir, "vault-a"+SnapshotExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected snapshots to be readable only by the owner, got %s", info.Mode().Perm())
+	}
+
+	snapshots, err = ListSnapshots(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	expected := "vault-b" + SnapshotExtension + ",vault-c" + SnapshotExtension + ",vault-a" + SnapshotExtension + ",vault-d" + SnapshotExtension
+	if strings.Join(names, ",") != expected {
+		t.Errorf("expected snapshots newest first %s, got %s", expected, strings.Join(names, ","))
+	}
+
+	data, err := storage.Get(ctx, "vault-c"+SnapshotExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "vault-c"+SnapshotExtension {
+		t.Errorf("expected the stored snapshot, got %q", data)
+	}
+}
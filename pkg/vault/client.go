@@ -7,15 +7,301 @@ See the LICENSE file for more details.
 package vault
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
 	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// default number of retries for 5xx responses, including a sealed Vault
+	defaultMaxRetries = 5
+	defaultTimeout    = 60 * time.Second
 )
 
 var Conf VaultConfiguration = VaultConfiguration{
 	Config: NewVault(),
 }
 
+// NewVault returns the default Vault API configuration
+//
+// Deprecated: use NewClient, which configures TLS, retries and the token
 func NewVault() vaultapi.Config {
 	config := vaultapi.DefaultConfig()
 
-	return *config
+	// the exported fields are copied so the lock of config is not
+	return vaultapi.Config{
+		Address:          config.Address,
+		AgentAddress:     config.AgentAddress,
+		HttpClient:       config.HttpClient,
+		MinRetryWait:     config.MinRetryWait,
+		MaxRetryWait:     config.MaxRetryWait,
+		MaxRetries:       config.MaxRetries,
+		Timeout:          config.Timeout,
+		Error:            config.Error,
+		Backoff:          config.Backoff,
+		CheckRetry:       config.CheckRetry,
+		Logger:           config.Logger,
+		Limiter:          config.Limiter,
+		OutputCurlString: config.OutputCurlString,
+		OutputPolicy:     config.OutputPolicy,
+		SRVLookup:        config.SRVLookup,
+		CloneHeaders:     config.CloneHeaders,
+		CloneToken:       config.CloneToken,
+		ReadYourWrites:   config.ReadYourWrites,
+		DisableRedirects: config.DisableRedirects,
+	}
+}
+
+// newClient returns a Client for the endpoint and token passed to the
+// VaultConfiguration methods, conf.Config is only read so the shared Conf is
+// never modified
+func (conf *VaultConfiguration) newClient(ctx context.Context, endpoint string, token string) (*Client, error) {
+	maxRetries := conf.Config.MaxRetries
+	if maxRetries == 0 {
+		// zero disables retries for the Vault API but is the default for NewClient
+		maxRetries = -1
+	}
+
+	return NewClient(ctx, ClientConfig{
+		Address:    endpoint,
+		Token:      token,
+		MaxRetries: maxRetries,
+		Timeout:    conf.Config.Timeout,
+	})
+}
+
+// ClientConfig configures a Vault Client
+type ClientConfig struct {
+	// Address of Vault, defaults to the local port-forward
+	Address string
+	// CACert is a PEM encoded CA bundle used to verify the Vault server
+	CACert []byte
+	// Insecure disables server certificate verification
+	Insecure bool
+	// Token authenticates the client, AuthMethod is used instead when it is set
+	Token string
+	// AuthMethod logs in to Vault, e.g. kubernetes or userpass, and is used to
+	// log in again when the token can no longer be renewed
+	AuthMethod vaultapi.AuthMethod
+	// MaxRetries for 5xx responses and a sealed Vault, defaults to 5
+	MaxRetries int
+	// Timeout for each request, defaults to 60 seconds
+	Timeout time.Duration
+}
+
+// Client wraps a Vault API client that is configured once and keeps its token
+// valid for as long as the client is used
+type Client struct {
+	api        *vaultapi.Client
+	authMethod vaultapi.AuthMethod
+
+	mu          sync.Mutex
+	stopRenewal context.CancelFunc
+}
+
+// NewClient returns a Vault client, logging in with the auth method when one is
+// configured
+func NewClient(ctx context.Context, config ClientConfig) (*Client, error) {
+	address := config.Address
+	if address == "" {
+		address = VaultDefaultAddress
+	}
+	if _, err := url.ParseRequestURI(address); err != nil {
+		return nil, fmt.Errorf("invalid vault address %q: %s", address, err)
+	}
+
+	apiConfig := vaultapi.DefaultConfig()
+	if apiConfig.Error != nil {
+		return nil, fmt.Errorf("error creating vault configuration: %s", apiConfig.Error)
+	}
+	apiConfig.Address = address
+	apiConfig.Timeout = config.Timeout
+	if apiConfig.Timeout == 0 {
+		apiConfig.Timeout = defaultTimeout
+	}
+	apiConfig.MaxRetries = config.MaxRetries
+	if apiConfig.MaxRetries == 0 {
+		apiConfig.MaxRetries = defaultMaxRetries
+	}
+	apiConfig.CheckRetry = checkRetry
+
+	err := apiConfig.ConfigureTLS(&vaultapi.TLSConfig{
+		CACertBytes: config.CACert,
+		Insecure:    config.Insecure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring vault tls: %s", err)
+	}
+
+	api, err := vaultapi.NewClient(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %s", err)
+	}
+	// the token is set explicitly below, do not pick up VAULT_TOKEN
+	api.ClearToken()
+
+	client := &Client{
+		api:        api,
+		authMethod: config.AuthMethod,
+	}
+
+	if config.AuthMethod != nil {
+		_, err = client.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.Token != "" {
+		api.SetToken(config.Token)
+	}
+	log.Info().Msgf("created vault client for %s", address)
+
+	return client, nil
+}
+
+// API returns the underlying Vault API client
+func (c *Client) API() *vaultapi.Client {
+	return c.api
+}
+
+// Address returns the address of Vault
+func (c *Client) Address() string {
+	return c.api.Address()
+}
+
+// Token returns the current Vault token
+func (c *Client) Token() string {
+	return c.api.Token()
+}
+
+// SetToken replaces the Vault token, e.g. with the root token after init
+func (c *Client) SetToken(token string) {
+	c.api.SetToken(token)
+}
+
+// StartTokenRenewal renews the client token in the background until ctx is
+// cancelled or Close is called
+//
+// When the token reaches its maximum TTL the client logs in again with its auth
+// method, without one renewal stops and the token expires
+func (c *Client) StartTokenRenewal(ctx context.Context) error {
+	secret, err := c.api.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error looking up vault token: %s", err)
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return err
+	}
+	if !renewable || ttl == 0 {
+		log.Debug().Msg("vault token is not renewable or does not expire, skipping renewal")
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	if c.stopRenewal != nil {
+		c.stopRenewal()
+	}
+	c.stopRenewal = cancel
+	c.mu.Unlock()
+
+	go c.renewToken(ctx, &vaultapi.Secret{
+		Auth: &vaultapi.SecretAuth{
+			ClientToken:   c.api.Token(),
+			Renewable:     renewable,
+			LeaseDuration: int(ttl.Seconds()),
+		},
+	})
+
+	return nil
+}
+
+// Close stops token renewal
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopRenewal != nil {
+		c.stopRenewal()
+		c.stopRenewal = nil
+	}
+}
+
+// renewToken keeps a token renewed, logging in again when it can no longer be
+// renewed and an auth method is available
+func (c *Client) renewToken(ctx context.Context, secret *vaultapi.Secret) {
+	for {
+		watcher, err := c.api.NewLifetimeWatcher(&vaultapi.LifetimeWatcherInput{Secret: secret})
+		if err != nil {
+			log.Error().Msgf("error creating vault token watcher: %s", err)
+			return
+		}
+		go watcher.Start()
+
+		done := false
+		for !done {
+			select {
+			case <-ctx.Done():
+				watcher.Stop()
+				return
+			case renewal := <-watcher.RenewCh():
+				log.Debug().Msgf("renewed vault token at %s", renewal.RenewedAt.Format(time.RFC3339))
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					log.Warn().Msgf("vault token renewal stopped: %s", err)
+				}
+				done = true
+			}
+		}
+		watcher.Stop()
+
+		if c.authMethod == nil {
+			log.Warn().Msg("vault token can no longer be renewed and no auth method is configured")
+			return
+		}
+		secret, err = c.login(ctx)
+		if err != nil {
+			log.Error().Msgf("error logging in to vault again: %s", err)
+			return
+		}
+	}
+}
+
+// login authenticates with the auth method and sets the client token
+func (c *Client) login(ctx context.Context) (*vaultapi.Secret, error) {
+	secret, err := c.api.Auth().Login(ctx, c.authMethod)
+	if err != nil {
+		return nil, fmt.Errorf("error logging in to vault: %s", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("vault login did not return a token")
+	}
+	log.Info().Msg("logged in to vault")
+
+	return secret, nil
+}
+
+// checkRetry retries connection errors and 5xx responses other than 501, which
+// includes the 503 returned while Vault is sealed or standby
+func checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	retry, retryErr := vaultapi.DefaultRetryPolicy(ctx, resp, err)
+	if retry {
+		if resp != nil {
+			log.Warn().Msgf("vault returned http status code %d, retrying", resp.StatusCode)
+		} else if err != nil {
+			log.Warn().Msgf("error contacting vault, retrying: %s", err)
+		}
+	}
+
+	return retry, retryErr
 }
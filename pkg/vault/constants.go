@@ -11,6 +11,12 @@ const (
 	VaultDefaultAddress = "http://127.0.0.1:8200"
 	// Name for the Secret that gets created that contains root auth data
 	VaultSecretName string = "vault-unseal-secret"
+	// key of the root token in the vault-unseal-secret
+	RootTokenKey = "root-token"
+	// prefix of the numbered unseal keys in the vault-unseal-secret
+	UnsealKeyPrefix = "unseal-key-"
+	// prefix of the numbered recovery keys in the vault-unseal-secret
+	RecoveryKeyPrefix = "recovery-key-"
 	// Namespace that Vault runs in
 	VaultNamespace string = "vault"
 	// number of recovery shares for Vault unseal
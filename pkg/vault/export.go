@@ -0,0 +1,280 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ExportFormat is the output format of ExportSecrets
+type ExportFormat string
+
+const (
+	// ExportFormatShell renders export statements for a bash shell
+	ExportFormatShell ExportFormat = "shell"
+	// ExportFormatDotenv renders a .env file
+	ExportFormatDotenv ExportFormat = "dotenv"
+	// ExportFormatJSON renders a JSON object
+	ExportFormatJSON ExportFormat = "json"
+	// ExportFormatSecret renders a Kubernetes Secret manifest
+	ExportFormatSecret ExportFormat = "secret"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ExportOptions configures ExportSecrets
+type ExportOptions struct {
+	// Mount of the KV v2 secrets engine, defaults to secret
+	Mount string
+	// Paths to read, the whole mount when empty
+	Paths []string
+	// Recursive also reads every secret below the paths
+	Recursive bool
+	// Format of the output, defaults to shell
+	Format ExportFormat
+	// SecretName and SecretNamespace name the Kubernetes Secret manifest
+	SecretName      string
+	SecretNamespace string
+	// FileName the output is written to with 0600 permissions, replacing any
+	// existing file, when set
+	FileName string
+}
+
+// ExportSecrets reads the key/value pairs of secrets in a KV v2 mount and
+// renders them in the requested format
+//
+// When secrets share a key the secret read last wins, paths are read in the
+// order provided and listed subpaths in lexical order
+func (c *Client) ExportSecrets(ctx context.Context, opts ExportOptions) ([]byte, error) {
+	if opts.Mount == "" {
+		opts.Mount = "secret"
+	}
+
+	values, err := c.ReadSecrets(ctx, opts.Mount, opts.Paths, opts.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := RenderSecrets(values, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.FileName != "" {
+		err = writeExportFile(opts.FileName, output)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("exported %d vault secret values to %s", len(values), opts.FileName)
+	}
+
+	return output, nil
+}
+
+// ReadSecrets returns the merged key/value pairs of the secrets at paths of a
+// KV v2 mount, non string values are JSON encoded
+func (c *Client) ReadSecrets(ctx context.Context, mount string, paths []string, recursive bool) (map[string]string, error) {
+	if len(paths) == 0 {
+		paths = []string{""}
+		recursive = true
+	}
+
+	secretPaths := make([]string, 0)
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		if !recursive {
+			secretPaths = append(secretPaths, path)
+			continue
+		}
+
+		// a path can be both a secret and a directory of secrets
+		if path != "" {
+			if _, err := c.api.KVv2(mount).GetMetadata(ctx, path); err == nil {
+				secretPaths = append(secretPaths, path)
+			}
+		}
+		listed, err := c.ListSecrets(ctx, mount, path)
+		if err != nil {
+			return nil, err
+		}
+		secretPaths = append(secretPaths, listed...)
+	}
+
+	values := make(map[string]string)
+	for _, path := range secretPaths {
+		// listing metadata includes secrets whose latest version is deleted
+		secret, err := c.api.KVv2(mount).Get(ctx, path)
+		if errors.Is(err, vaultapi.ErrSecretNotFound) {
+			log.Info().Msgf("secret %s/%s not found - skipping", mount, path)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret %s/%s: %s", mount, path, err)
+		}
+		if metadata := secret.VersionMetadata; metadata != nil && (!metadata.DeletionTime.IsZero() || metadata.Destroyed) {
+			log.Info().Msgf("latest version of secret %s/%s is deleted - skipping", mount, path)
+			continue
+		}
+		for key, value := range secret.Data {
+			switch v := value.(type) {
+			case string:
+				values[key] = v
+			default:
+				encoded, err := json.Marshal(v)
+				if err != nil {
+					return nil, fmt.Errorf("error encoding %s of secret %s/%s: %s", key, mount, path, err)
+				}
+				values[key] = string(encoded)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// ListSecrets returns the paths of every secret below path of a KV v2 mount in
+// lexical order
+func (c *Client) ListSecrets(ctx context.Context, mount string, path string) ([]string, error) {
+	listPath := fmt.Sprintf("%s/metadata/%s", mount, strings.Trim(path, "/"))
+	secret, err := c.api.Logical().ListWithContext(ctx, listPath)
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets at %s: %s", listPath, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return []string{}, nil
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name, ok := key.(string); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		child := strings.TrimPrefix(strings.Trim(path, "/")+"/"+name, "/")
+		if strings.HasSuffix(name, "/") {
+			nested, err := c.ListSecrets(ctx, mount, child)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, nested...)
+			continue
+		}
+		paths = append(paths, child)
+	}
+
+	return paths, nil
+}
+
+// RenderSecrets renders key/value pairs in the format of opts, keys are sorted
+// so the output is stable
+func RenderSecrets(values map[string]string, opts ExportOptions) ([]byte, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	format := opts.Format
+	if format == "" {
+		format = ExportFormatShell
+	}
+
+	switch format {
+	case ExportFormatShell, ExportFormatDotenv:
+		for _, key := range keys {
+			if !envNamePattern.MatchString(key) {
+				return nil, fmt.Errorf("%s is not a valid environment variable name", key)
+			}
+		}
+		return renderEnv(keys, values, format), nil
+	case ExportFormatJSON:
+		output, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(output, '\n'), nil
+	case ExportFormatSecret:
+		if opts.SecretName == "" {
+			return nil, fmt.Errorf("a secret name is required to render a kubernetes secret")
+		}
+		secret := v1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Name: opts.SecretName, Namespace: opts.SecretNamespace},
+			Type:       v1.SecretTypeOpaque,
+			StringData: values,
+		}
+		return yaml.Marshal(secret)
+	default:
+		return nil, fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// renderEnv renders the keys as export statements or dotenv lines without
+// checking that they are valid environment variable names
+func renderEnv(keys []string, values map[string]string, format ExportFormat) []byte {
+	var builder strings.Builder
+	for _, key := range keys {
+		if format == ExportFormatShell {
+			builder.WriteString(fmt.Sprintf("export %s=%s\n", key, shellQuote(values[key])))
+		} else {
+			builder.WriteString(fmt.Sprintf("%s=%s\n", key, dotenvQuote(values[key])))
+		}
+	}
+
+	return []byte(builder.String())
+}
+
+// shellQuote single quotes a value so a shell does not expand it
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
+// dotenvQuote double quotes a value, escaping the characters dotenv parsers
+// interpret inside double quotes
+func dotenvQuote(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		`$`, `\$`,
+	)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// writeExportFile replaces fileName with data readable only by the owner
+func writeExportFile(fileName string, data []byte) error {
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting file: %s", err)
+	}
+
+	err = os.WriteFile(fileName, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing file: %s", err)
+	}
+
+	return nil
+}
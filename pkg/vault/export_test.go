@@ -0,0 +1,181 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderSecrets(t *testing.T) {
+	values := map[string]string{
+		"PLAIN":  "value",
+		"QUOTED": `it's a "test" $HOME`,
+		"MULTI":  "line one\nline two",
+	}
+
+	tests := []struct {
+		name     string
+		opts     ExportOptions
+		expected string
+	}{
+		{
+			name: "shell",
+			opts: ExportOptions{Format: ExportFormatShell},
+			expected: "export MULTI='line one\nline two'\n" +
+				"export PLAIN='value'\n" +
+				`export QUOTED='it'"'"'s a "test" $HOME'` + "\n",
+		},
+		{
+			name: "dotenv",
+			opts: ExportOptions{Format: ExportFormatDotenv},
+			expected: `MULTI="line one\nline two"` + "\n" +
+				`PLAIN="value"` + "\n" +
+				`QUOTED="it's a \"test\" \$HOME"` + "\n",
+		},
+		{
+			name:     "json",
+			opts:     ExportOptions{Format: ExportFormatJSON},
+			expected: "{\n  \"MULTI\": \"line one\\nline two\",\n  \"PLAIN\": \"value\",\n  \"QUOTED\": \"it's a \\\"test\\\" $HOME\"\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := RenderSecrets(values, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tt.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expected, output)
+			}
+		})
+	}
+
+	manifest, err := RenderSecrets(values, ExportOptions{Format: ExportFormatSecret, SecretName: "atlantis", SecretNamespace: "atlantis"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"kind: Secret", "name: atlantis", "PLAIN: value"} {
+		if !strings.Contains(string(manifest), expected) {
+			t.Errorf("expected manifest to contain %q, got:\n%s", expected, manifest)
+		}
+	}
+
+	_, err = RenderSecrets(map[string]string{"not-a-var": "x"}, ExportOptions{})
+	if err == nil {
+		t.Error("expected an error for an invalid environment variable name")
+	}
+}
+
+func TestIterSecretsExportsEveryKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/atlantis" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"data":{"TF_VAR_token":"abc\n","not-a-var":"x","VAULT_ADDR":"https://vault.example.com"},"metadata":{"version":1}}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(context.Background(), ClientConfig{Address: server.URL, Token: "token", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), ".env")
+	err = client.IterSecrets(context.Background(), fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "export TF_VAR_token='abc'\n" +
+		"export VAULT_ADDR='" + server.URL + "'\n" +
+		"export not-a-var='x'\n"
+	if string(output) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestLegacyIterSecretsDoesNotModifyConf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/atlantis" || r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"data":{"TF_VAR_token":"abc"},"metadata":{"version":1}}}`))
+	}))
+	defer server.Close()
+
+	address := Conf.Config.Address
+	fileName := filepath.Join(t.TempDir(), ".env")
+	err := Conf.IterSecrets(server.URL, "token", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Conf.Config.Address != address {
+		t.Errorf("expected Conf address to stay %s, got %s", address, Conf.Config.Address)
+	}
+
+	output, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "export TF_VAR_token='abc'\n" {
+		t.Errorf("expected the secret to be exported, got:\n%s", output)
+	}
+}
+
+func TestReadSecretsSkipsDeletedSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		list := r.Method == "LIST" || r.URL.Query().Get("list") == "true"
+		switch {
+		case list && r.URL.Path == "/v1/secret/metadata":
+			w.Write([]byte(`{"data":{"keys":["app","deleted","destroyed","team/"]}}`))
+		case list && r.URL.Path == "/v1/secret/metadata/team":
+			w.Write([]byte(`{"data":{"keys":["db"]}}`))
+		case r.URL.Path == "/v1/secret/data/app":
+			w.Write([]byte(`{"data":{"data":{"APP":"app"},"metadata":{"version":1,"created_time":"2023-01-01T00:00:00Z","deletion_time":"","destroyed":false}}}`))
+		case r.URL.Path == "/v1/secret/data/deleted":
+			// the latest version is soft deleted
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"data":{"data":null,"metadata":{"version":2,"created_time":"2023-01-01T00:00:00Z","deletion_time":"2023-02-01T00:00:00Z","destroyed":false}}}`))
+		case r.URL.Path == "/v1/secret/data/destroyed":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		case r.URL.Path == "/v1/secret/data/team/db":
+			w.Write([]byte(`{"data":{"data":{"DB":"db"},"metadata":{"version":1,"created_time":"2023-01-01T00:00:00Z","deletion_time":"","destroyed":false}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(context.Background(), ClientConfig{Address: server.URL, Token: "token", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := client.ReadSecrets(context.Background(), "secret", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["APP"] != "app" || values["DB"] != "db" {
+		t.Errorf("expected only the live secrets to be read, got %v", values)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultUserpassPath = "userpass"
+
+// UserpassUser is a user of the userpass auth method
+type UserpassUser struct {
+	Username string
+	Password string
+	Policies []string
+}
+
+// Entity is a Vault identity entity, representing a person across auth methods
+type Entity struct {
+	Name     string
+	Policies []string
+	Metadata map[string]string
+}
+
+// Group is an internal Vault identity group
+type Group struct {
+	Name     string
+	Policies []string
+	// MemberEntities are entity names
+	MemberEntities []string
+	Metadata       map[string]string
+}
+
+// WriteUserpassUser creates or updates a user of the userpass auth method
+// mounted at path, the password is left unchanged when it is empty
+func (c *Client) WriteUserpassUser(ctx context.Context, path string, user UserpassUser) error {
+	if path == "" {
+		path = defaultUserpassPath
+	}
+	if user.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+
+	data := map[string]interface{}{
+		"token_policies": user.Policies,
+	}
+	if user.Password != "" {
+		data["password"] = user.Password
+	}
+
+	_, err := c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/users/%s", path, user.Username), data)
+	if err != nil {
+		return fmt.Errorf("error writing userpass user %s: %s", user.Username, err)
+	}
+	log.Info().Msgf("wrote vault userpass user %s", user.Username)
+
+	return nil
+}
+
+// DeleteUserpassUser removes a user of the userpass auth method mounted at path
+func (c *Client) DeleteUserpassUser(ctx context.Context, path string, username string) error {
+	if path == "" {
+		path = defaultUserpassPath
+	}
+
+	_, err := c.api.Logical().DeleteWithContext(ctx, fmt.Sprintf("auth/%s/users/%s", path, username))
+	if err != nil {
+		return fmt.Errorf("error deleting userpass user %s: %s", username, err)
+	}
+	log.Info().Msgf("deleted vault userpass user %s", username)
+
+	return nil
+}
+
+// WriteEntity creates or updates an identity entity and returns its ID
+func (c *Client) WriteEntity(ctx context.Context, entity Entity) (string, error) {
+	if entity.Name == "" {
+		return "", fmt.Errorf("entity name is required")
+	}
+
+	_, err := c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("identity/entity/name/%s", entity.Name), map[string]interface{}{
+		"policies": entity.Policies,
+		"metadata": entity.Metadata,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error writing identity entity %s: %s", entity.Name, err)
+	}
+	log.Info().Msgf("wrote vault identity entity %s", entity.Name)
+
+	return c.entityID(ctx, entity.Name)
+}
+
+// DeleteEntity removes an identity entity and its aliases
+func (c *Client) DeleteEntity(ctx context.Context, name string) error {
+	_, err := c.api.Logical().DeleteWithContext(ctx, fmt.Sprintf("identity/entity/name/%s", name))
+	if err != nil {
+		return fmt.Errorf("error deleting identity entity %s: %s", name, err)
+	}
+	log.Info().Msgf("deleted vault identity entity %s", name)
+
+	return nil
+}
+
+// LinkEntityAlias links the login name of the auth method mounted at path to an
+// entity, so logins through that method resolve to the entity
+func (c *Client) LinkEntityAlias(ctx context.Context, entityName string, path string, aliasName string) error {
+	accessor, err := c.authMountAccessor(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	entity, err := c.api.Logical().ReadWithContext(ctx, fmt.Sprintf("identity/entity/name/%s", entityName))
+	if err != nil {
+		return fmt.Errorf("error reading identity entity %s: %s", entityName, err)
+	}
+	if entity == nil {
+		return fmt.Errorf("identity entity %s does not exist", entityName)
+	}
+	aliases, _ := entity.Data["aliases"].([]interface{})
+	for _, alias := range aliases {
+		existing, _ := alias.(map[string]interface{})
+		if existing["mount_accessor"] == accessor && existing["name"] == aliasName {
+			return nil
+		}
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, "identity/entity-alias", map[string]interface{}{
+		"name":           aliasName,
+		"canonical_id":   entity.Data["id"],
+		"mount_accessor": accessor,
+	})
+	if err != nil {
+		return fmt.Errorf("error linking %s login %s to identity entity %s: %s", path, aliasName, entityName, err)
+	}
+	log.Info().Msgf("linked vault %s login %s to identity entity %s", path, aliasName, entityName)
+
+	return nil
+}
+
+// WriteGroup creates or updates an internal identity group, replacing its
+// members with the entities of the group, and returns its ID
+func (c *Client) WriteGroup(ctx context.Context, group Group) (string, error) {
+	if group.Name == "" {
+		return "", fmt.Errorf("group name is required")
+	}
+
+	memberIDs := make([]string, 0, len(group.MemberEntities))
+	for _, member := range group.MemberEntities {
+		id, err := c.entityID(ctx, member)
+		if err != nil {
+			return "", err
+		}
+		memberIDs = append(memberIDs, id)
+	}
+
+	return c.writeGroup(ctx, group.Name, map[string]interface{}{
+		"type":              "internal",
+		"policies":          group.Policies,
+		"metadata":          group.Metadata,
+		"member_entity_ids": memberIDs,
+	})
+}
+
+// DeleteGroup removes an identity group
+func (c *Client) DeleteGroup(ctx context.Context, name string) error {
+	_, err := c.api.Logical().DeleteWithContext(ctx, fmt.Sprintf("identity/group/name/%s", name))
+	if err != nil {
+		return fmt.Errorf("error deleting identity group %s: %s", name, err)
+	}
+	log.Info().Msgf("deleted vault identity group %s", name)
+
+	return nil
+}
+
+// AddGroupMember adds an entity to an internal identity group
+func (c *Client) AddGroupMember(ctx context.Context, groupName string, entityName string) error {
+	return c.updateGroupMembers(ctx, groupName, entityName, true)
+}
+
+// RemoveGroupMember removes an entity from an internal identity group
+func (c *Client) RemoveGroupMember(ctx context.Context, groupName string, entityName string) error {
+	return c.updateGroupMembers(ctx, groupName, entityName, false)
+}
+
+// updateGroupMembers adds or removes an entity from the members of a group,
+// keeping the other members
+func (c *Client) updateGroupMembers(ctx context.Context, groupName string, entityName string, add bool) error {
+	entityID, err := c.entityID(ctx, entityName)
+	if err != nil {
+		return err
+	}
+
+	group, err := c.api.Logical().ReadWithContext(ctx, fmt.Sprintf("identity/group/name/%s", groupName))
+	if err != nil {
+		return fmt.Errorf("error reading identity group %s: %s", groupName, err)
+	}
+	if group == nil {
+		return fmt.Errorf("identity group %s does not exist", groupName)
+	}
+
+	members := make([]string, 0)
+	found := false
+	existing, _ := group.Data["member_entity_ids"].([]interface{})
+	for _, member := range existing {
+		id, _ := member.(string)
+		if id == entityID {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		members = append(members, id)
+	}
+	if found == add {
+		return nil
+	}
+	if add {
+		members = append(members, entityID)
+	}
+
+	_, err = c.writeGroup(ctx, groupName, map[string]interface{}{"member_entity_ids": members})
+	return err
+}
+
+// writeGroup writes the fields of an identity group and returns its ID
+func (c *Client) writeGroup(ctx context.Context, name string, data map[string]interface{}) (string, error) {
+	_, err := c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("identity/group/name/%s", name), data)
+	if err != nil {
+		return "", fmt.Errorf("error writing identity group %s: %s", name, err)
+	}
+	log.Info().Msgf("wrote vault identity group %s", name)
+
+	group, err := c.api.Logical().ReadWithContext(ctx, fmt.Sprintf("identity/group/name/%s", name))
+	if err != nil || group == nil {
+		return "", fmt.Errorf("error reading identity group %s: %v", name, err)
+	}
+	id, _ := group.Data["id"].(string)
+
+	return id, nil
+}
+
+// entityID returns the ID of the named identity entity
+func (c *Client) entityID(ctx context.Context, name string) (string, error) {
+	entity, err := c.api.Logical().ReadWithContext(ctx, fmt.Sprintf("identity/entity/name/%s", name))
+	if err != nil {
+		return "", fmt.Errorf("error reading identity entity %s: %s", name, err)
+	}
+	if entity == nil {
+		return "", fmt.Errorf("identity entity %s does not exist", name)
+	}
+	id, _ := entity.Data["id"].(string)
+
+	return id, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/rs/zerolog/log"
+)
+
+// policyCapabilities are the capabilities a policy path can grant
+var policyCapabilities = map[string]bool{
+	"create": true,
+	"read":   true,
+	"update": true,
+	"patch":  true,
+	"delete": true,
+	"list":   true,
+	"sudo":   true,
+	"deny":   true,
+}
+
+// policyPathKeys are the keys allowed in a path block
+var policyPathKeys = map[string]bool{
+	"capabilities":        true,
+	"policy":              true,
+	"allowed_parameters":  true,
+	"denied_parameters":   true,
+	"required_parameters": true,
+	"min_wrapping_ttl":    true,
+	"max_wrapping_ttl":    true,
+}
+
+// ValidatePolicy checks that a policy is valid HCL made of path blocks that
+// grant known capabilities, and returns the paths it covers
+func ValidatePolicy(policy string) ([]string, error) {
+	root, err := hcl.Parse(policy)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing policy: %s", err)
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("policy does not contain a root object")
+	}
+
+	paths := make([]string, 0)
+	for _, item := range list.Items {
+		key := item.Keys[0].Token.Value()
+		if key == "name" {
+			// legacy policies may still carry their name
+			continue
+		}
+		if key != "path" {
+			return nil, fmt.Errorf("line %d: unexpected key %v, policies only contain path blocks", item.Pos().Line, key)
+		}
+		if len(item.Keys) != 2 {
+			return nil, fmt.Errorf("line %d: path blocks require a single path", item.Pos().Line)
+		}
+		path, _ := item.Keys[1].Token.Value().(string)
+		if path == "" {
+			return nil, fmt.Errorf("line %d: path cannot be empty", item.Pos().Line)
+		}
+
+		body, ok := item.Val.(*ast.ObjectType)
+		if !ok {
+			return nil, fmt.Errorf("path %q: expected a block", path)
+		}
+		for _, field := range body.List.Items {
+			name, _ := field.Keys[0].Token.Value().(string)
+			if !policyPathKeys[name] {
+				return nil, fmt.Errorf("path %q: unknown key %s", path, name)
+			}
+		}
+
+		var rules struct {
+			Capabilities []string `hcl:"capabilities"`
+			Policy       string   `hcl:"policy"`
+		}
+		err = hcl.DecodeObject(&rules, item.Val)
+		if err != nil {
+			return nil, fmt.Errorf("path %q: %s", path, err)
+		}
+		if len(rules.Capabilities) == 0 && rules.Policy == "" {
+			return nil, fmt.Errorf("path %q: capabilities are required", path)
+		}
+		for _, capability := range rules.Capabilities {
+			if !policyCapabilities[capability] {
+				return nil, fmt.Errorf("path %q: unknown capability %q", path, capability)
+			}
+		}
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("policy does not contain any paths")
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// WritePolicy validates and creates or updates an ACL policy
+func (c *Client) WritePolicy(ctx context.Context, name string, policy string) error {
+	if name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+	if name == "root" || name == "default" {
+		return fmt.Errorf("the %s policy cannot be replaced", name)
+	}
+	_, err := ValidatePolicy(policy)
+	if err != nil {
+		return fmt.Errorf("invalid policy %s: %s", name, err)
+	}
+
+	err = c.api.Sys().PutPolicyWithContext(ctx, name, policy)
+	if err != nil {
+		return fmt.Errorf("error writing policy %s: %s", name, err)
+	}
+	log.Info().Msgf("wrote vault policy %s", name)
+
+	return nil
+}
+
+// GetPolicy returns the HCL of an ACL policy, empty when it does not exist
+func (c *Client) GetPolicy(ctx context.Context, name string) (string, error) {
+	policy, err := c.api.Sys().GetPolicyWithContext(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("error reading policy %s: %s", name, err)
+	}
+
+	return policy, nil
+}
+
+// ListPolicies returns the names of the ACL policies
+func (c *Client) ListPolicies(ctx context.Context) ([]string, error) {
+	policies, err := c.api.Sys().ListPoliciesWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing policies: %s", err)
+	}
+
+	return policies, nil
+}
+
+// DeletePolicy removes an ACL policy, deleting a policy that does not exist is
+// not an error
+func (c *Client) DeletePolicy(ctx context.Context, name string) error {
+	err := c.api.Sys().DeletePolicyWithContext(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error deleting policy %s: %s", name, err)
+	}
+	log.Info().Msgf("deleted vault policy %s", name)
+
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		expected []string
+		err      string
+	}{
+		{
+			name: "path blocks",
+			policy: `
+path "secret/data/*" {
+  capabilities = ["create", "read", "update", "patch", "delete", "list"]
+}
+
+path "sys/mounts" {
+  capabilities = ["read"]
+  allowed_parameters = {
+    "type" = ["kv"]
+  }
+}
+`,
+			expected: []string{"secret/data/*", "sys/mounts"},
+		},
+		{
+			name:     "legacy policy",
+			policy:   "name = \"legacy\"\npath \"auth/*\" {\n  policy = \"sudo\"\n}\n",
+			expected: []string{"auth/*"},
+		},
+		{
+			name:   "invalid hcl",
+			policy: `path "secret/*" { capabilities = ["read"]`,
+			err:    "error parsing policy",
+		},
+		{
+			name:   "empty policy",
+			policy: "",
+			err:    "does not contain any paths",
+		},
+		{
+			name:   "unknown top level key",
+			policy: `role "admin" { capabilities = ["read"] }`,
+			err:    "unexpected key",
+		},
+		{
+			name:   "path without a name",
+			policy: `path { capabilities = ["read"] }`,
+			err:    "single path",
+		},
+		{
+			name:   "empty path",
+			policy: `path "" { capabilities = ["read"] }`,
+			err:    "path cannot be empty",
+		},
+		{
+			name:   "path assigned a value",
+			policy: `path = "secret/*"`,
+			err:    "single path",
+		},
+		{
+			name: "unknown key in path",
+			policy: `path "secret/*" { capabilities = ["read"]
+  ttl = "1h"
+}`,
+			err: "unknown key ttl",
+		},
+		{
+			name:   "unknown capability",
+			policy: `path "secret/*" { capabilities = ["read", "write"] }`,
+			err:    `unknown capability "write"`,
+		},
+		{
+			name:   "missing capabilities",
+			policy: `path "secret/*" { min_wrapping_ttl = "1m" }`,
+			err:    "capabilities are required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := ValidatePolicy(tt.policy)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected paths %v, got %v", tt.expected, paths)
+			}
+		})
+	}
+}
@@ -8,12 +8,8 @@ package vault
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"sort"
 	"strings"
-
-	vaultapi "github.com/hashicorp/vault/api"
-	"github.com/rs/zerolog/log"
 )
 
 // IterSecrets returns the contents of Vault secret data using the key/value contents of
@@ -26,67 +22,36 @@ func (conf *VaultConfiguration) IterSecrets(
 	token string,
 	fileName string,
 ) error {
-	_, err := os.Stat(fileName)
+	ctx := context.Background()
+	vaultClient, err := conf.newClient(ctx, endpoint, token)
 	if err != nil {
-		log.Info().Msgf("file %s does not exist, continuing", fileName)
-	} else {
-		err := os.Remove(fileName)
-		if err != nil {
-			return fmt.Errorf("error deleting file: %s", err)
-		}
+		return err
 	}
 
-	result := make([]map[string]interface{}, 0)
-
-	conf.Config.Address = endpoint
+	return vaultClient.IterSecrets(ctx, fileName)
+}
 
-	vaultClient, err := vaultapi.NewClient(&conf.Config)
+// IterSecrets writes the atlantis secrets as export statements to fileName,
+// replacing the file when it exists
+func (c *Client) IterSecrets(ctx context.Context, fileName string) error {
+	values, err := c.ReadSecrets(ctx, "secret", []string{"atlantis"}, false)
 	if err != nil {
 		return err
 	}
-	vaultClient.SetToken(token)
-	if strings.Contains(endpoint, "http://") {
-		vaultClient.CloneConfig().ConfigureTLS(&vaultapi.TLSConfig{
-			Insecure: true,
-		})
+	for k, v := range values {
+		values[k] = strings.TrimSuffix(v, "\n")
 	}
-	log.Info().Msg("created vault client")
-
-	secretsToUse := []string{"atlantis"}
-
-	for _, s := range secretsToUse {
-		resp, err := vaultClient.KVv2("secret").Get(context.Background(), s)
-		if err != nil {
-			return err
-		}
-		result = append(result, resp.Data)
-	}
-
-	_, err = os.Create(fileName)
-	if err != nil {
-		return fmt.Errorf("error creating file: %s", err)
-	}
-	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("error opening file: %s", err)
+	if _, ok := values["VAULT_ADDR"]; ok {
+		values["VAULT_ADDR"] = c.Address()
 	}
-	defer f.Close()
 
-	for _, m := range result {
-		for k, v := range m {
-			if k == "VAULT_ADDR" {
-				_, err = f.WriteString(fmt.Sprintf("export %s=\"%v\"\n", k, endpoint))
-				if err != nil {
-					return fmt.Errorf("error writing to file: %s", err)
-				}
-			} else {
-				_, err = f.WriteString(fmt.Sprintf("export %s=\"%v\"\n", k, strings.TrimSuffix(v.(string), "\n")))
-				if err != nil {
-					return fmt.Errorf("error writing to file: %s", err)
-				}
-			}
-		}
+	// every key is exported as it always was, RenderSecrets would reject keys
+	// that are not valid environment variable names
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	return nil
+	return writeExportFile(fileName, renderEnv(keys, values, ExportFormatShell))
 }
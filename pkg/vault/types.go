@@ -8,6 +8,11 @@ package vault
 
 import vaultapi "github.com/hashicorp/vault/api"
 
+// VaultConfiguration holds the methods that predate Client
+//
+// Deprecated: use Client
 type VaultConfiguration struct {
+	// Config configures the client of each method, Address is replaced with the
+	// endpoint the method is passed
 	Config vaultapi.Config
 }
@@ -0,0 +1,411 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	vaultPodPort         = 8200
+	defaultUnsealTimeout = 5 * time.Minute
+)
+
+// vaultKeysBackoff retries storing the root token and keys, they only exist in
+// memory until they are stored
+var vaultKeysBackoff = wait.Backoff{
+	Steps:    6,
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// InitAndUnsealOptions configures InitAndUnseal
+type InitAndUnsealOptions struct {
+	// Namespace of the Vault StatefulSet, defaults to vault
+	Namespace string
+	// StatefulSet name, defaults to vault
+	StatefulSet string
+	// TLS is set when the Vault listener serves https, certificates are not
+	// verified as the pods are reached through a local port forward
+	TLS bool
+	// LeaderAPIAddr is the address raft followers join, defaults to the first
+	// replica behind the <statefulset>-internal headless service
+	LeaderAPIAddr string
+	// Timeout for all replicas to be running and unsealed, defaults to 5 minutes
+	Timeout time.Duration
+}
+
+// PodSealStatus is the state of a single Vault replica
+type PodSealStatus struct {
+	Pod         string
+	Initialized bool
+	Sealed      bool
+	// Joined is set when the replica joined the raft leader during this run
+	Joined bool
+}
+
+// InitAndUnsealResult is returned by InitAndUnseal
+type InitAndUnsealResult struct {
+	// Initialized is set when Vault was initialized during this run
+	Initialized bool
+	// RootToken of Vault, read from the vault-unseal-secret on later runs
+	RootToken string
+	// UnsealKeys and RecoveryKeys are only set, together with an error, when
+	// Vault was initialized during this run but the keys could not be stored in
+	// the vault-unseal-secret - they are the only copy and have to be kept
+	UnsealKeys   []string
+	RecoveryKeys []string
+	Pods         []PodSealStatus
+}
+
+// vaultKeys are the root token and keys stored in the vault-unseal-secret
+type vaultKeys struct {
+	rootToken    string
+	unsealKeys   []string
+	recoveryKeys []string
+}
+
+// InitAndUnseal initializes Vault once, stores the root token and keys in the
+// vault-unseal-secret and unseals every replica of the StatefulSet
+//
+// Each replica is reached through its own port forward so its state can be
+// detected individually. Replicas that are not initialized once Vault has been
+// initialized are raft followers and join the leader before being unsealed.
+// Replicas using auto unseal are only initialized, with recovery keys stored
+// instead of unseal keys. Running it again against an initialized and unsealed
+// Vault changes nothing
+//
+// When the keys of a newly initialized Vault cannot be stored the result is
+// returned along with the error, carrying the root token and keys
+func InitAndUnseal(ctx context.Context, kcl *k8s.KubernetesClient, opts InitAndUnsealOptions) (*InitAndUnsealResult, error) {
+	if opts.Namespace == "" {
+		opts.Namespace = VaultNamespace
+	}
+	if opts.StatefulSet == "" {
+		opts.StatefulSet = "vault"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultUnsealTimeout
+	}
+	scheme := "http"
+	if opts.TLS {
+		scheme = "https"
+	}
+	if opts.LeaderAPIAddr == "" {
+		opts.LeaderAPIAddr = fmt.Sprintf("%s://%s-0.%s-internal:%d", scheme, opts.StatefulSet, opts.StatefulSet, vaultPodPort)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	pods, err := waitForVaultPods(ctx, kcl.Clientset, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*Client, 0, len(pods))
+	for _, pod := range pods {
+		forward, err := k8s.OpenPodPortForward(ctx, kcl.Clientset, kcl.RestConfig, opts.Namespace, pod.Name, vaultPodPort)
+		if err != nil {
+			return nil, err
+		}
+		defer forward.Close()
+
+		client, err := NewClient(ctx, ClientConfig{
+			Address:  fmt.Sprintf("%s://localhost:%d", scheme, forward.LocalPort),
+			Insecure: opts.TLS,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating vault client for pod %s: %s", pod.Name, err)
+		}
+		clients = append(clients, client)
+	}
+
+	return initAndUnsealPods(ctx, kcl.Clientset, opts, pods, clients)
+}
+
+// initAndUnsealPods initializes Vault through the first of the pods if no pod
+// is initialized and unseals every pod, clients are ordered like pods
+func initAndUnsealPods(ctx context.Context, clientset kubernetes.Interface, opts InitAndUnsealOptions, pods []v1.Pod, clients []*Client) (*InitAndUnsealResult, error) {
+	var err error
+	result := &InitAndUnsealResult{Pods: make([]PodSealStatus, len(pods))}
+	statuses := make([]*vaultapi.SealStatusResponse, len(pods))
+	initialized := false
+	for i, client := range clients {
+		statuses[i], err = client.api.Sys().SealStatusWithContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading seal status of pod %s: %s", pods[i].Name, err)
+		}
+		initialized = initialized || statuses[i].Initialized
+		log.Info().Msgf("vault pod %s initialized: %t, sealed: %t", pods[i].Name, statuses[i].Initialized, statuses[i].Sealed)
+	}
+
+	var keys *vaultKeys
+	if initialized {
+		keys, err = readVaultKeys(ctx, clientset, opts.Namespace)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		keys, err = initializeVault(ctx, clients[0], statuses[0])
+		if err != nil {
+			return nil, err
+		}
+		err = retry.OnError(vaultKeysBackoff, func(error) bool { return ctx.Err() == nil }, func() error {
+			return writeVaultKeys(ctx, clientset, opts.Namespace, keys)
+		})
+		if err != nil {
+			log.Error().Msgf("vault was initialized but its root token and keys could not be stored in secret %s/%s", opts.Namespace, VaultSecretName)
+			result.Initialized = true
+			result.RootToken = keys.rootToken
+			result.UnsealKeys = keys.unsealKeys
+			result.RecoveryKeys = keys.recoveryKeys
+			return result, err
+		}
+		result.Initialized = true
+		statuses[0], err = clients[0].api.Sys().SealStatusWithContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading seal status of pod %s: %s", pods[0].Name, err)
+		}
+	}
+	result.RootToken = keys.rootToken
+
+	for i, client := range clients {
+		podStatus := PodSealStatus{Pod: pods[i].Name}
+
+		// once Vault is initialized a replica that is not is a raft follower
+		// that still has to join the leader
+		if !statuses[i].Initialized {
+			_, err := client.api.Sys().RaftJoinWithContext(ctx, &vaultapi.RaftJoinRequest{
+				LeaderAPIAddr: opts.LeaderAPIAddr,
+				Retry:         true,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error joining pod %s to raft leader %s: %s", pods[i].Name, opts.LeaderAPIAddr, err)
+			}
+			podStatus.Joined = true
+			log.Info().Msgf("vault pod %s joined raft leader %s", pods[i].Name, opts.LeaderAPIAddr)
+		}
+
+		status, err := unsealPod(ctx, client, pods[i].Name, keys)
+		if err != nil {
+			return nil, err
+		}
+		podStatus.Initialized = status.Initialized
+		podStatus.Sealed = status.Sealed
+		result.Pods[i] = podStatus
+	}
+
+	return result, nil
+}
+
+// waitForVaultPods returns the pods of the StatefulSet ordered by ordinal once
+// every replica is running
+func waitForVaultPods(ctx context.Context, clientset kubernetes.Interface, opts InitAndUnsealOptions) ([]v1.Pod, error) {
+	statefulSet, err := clientset.AppsV1().StatefulSets(opts.Namespace).Get(ctx, opts.StatefulSet, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting statefulset %s/%s: %s", opts.Namespace, opts.StatefulSet, err)
+	}
+	replicas := 1
+	if statefulSet.Spec.Replicas != nil {
+		replicas = int(*statefulSet.Spec.Replicas)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(statefulSet.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("error reading selector of statefulset %s: %s", opts.StatefulSet, err)
+	}
+
+	for {
+		pods, err := runningStatefulSetPods(ctx, clientset, opts, selector)
+		if err != nil {
+			return nil, err
+		}
+		if len(pods) >= replicas {
+			return pods, nil
+		}
+		log.Info().Msgf("waiting for vault pods to be running, %d of %d running", len(pods), replicas)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for %d vault pods to be running", replicas)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// runningStatefulSetPods returns the running pods of the StatefulSet ordered by
+// ordinal
+func runningStatefulSetPods(ctx context.Context, clientset kubernetes.Interface, opts InitAndUnsealOptions, selector labels.Selector) ([]v1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(opts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("error listing vault pods: %s", err)
+	}
+
+	pods := make([]v1.Pod, 0, len(podList.Items))
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == v1.PodRunning && strings.HasPrefix(pod.Name, opts.StatefulSet+"-") {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return podOrdinal(pods[i].Name) < podOrdinal(pods[j].Name)
+	})
+
+	return pods, nil
+}
+
+// podOrdinal returns the ordinal of a StatefulSet pod name, e.g. 2 for vault-2
+func podOrdinal(name string) int {
+	ordinal, err := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
+
+// initializeVault initializes Vault through the first replica, using recovery
+// keys when the replica is configured with auto unseal
+func initializeVault(ctx context.Context, client *Client, status *vaultapi.SealStatusResponse) (*vaultKeys, error) {
+	request := &vaultapi.InitRequest{
+		SecretShares:    SecretShares,
+		SecretThreshold: SecretThreshold,
+	}
+	if status.Type != "" && status.Type != "shamir" {
+		request = &vaultapi.InitRequest{
+			RecoveryShares:    RecoveryShares,
+			RecoveryThreshold: RecoveryThreshold,
+		}
+	}
+
+	initResponse, err := client.api.Sys().InitWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing vault: %s", err)
+	}
+	log.Info().Msgf("vault initialization complete, seal type %s", status.Type)
+
+	return &vaultKeys{
+		rootToken:    initResponse.RootToken,
+		unsealKeys:   initResponse.Keys,
+		recoveryKeys: initResponse.RecoveryKeys,
+	}, nil
+}
+
+// unsealPod submits unseal keys until the replica is unsealed
+func unsealPod(ctx context.Context, client *Client, podName string, keys *vaultKeys) (*vaultapi.SealStatusResponse, error) {
+	status, err := client.api.Sys().SealStatusWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading seal status of pod %s: %s", podName, err)
+	}
+	if !status.Sealed {
+		return status, nil
+	}
+	if status.Type != "" && status.Type != "shamir" {
+		// auto unseal replicas unseal themselves once initialized or joined
+		return waitForUnseal(ctx, client, podName)
+	}
+	if len(keys.unsealKeys) == 0 {
+		return nil, fmt.Errorf("pod %s is sealed and no unseal keys are stored in %s", podName, VaultSecretName)
+	}
+
+	for _, key := range keys.unsealKeys {
+		status, err = client.api.Sys().UnsealWithContext(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error unsealing pod %s: %s", podName, err)
+		}
+		if !status.Sealed {
+			log.Info().Msgf("vault pod %s unsealed", podName)
+			return status, nil
+		}
+	}
+
+	return nil, fmt.Errorf("pod %s is still sealed after submitting %d unseal keys", podName, len(keys.unsealKeys))
+}
+
+// waitForUnseal waits for a replica using auto unseal to report it is unsealed
+func waitForUnseal(ctx context.Context, client *Client, podName string) (*vaultapi.SealStatusResponse, error) {
+	for {
+		status, err := client.api.Sys().SealStatusWithContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading seal status of pod %s: %s", podName, err)
+		}
+		if !status.Sealed {
+			log.Info().Msgf("vault pod %s unsealed", podName)
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for pod %s to auto unseal", podName)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// writeVaultKeys stores the root token and keys in the vault-unseal-secret
+func writeVaultKeys(ctx context.Context, clientset kubernetes.Interface, namespace string, keys *vaultKeys) error {
+	data := map[string][]byte{RootTokenKey: []byte(keys.rootToken)}
+	for i, key := range keys.unsealKeys {
+		data[fmt.Sprintf("%s%d", UnsealKeyPrefix, i)] = []byte(key)
+	}
+	for i, key := range keys.recoveryKeys {
+		data[fmt.Sprintf("%s%d", RecoveryKeyPrefix, i)] = []byte(key)
+	}
+
+	_, err := k8s.EnsureSecret(ctx, clientset, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: VaultSecretName, Namespace: namespace},
+		Type:       v1.SecretTypeOpaque,
+		Data:       data,
+	})
+	if err != nil {
+		return fmt.Errorf("error storing vault keys in secret %s: %s", VaultSecretName, err)
+	}
+	log.Info().Msgf("stored vault root token and keys in secret %s/%s", namespace, VaultSecretName)
+
+	return nil
+}
+
+// readVaultKeys reads the root token and keys from the vault-unseal-secret
+func readVaultKeys(ctx context.Context, clientset kubernetes.Interface, namespace string) (*vaultKeys, error) {
+	secret, err := k8s.GetSecret(ctx, clientset, namespace, VaultSecretName)
+	if err != nil {
+		return nil, fmt.Errorf("vault is initialized but secret %s could not be read: %s", VaultSecretName, err)
+	}
+
+	keys := &vaultKeys{rootToken: string(secret.Data[RootTokenKey])}
+	for i := 0; ; i++ {
+		key, ok := secret.Data[fmt.Sprintf("%s%d", UnsealKeyPrefix, i)]
+		if !ok {
+			break
+		}
+		keys.unsealKeys = append(keys.unsealKeys, string(key))
+	}
+	for i := 0; ; i++ {
+		key, ok := secret.Data[fmt.Sprintf("%s%d", RecoveryKeyPrefix, i)]
+		if !ok {
+			break
+		}
+		keys.recoveryKeys = append(keys.recoveryKeys, string(key))
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testVaultPod serves the sys endpoints of a single shamir sealed replica
+type testVaultPod struct {
+	mu          sync.Mutex
+	initialized bool
+	sealed      bool
+	submitted   int
+	joined      string
+}
+
+func (p *testVaultPod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/v1/sys/seal-status":
+	case r.URL.Path == "/v1/sys/init" && r.Method == http.MethodPut:
+		if p.initialized {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["Vault is already initialized"]}`))
+			return
+		}
+		p.initialized = true
+		keys := make([]string, 0, SecretShares)
+		for i := 0; i < SecretShares; i++ {
+			keys = append(keys, fmt.Sprintf("key-%d", i))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys, "keys_base64": keys, "root_token": "root"})
+		return
+	case r.URL.Path == "/v1/sys/unseal" && r.Method == http.MethodPut:
+		p.submitted++
+		if p.submitted >= SecretThreshold {
+			p.sealed = false
+		}
+	case r.URL.Path == "/v1/sys/storage/raft/join" && r.Method == http.MethodPost:
+		var request struct {
+			LeaderAPIAddr string `json:"leader_api_addr"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		p.joined = request.LeaderAPIAddr
+		p.initialized = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"joined": true})
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "shamir",
+		"initialized": p.initialized,
+		"sealed":      p.sealed,
+		"t":           SecretThreshold,
+		"n":           SecretShares,
+		"progress":    p.submitted,
+	})
+}
+
+// newTestVaultPods starts a server for every replica and returns the pods and
+// their clients
+func newTestVaultPods(t *testing.T, replicas []*testVaultPod) ([]v1.Pod, []*Client) {
+	pods := make([]v1.Pod, 0, len(replicas))
+	clients := make([]*Client, 0, len(replicas))
+	for i, replica := range replicas {
+		server := httptest.NewServer(replica)
+		t.Cleanup(server.Close)
+
+		client, err := NewClient(context.Background(), ClientConfig{Address: server.URL, MaxRetries: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pods = append(pods, v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("vault-%d", i), Namespace: "vault"}})
+		clients = append(clients, client)
+	}
+
+	return pods, clients
+}
+
+// newTestUnsealClientset returns a fake clientset that stores applied Secrets,
+// server-side apply is not supported by the fake object tracker
+func newTestUnsealClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		secret := &v1.Secret{}
+		err := json.Unmarshal(patch.GetPatch(), secret)
+		if err != nil {
+			return true, nil, err
+		}
+		secret.Namespace = patch.GetNamespace()
+		err = clientset.Tracker().Add(secret)
+		if errors.IsAlreadyExists(err) {
+			err = clientset.Tracker().Update(v1.SchemeGroupVersion.WithResource("secrets"), secret, secret.Namespace)
+		}
+		return true, secret, err
+	})
+
+	return clientset
+}
+
+var testUnsealOptions = InitAndUnsealOptions{
+	Namespace:     "vault",
+	StatefulSet:   "vault",
+	LeaderAPIAddr: "http://vault-0.vault-internal:8200",
+}
+
+func TestInitAndUnsealPodsInitializes(t *testing.T) {
+	replicas := []*testVaultPod{{sealed: true}, {sealed: true}}
+	pods, clients := newTestVaultPods(t, replicas)
+	clientset := newTestUnsealClientset()
+
+	result, err := initAndUnsealPods(context.Background(), clientset, testUnsealOptions, pods, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Initialized || result.RootToken != "root" {
+		t.Errorf("expected vault to be initialized with root token root, got %+v", result)
+	}
+	if len(result.UnsealKeys) != 0 {
+		t.Errorf("expected stored unseal keys not to be returned, got %v", result.UnsealKeys)
+	}
+	expected := []PodSealStatus{
+		{Pod: "vault-0", Initialized: true},
+		{Pod: "vault-1", Initialized: true, Joined: true},
+	}
+	for i, status := range result.Pods {
+		if status != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], status)
+		}
+	}
+	if replicas[0].joined != "" || replicas[1].joined != testUnsealOptions.LeaderAPIAddr {
+		t.Errorf("expected only vault-1 to join the leader, got %q and %q", replicas[0].joined, replicas[1].joined)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("vault").Get(context.Background(), VaultSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data[RootTokenKey]) != "root" || string(secret.Data[UnsealKeyPrefix+"4"]) != "key-4" {
+		t.Errorf("expected the root token and unseal keys to be stored, got %v", secret.Data)
+	}
+}
+
+func TestInitAndUnsealPodsAlreadyInitialized(t *testing.T) {
+	replicas := []*testVaultPod{{initialized: true, sealed: true}, {initialized: true}}
+	pods, clients := newTestVaultPods(t, replicas)
+	clientset := newTestUnsealClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: VaultSecretName, Namespace: "vault"},
+		Data: map[string][]byte{
+			RootTokenKey:          []byte("stored-root"),
+			UnsealKeyPrefix + "0": []byte("key-0"),
+			UnsealKeyPrefix + "1": []byte("key-1"),
+			UnsealKeyPrefix + "2": []byte("key-2"),
+		},
+	})
+
+	result, err := initAndUnsealPods(context.Background(), clientset, testUnsealOptions, pods, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Initialized || result.RootToken != "stored-root" {
+		t.Errorf("expected the stored root token without initializing, got %+v", result)
+	}
+	if replicas[0].submitted != SecretThreshold || replicas[1].submitted != 0 {
+		t.Errorf("expected only the sealed replica to be unsealed, got %d and %d keys", replicas[0].submitted, replicas[1].submitted)
+	}
+	for _, status := range result.Pods {
+		if status.Sealed || status.Joined {
+			t.Errorf("expected %s to be unsealed without joining, got %+v", status.Pod, status)
+		}
+	}
+}
+
+func TestInitAndUnsealPodsJoinsFollowers(t *testing.T) {
+	replicas := []*testVaultPod{{initialized: true}, {sealed: true}, {sealed: true}}
+	pods, clients := newTestVaultPods(t, replicas)
+	clientset := newTestUnsealClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: VaultSecretName, Namespace: "vault"},
+		Data: map[string][]byte{
+			RootTokenKey:          []byte("root"),
+			UnsealKeyPrefix + "0": []byte("key-0"),
+			UnsealKeyPrefix + "1": []byte("key-1"),
+			UnsealKeyPrefix + "2": []byte("key-2"),
+		},
+	})
+
+	result, err := initAndUnsealPods(context.Background(), clientset, testUnsealOptions, pods, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range result.Pods {
+		if status.Joined != (i > 0) || status.Sealed {
+			t.Errorf("expected %s to be unsealed and joined %t, got %+v", status.Pod, i > 0, status)
+		}
+	}
+	if replicas[1].joined != testUnsealOptions.LeaderAPIAddr || replicas[2].joined != testUnsealOptions.LeaderAPIAddr {
+		t.Errorf("expected the followers to join %s", testUnsealOptions.LeaderAPIAddr)
+	}
+}
+
+func TestInitAndUnsealPodsReturnsKeysThatCannotBeStored(t *testing.T) {
+	backoff := vaultKeysBackoff
+	vaultKeysBackoff = wait.Backoff{Steps: 3, Duration: time.Millisecond}
+	defer func() { vaultKeysBackoff = backoff }()
+
+	replicas := []*testVaultPod{{sealed: true}}
+	pods, clients := newTestVaultPods(t, replicas)
+	attempts := 0
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		return true, nil, fmt.Errorf("etcdserver: request timed out")
+	})
+
+	result, err := initAndUnsealPods(context.Background(), clientset, testUnsealOptions, pods, clients)
+	if err == nil {
+		t.Fatal("expected an error storing the keys")
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts to store the keys, got %d", attempts)
+	}
+	if result == nil || !result.Initialized || result.RootToken != "root" || len(result.UnsealKeys) != SecretShares {
+		t.Fatalf("expected the root token and unseal keys to be returned, got %+v", result)
+	}
+	if replicas[0].submitted != 0 {
+		t.Errorf("expected vault not to be unsealed, %d keys were submitted", replicas[0].submitted)
+	}
+}
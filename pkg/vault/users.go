@@ -8,33 +8,127 @@ package vault
 
 import (
 	"context"
-	"strings"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
 
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	passwordLength  = 20
+	passwordCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
 // GetUserPassword retrieves the password for a Vault user at the users mount path
 func (conf *VaultConfiguration) GetUserPassword(endpoint string, token string, username string, key string) (string, error) {
-	conf.Config.Address = endpoint
+	ctx := context.Background()
+	vaultClient, err := conf.newClient(ctx, endpoint, token)
+	if err != nil {
+		return "", err
+	}
 
-	vaultClient, err := vaultapi.NewClient(&conf.Config)
+	return vaultClient.GetUserPassword(ctx, username, key)
+}
+
+// GetUserPassword retrieves the password for a Vault user at the users mount path
+func (c *Client) GetUserPassword(ctx context.Context, username string, key string) (string, error) {
+	resp, err := c.api.KVv2("users").Get(ctx, username)
 	if err != nil {
 		return "", err
 	}
-	vaultClient.SetToken(token)
-	if strings.Contains(endpoint, "http://") {
-		vaultClient.CloneConfig().ConfigureTLS(&vaultapi.TLSConfig{
-			Insecure: true,
-		})
+
+	password, ok := resp.Data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %s was not found for user %s", key, username)
 	}
 
-	log.Info().Msg("created vault client")
+	return password, nil
+}
+
+// RotateUserPassword generates a new password for a userpass user, stores it at
+// key of the user's secret in the users mount and sets it on the userpass auth
+// method mounted at path, returning the new password
+//
+// The new password is stored before it is set on the login, and the secret is
+// restored to its previous version when setting it fails, so the users mount
+// always holds the password that works
+func (c *Client) RotateUserPassword(ctx context.Context, path string, username string, key string) (string, error) {
+	if path == "" {
+		path = defaultUserpassPath
+	}
+	kv := c.api.KVv2("users")
+
+	previous := make(map[string]interface{})
+	current, err := kv.Get(ctx, username)
+	if err != nil && !errors.Is(err, vaultapi.ErrSecretNotFound) {
+		return "", fmt.Errorf("error reading secret of user %s: %s", username, err)
+	}
+	if err == nil {
+		previous = current.Data
+	}
 
-	resp, err := vaultClient.KVv2("users").Get(context.Background(), username)
+	password, err := GeneratePassword(passwordLength)
 	if err != nil {
 		return "", err
 	}
 
-	return resp.Data[key].(string), nil
+	data := make(map[string]interface{}, len(previous)+1)
+	for k, v := range previous {
+		data[k] = v
+	}
+	data[key] = password
+	written, err := kv.Put(ctx, username, data)
+	if err != nil {
+		return "", fmt.Errorf("error storing new password of user %s: %s", username, err)
+	}
+
+	_, err = c.api.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/users/%s/password", path, username), map[string]interface{}{
+		"password": password,
+	})
+	if err != nil {
+		rollbackErr := c.restoreUserSecret(ctx, username, current != nil, previous, written.VersionMetadata.Version)
+		if rollbackErr != nil {
+			return "", fmt.Errorf("error setting password of userpass user %s: %s, and restoring the previous password failed: %s", username, err, rollbackErr)
+		}
+		return "", fmt.Errorf("error setting password of userpass user %s: %s", username, err)
+	}
+	log.Info().Msgf("rotated password of vault user %s", username)
+
+	return password, nil
+}
+
+// restoreUserSecret undoes the version of a user's secret written by a failed
+// rotation, deleting it when the user had no secret before
+func (c *Client) restoreUserSecret(ctx context.Context, username string, existed bool, previous map[string]interface{}, writtenVersion int) error {
+	kv := c.api.KVv2("users")
+	if !existed {
+		return kv.Delete(ctx, username)
+	}
+
+	_, err := kv.Put(ctx, username, previous, vaultapi.WithCheckAndSet(writtenVersion))
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("restored previous password of vault user %s", username)
+
+	return nil
+}
+
+// GeneratePassword returns a random password of length characters using a
+// cryptographically secure source
+func GeneratePassword(length int) (string, error) {
+	password := make([]byte, length)
+	max := big.NewInt(int64(len(passwordCharset)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating password: %s", err)
+		}
+		password[i] = passwordCharset[n.Int64()]
+	}
+
+	return string(password), nil
 }
@@ -0,0 +1,153 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUsersVault serves the users KV v2 mount and the userpass password
+// endpoint, keeping every version of each secret
+type testUsersVault struct {
+	mu              sync.Mutex
+	versions        map[string][]map[string]interface{}
+	deleted         map[string]bool
+	passwords       map[string]string
+	failSetPassword bool
+}
+
+func (v *testUsersVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/users/data/"):
+		username := strings.TrimPrefix(r.URL.Path, "/v1/users/data/")
+		versions := v.versions[username]
+		switch r.Method {
+		case http.MethodGet:
+			if len(versions) == 0 || v.deleted[username] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     versions[len(versions)-1],
+				"metadata": map[string]interface{}{"version": len(versions), "created_time": time.Now().Format(time.RFC3339)},
+			}})
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Data    map[string]interface{} `json:"data"`
+				Options map[string]interface{} `json:"options"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if cas, ok := body.Options["cas"].(float64); ok && int(cas) != len(versions) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+				return
+			}
+			v.versions[username] = append(versions, body.Data)
+			delete(v.deleted, username)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"version": len(v.versions[username]), "created_time": time.Now().Format(time.RFC3339),
+			}})
+		case http.MethodDelete:
+			v.deleted[username] = true
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/auth/userpass/users/") && strings.HasSuffix(r.URL.Path, "/password"):
+		if v.failSetPassword {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/auth/userpass/users/"), "/password")
+		v.passwords[username] = body["password"]
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRotateUserPassword(t *testing.T) {
+	tests := []struct {
+		name            string
+		existing        map[string]interface{}
+		failSetPassword bool
+	}{
+		{name: "existing secret", existing: map[string]interface{}{"initial-password": "old", "email": "kbot@example.com"}},
+		{name: "no secret yet"},
+		{name: "set password fails", existing: map[string]interface{}{"initial-password": "old"}, failSetPassword: true},
+		{name: "set password fails without a secret", failSetPassword: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := &testUsersVault{
+				versions:        map[string][]map[string]interface{}{},
+				deleted:         map[string]bool{},
+				passwords:       map[string]string{"kbot": "old"},
+				failSetPassword: tt.failSetPassword,
+			}
+			if tt.existing != nil {
+				vault.versions["kbot"] = []map[string]interface{}{tt.existing}
+			}
+			server := httptest.NewServer(vault)
+			defer server.Close()
+
+			client, err := NewClient(context.Background(), ClientConfig{Address: server.URL, Token: "token", MaxRetries: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			password, err := client.RotateUserPassword(context.Background(), "", "kbot", "initial-password")
+			versions := vault.versions["kbot"]
+
+			if tt.failSetPassword {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if vault.passwords["kbot"] != "old" {
+					t.Errorf("expected the login password to be unchanged")
+				}
+				if tt.existing == nil {
+					if !vault.deleted["kbot"] {
+						t.Errorf("expected the secret written by the rotation to be deleted")
+					}
+					return
+				}
+				if versions[len(versions)-1]["initial-password"] != "old" {
+					t.Errorf("expected the previous password to be restored, got %v", versions[len(versions)-1])
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(password) != passwordLength || vault.passwords["kbot"] != password {
+				t.Errorf("expected the login password to be the returned password")
+			}
+			latest := versions[len(versions)-1]
+			if latest["initial-password"] != password {
+				t.Errorf("expected the stored password to be the returned password, got %v", latest)
+			}
+			if tt.existing != nil && latest["email"] != "kbot@example.com" {
+				t.Errorf("expected other keys of the secret to be kept, got %v", latest)
+			}
+		})
+	}
+}